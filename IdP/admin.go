@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// caAdminUID is the CA administrator, who logs in with a certificate of the root pki mount.
+	caAdminUID     = "admin"
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// authenticateAdmin is like authenticate, but additionally requires the subject to be an
+// administrator.
+func (s server) authenticateAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return "", false
+	}
+	if id == caAdminUID {
+		return id, true
+	}
+	u, err := s.db.GetUser(r.Context(), id)
+	if err != nil && err != sql.ErrNoRows {
+		log.WithError(err).WithField("uid", id).Error("Failed to get user.")
+		s.httpInternalError(w, fmt.Errorf("failed to get user"))
+		return "", false
+	}
+	if err == sql.ErrNoRows || !u.Admin || u.Disabled {
+		log.WithField("uid", id).Warn("Non-admin tried to access the admin API.")
+		s.httpUnauthorized(w)
+		return "", false
+	}
+	return id, true
+}
+
+type userList struct {
+	Users   []User `json:"users"`
+	Total   int    `json:"total"`
+	Page    int    `json:"page"`
+	PerPage int    `json:"perPage"`
+}
+
+// AdminListUsers lists users page by page. The optional query parameter q searches uid, name and
+// email.
+func (s server) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticateAdmin(w, r); !ok {
+		return
+	}
+	q := r.URL.Query()
+	page, err := queryInt(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		s.httpBadRequest(w, "invalid page")
+		return
+	}
+	perPage, err := queryInt(q.Get("per_page"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		s.httpBadRequest(w, fmt.Sprintf("per_page must be between 1 and %d", maxPerPage))
+		return
+	}
+
+	users, total, err := s.db.ListUsers(r.Context(), q.Get("q"), (page-1)*perPage, perPage)
+	if err != nil {
+		log.WithError(err).Error("Failed to list users.")
+		s.httpInternalError(w, fmt.Errorf("failed to list users"))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, userList{Users: users, Total: total, Page: page, PerPage: perPage})
+}
+
+func queryInt(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func (s server) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticateAdmin(w, r); !ok {
+		return
+	}
+	uid := mux.Vars(r)["uid"]
+	u, err := s.db.GetUser(r.Context(), uid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			s.httpNotFound(w)
+			return
+		}
+		log.WithError(err).WithField("user-id", uid).Error("Failed to GetUser.")
+		s.httpInternalError(w, fmt.Errorf("failed to get user"))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, u)
+}
+
+type createUserRequest struct {
+	User
+	// Password is optional, a random one is generated and returned if it is empty.
+	Password string `json:"password"`
+}
+
+type passwordResponse struct {
+	User     *User  `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func (s server) AdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("admin", admin)
+
+	var req createUserRequest
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(reqBody) == 0 {
+		l.WithError(err).Error("AdminCreateUser request without body")
+		s.httpBadRequest(w, "Could not parse body.")
+		return
+	}
+	err = json.Unmarshal(reqBody, &req)
+	if err != nil {
+		l.WithError(err).Error("AdminCreateUser error unmarshaling json")
+		s.httpBadRequest(w, "Could not parse body.")
+		return
+	}
+	if req.UserID == caAdminUID {
+		s.httpBadRequest(w, "Reserved id")
+		return
+	}
+	err = validateUser(req.User)
+	if err != nil {
+		l.WithError(err).Error("Invalid user.")
+		s.httpBadRequest(w, err.Error())
+		return
+	}
+
+	res := passwordResponse{User: &req.User}
+	password := req.Password
+	if password == "" {
+		password, err = generatePassword()
+		if err != nil {
+			s.httpInternalError(w, err)
+			return
+		}
+		res.Password = password
+	} else {
+		vs, err := s.policy.Check(password, req.User)
+		if err != nil {
+			l.WithError(err).Error("Failed to check password policy.")
+			s.httpInternalError(w, fmt.Errorf("failed to create user"))
+			return
+		}
+		if len(vs) > 0 {
+			s.writePolicyError(w, vs)
+			return
+		}
+	}
+
+	// A new user must not inherit the PKI and escrowed keys of a deleted user of the same uid.
+	exists, err := s.vault.PKIRoleExists(req.UserID)
+	if err != nil {
+		l.WithError(err).WithField("user-id", req.UserID).Error("Failed to check for a PKI of the user.")
+		s.httpInternalError(w, fmt.Errorf("failed to create user"))
+		return
+	}
+	if exists {
+		http.Error(w, "user id is already in use", http.StatusConflict)
+		return
+	}
+	err = s.db.CreateUser(r.Context(), req.User, password)
+	if err != nil {
+		if err == errUserExists {
+			http.Error(w, "user already exists", http.StatusConflict)
+			return
+		}
+		l.WithError(err).WithField("user-id", req.UserID).Error("Failed to create user.")
+		s.httpInternalError(w, fmt.Errorf("failed to create user"))
+		return
+	}
+	l.WithField("user-id", req.UserID).Info("Created user.")
+	s.writeJSON(w, http.StatusCreated, res)
+}
+
+// AdminSetUserDisabled returns a handler disabling or enabling the user. Disabling also logs the
+// user out of Hydra and revokes the tokens issued to clients.
+func (s server) AdminSetUserDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := s.authenticateAdmin(w, r)
+		if !ok {
+			return
+		}
+		uid := mux.Vars(r)["uid"]
+		l := log.WithFields(log.Fields{"admin": admin, "user-id": uid, "disabled": disabled})
+		err := s.db.SetUserDisabled(r.Context(), uid, disabled)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				s.httpNotFound(w)
+				return
+			}
+			l.WithError(err).Error("Failed to disable user.")
+			s.httpInternalError(w, fmt.Errorf("failed to disable user"))
+			return
+		}
+		if disabled {
+			if err := s.revokeSessions(r.Context(), uid); err != nil {
+				l.WithError(err).Error("Failed to revoke sessions of disabled user.")
+				s.httpInternalError(w, fmt.Errorf("failed to revoke sessions"))
+				return
+			}
+		}
+		l.Info("Changed user state.")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// revokeSessions logs uid out of Hydra and revokes the tokens issued to clients.
+func (s server) revokeSessions(ctx context.Context, uid string) error {
+	if err := s.hydra.RevokeConsentSessions(ctx, uid); err != nil {
+		return err
+	}
+	return s.hydra.RevokeLoginSessions(ctx, uid)
+}
+
+// AdminDeleteUser deletes the user from the database and revokes their sessions like
+// AdminSetUserDisabled. Certificates and Vault mounts of the user are kept, so that the certificates
+// stay revocable. The uid cannot be reused while the mounts exist, see AdminCreateUser.
+func (s server) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	uid := mux.Vars(r)["uid"]
+	l := log.WithFields(log.Fields{"admin": admin, "user-id": uid})
+	err := s.db.DeleteUser(r.Context(), uid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			s.httpNotFound(w)
+			return
+		}
+		l.WithError(err).Error("Failed to delete user.")
+		s.httpInternalError(w, fmt.Errorf("failed to delete user"))
+		return
+	}
+	if err := s.revokeSessions(r.Context(), uid); err != nil {
+		l.WithError(err).Error("Failed to revoke sessions of deleted user.")
+		s.httpInternalError(w, fmt.Errorf("failed to revoke sessions"))
+		return
+	}
+	l.Info("Deleted user.")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// AdminResetPassword sets a new password for the user. If the body does not contain one, a random
+// password is generated and returned.
+func (s server) AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	uid := mux.Vars(r)["uid"]
+	l := log.WithFields(log.Fields{"admin": admin, "user-id": uid})
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.httpBadRequest(w, "Could not parse body.")
+		return
+	}
+	if len(reqBody) > 0 {
+		if err := json.Unmarshal(reqBody, &req); err != nil {
+			s.httpBadRequest(w, "Could not parse body.")
+			return
+		}
+	}
+	res := passwordResponse{}
+	if req.Password == "" {
+		req.Password, err = generatePassword()
+		if err != nil {
+			s.httpInternalError(w, err)
+			return
+		}
+		res.Password = req.Password
+	} else {
+		u, err := s.db.GetUser(r.Context(), uid)
+		if err == sql.ErrNoRows {
+			s.httpNotFound(w)
+			return
+		}
+		var vs []policyViolation
+		if err == nil {
+			vs, err = s.checkPassword(r.Context(), u, req.Password)
+		}
+		if err != nil {
+			l.WithError(err).Error("Failed to check password policy.")
+			s.httpInternalError(w, fmt.Errorf("failed to reset password"))
+			return
+		}
+		if len(vs) > 0 {
+			s.writePolicyError(w, vs)
+			return
+		}
+	}
+
+	err = s.db.ChangePassword(r.Context(), uid, req.Password)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			s.httpNotFound(w)
+			return
+		}
+		l.WithError(err).Error("Failed to reset password.")
+		s.httpInternalError(w, fmt.Errorf("failed to reset password"))
+		return
+	}
+	l.Info("Reset password.")
+	s.writeJSON(w, http.StatusOK, res)
+}
+
+// AdminUnlockUser lifts a lockout caused by failed logins before it expires.
+func (s server) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	uid := mux.Vars(r)["uid"]
+	s.throttle.Unlock(uid)
+	log.WithFields(log.Fields{"admin": admin, "user-id": uid}).Info("Unlocked user.")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
@@ -14,9 +14,27 @@ type validator struct {
 	provider       *oidc.Provider
 	tokenExtractor *regexp.Regexp
 	clientID       string
+	// roleClaim names the claim listing the roles of the subject.
+	roleClaim string
 }
 
-func NewValidator(issuer string, cid string) (*validator, error) {
+// tokenIdentity is the subject of a token and the roles it grants.
+type tokenIdentity struct {
+	Subject string
+	Roles   []string
+}
+
+// HasRole reports whether role was granted.
+func (id tokenIdentity) HasRole(role string) bool {
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func NewValidator(issuer string, cid string, roleClaim string) (*validator, error) {
 	log.WithField("issuer-url", issuer).Info("Contacting OIDC Issuer...")
 	p, err := oidc.NewProvider(context.Background(), issuer)
 	if err != nil {
@@ -24,20 +42,76 @@ func NewValidator(issuer string, cid string) (*validator, error) {
 		return nil, err
 	}
 	log.WithField("issuer", issuer).Info("Successfully created OIDC Provider for Issuer.")
-	v := validator{provider: p, tokenExtractor: regexp.MustCompile(bearerToken), clientID: cid}
+	v := validator{provider: p, tokenExtractor: regexp.MustCompile(bearerToken), clientID: cid, roleClaim: roleClaim}
 	return &v, nil
 }
 
 // Validate takes the whole authorization header and if it is a JWT, validates it.
 func (v *validator) Validate(ctx context.Context, authHeader string) (string, error) {
+	id, err := v.Identity(ctx, authHeader)
+	return id.Subject, err
+}
+
+// Identity is like Validate, but also returns the roles granted by the token. The role claim may
+// be a single string or a list of strings.
+func (v *validator) Identity(ctx context.Context, authHeader string) (tokenIdentity, error) {
 	m := v.tokenExtractor.FindStringSubmatch(authHeader)
 	if len(m) != 2 {
-		return "", fmt.Errorf("malformed Authorization header")
+		return tokenIdentity{}, fmt.Errorf("malformed Authorization header")
 	}
 	verifier := v.provider.Verifier(&oidc.Config{ClientID: v.clientID})
 	tok, err := verifier.Verify(context.Background(), m[1])
 	if err != nil {
-		return "", err
+		return tokenIdentity{}, err
+	}
+	id := tokenIdentity{Subject: tok.Subject}
+	if v.roleClaim == "" {
+		return id, nil
+	}
+	var claims map[string]interface{}
+	if err := tok.Claims(&claims); err != nil {
+		return tokenIdentity{}, err
+	}
+	id.Roles = claimStrings(claims[v.roleClaim])
+	return id, nil
+}
+
+func claimStrings(c interface{}) []string {
+	switch c := c.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		var ss []string
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+// checkClientCert reports whether the client certificate c has not been revoked. Certificates of
+// the CA administrator are issued by the root pki mount, all others by the mount of the user, whose
+// status is usually known to the revocation cache.
+func (s server) checkClientCert(c clientCert) (bool, error) {
+	uid := c.UID
+	certSerial := c.Serial
+	if certSerial == "" {
+		return false, fmt.Errorf("empty certificate serial")
+	}
+	certSerial, err := normalizeSerial(certSerial)
+	if err != nil {
+		return false, err
+	}
+	if uid == caAdminUID {
+		return s.vault.CertificateIsValid("pki", certSerial)
+	}
+	if s.revocations != nil {
+		if st, ok := s.revocations.Status(uid, certSerial); ok {
+			return st.revokedAt.IsZero(), nil
+		}
 	}
-	return tok.Subject, nil
+	return s.vault.CertificateIsValid(fmt.Sprintf("pki-user/%s", uid), certSerial)
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// authenticateCAAdmin authorizes requests to the CA administration API. They must either come with
+// a valid client certificate of the CA administrator, issued by the root pki mount, or with a token
+// of the CA administrator or granting the CA admin role, which admins get, see consentSession. On
+// failure the response has already been written and ok is false.
+func (s server) authenticateCAAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if c, ok := s.clientCertificate(r, caAdminUID); ok {
+		valid, err := s.checkClientCert(c)
+		if err != nil || !valid {
+			log.WithError(err).Warn("Invalid CA admin client certificate.")
+			s.httpUnauthorized(w)
+			return "", false
+		}
+		return caAdminUID, true
+	}
+	h := r.Header.Get(authorization)
+	if h == "" {
+		log.WithField("path", r.URL.Path).Warn("Missing authorization header.")
+		s.httpUnauthorized(w)
+		return "", false
+	}
+	id, err := s.auth.Identity(r.Context(), h)
+	if err != nil {
+		log.WithError(err).Error("Failed to validate authorization token.")
+		s.httpUnauthorized(w)
+		return "", false
+	}
+	if id.Subject != caAdminUID && (s.caAdminRole == "" || !id.HasRole(s.caAdminRole)) {
+		log.WithField("uid", id.Subject).Warn("Non-admin tried to access the CA admin API.")
+		s.httpUnauthorized(w)
+		return "", false
+	}
+	if !s.checkNotDisabled(w, r, id.Subject) {
+		return "", false
+	}
+	return id.Subject, true
+}
+
+type userCertStats struct {
+	UserID  string `json:"uid"`
+	Issued  int    `json:"issued"`
+	Revoked int    `json:"revoked"`
+}
+
+type caStats struct {
+	Issued  int `json:"issued"`
+	Revoked int `json:"revoked"`
+	// CurrentSerial is the serial of the certificate issued last. Vault assigns random serials, so
+	// it is not a counter.
+	CurrentSerial string          `json:"currentSerial"`
+	Users         []userCertStats `json:"users"`
+}
+
+// AdminCAStats counts the certificates issued by the PKIs of all users. CA certificates are not
+// counted.
+func (s server) AdminCAStats(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateCAAdmin(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("admin", admin)
+	names, err := s.vault.ListUserPKIs()
+	if err != nil {
+		s.httpInternalError(w, fmt.Errorf("failed to list PKIs"))
+		return
+	}
+	stats := caStats{Users: []userCertStats{}}
+	var current *vaultCert
+	var currentIssued int64
+	for _, name := range names {
+		certs, err := s.vault.ListCerts(r.Context(), name)
+		if err != nil {
+			s.httpInternalError(w, fmt.Errorf("failed to list certificates of %s", name))
+			return
+		}
+		us := userCertStats{UserID: name}
+		for i, c := range certs {
+			cert, err := parseVaultCert(c)
+			if err != nil {
+				l.WithError(err).WithFields(log.Fields{"uid": name, "serial": c.Serial}).Warn("Skipping unparsable certificate.")
+				continue
+			}
+			if cert == nil {
+				continue
+			}
+			us.Issued++
+			if !c.RevokedAt.IsZero() {
+				us.Revoked++
+			}
+			if current == nil || cert.NotBefore.Unix() > currentIssued {
+				current, currentIssued = &certs[i], cert.NotBefore.Unix()
+			}
+		}
+		stats.Issued += us.Issued
+		stats.Revoked += us.Revoked
+		stats.Users = append(stats.Users, us)
+	}
+	if current != nil {
+		stats.CurrentSerial, err = normalizeSerial(current.Serial)
+		if err != nil {
+			stats.CurrentSerial = current.Serial
+		}
+	}
+	s.writeJSON(w, http.StatusOK, stats)
+}
+
+// AdminListUserCerts lists the certificates of any user, like ListCertificates.
+func (s server) AdminListUserCerts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticateCAAdmin(w, r); !ok {
+		return
+	}
+	uid, ok := s.pathUID(w, r)
+	if !ok {
+		return
+	}
+	s.writeCertList(w, r, s.vault, uid)
+}
+
+// AdminRevokeUserCert revokes a certificate of any user, like RevokeCertificate.
+func (s server) AdminRevokeUserCert(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateCAAdmin(w, r)
+	if !ok {
+		return
+	}
+	uid, ok := s.pathUID(w, r)
+	if !ok {
+		return
+	}
+	log.WithFields(log.Fields{"admin": admin, "uid": uid, "serial": mux.Vars(r)["serial"]}).Info("Admin revokes certificate.")
+	s.revokeUserCert(w, r, s.vault, uid)
+}
+
+func (s server) pathUID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	uid := mux.Vars(r)["uid"]
+	if !regexp.MustCompile(uidRegex).MatchString(uid) {
+		s.httpBadRequest(w, "invalid uid")
+		return "", false
+	}
+	return uid, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCAAdmin(t *testing.T) {
+	now := time.Now()
+	fakeCert := func(serial int64, notBefore time.Time, isCA bool) string {
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(serial), NotBefore: notBefore, IsCA: isCA, BasicConstraintsValid: true}
+		c, _ := newTestCert(t, tmpl, nil, nil)
+		return encodeCert(c)
+	}
+	v := &fakeVault{certs: map[string][]vaultCert{
+		"a3": {
+			{Serial: "0a", Certificate: fakeCert(10, now.Add(-3*time.Hour), true)},
+			{Serial: "01", Certificate: fakeCert(1, now.Add(-2*time.Hour), false), RevokedAt: now.Add(-time.Hour)},
+			{Serial: "02", Certificate: fakeCert(2, now.Add(-time.Minute), false)},
+		},
+		"ps": {
+			{Serial: "03", Certificate: fakeCert(3, now.Add(-time.Hour), false)},
+		},
+	}}
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, _ := NewStorage("memory://?seed="+usersDump, hasher)
+	s := server{db: db, vault: v, auth: staticValidator{}, caAdminRole: "ca-admin"}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/ca", s.AdminCAStats).Methods(http.MethodGet)
+	r.HandleFunc("/admin/ca/users/{uid}/certs/{serial}", s.AdminRevokeUserCert).Methods(http.MethodDelete)
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(authorization, token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodGet, "/admin/ca", "Bearer a3"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without role, got %d", w.Code)
+	}
+	w := do(http.MethodGet, "/admin/ca", "Bearer a3 ca-admin")
+	var stats caStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to parse stats %s. %v", w.Body.String(), err)
+	}
+	if stats.Issued != 3 || stats.Revoked != 1 || stats.CurrentSerial != "02" || len(stats.Users) != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	if w := do(http.MethodDelete, "/admin/ca/users/ps/certs/03?reason=keyCompromise", "Bearer admin"); w.Code != http.StatusOK {
+		t.Fatalf("Failed to revoke: %d %s", w.Code, w.Body.String())
+	}
+	if reasons, _ := db.RevocationReasons(context.Background(), "ps"); reasons["03"] != 1 {
+		t.Errorf("Unexpected reasons %v", reasons)
+	}
+	if w := do(http.MethodDelete, "/admin/ca/users/ps/certs/03", "Bearer admin"); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for revoked certificate, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/admin/ca/users/a3/certs/0a", "Bearer admin"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for CA certificate, got %d", w.Code)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// The PKI roles only accept RSA keys of at least this size.
+	minRSABits = 2048
+	maxCSRSize = 64 << 10
+)
+
+// parseCSR parses a PKCS#10 certificate request, either PEM or DER encoded.
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	if b, _ := pem.Decode(data); b != nil {
+		if b.Type != "CERTIFICATE REQUEST" && b.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("unexpected PEM block %q", b.Type)
+		}
+		data = b.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	return csr, nil
+}
+
+// validateCSR checks that csr only asks for the identity want, see Config.certEmail, so that the
+// signed certificate cannot be used to impersonate anybody else.
+func validateCSR(csr *x509.CertificateRequest, want string) error {
+	if csr.Subject.CommonName != want {
+		return fmt.Errorf("common name must be %s", want)
+	}
+	for _, e := range csr.EmailAddresses {
+		if !strings.EqualFold(e, want) {
+			return fmt.Errorf("email address %s not allowed", e)
+		}
+	}
+	if len(csr.DNSNames) > 0 || len(csr.IPAddresses) > 0 || len(csr.URIs) > 0 {
+		return fmt.Errorf("only email subject alternative names are allowed")
+	}
+	k, ok := csr.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("only RSA keys are supported")
+	}
+	if k.N.BitLen() < minRSABits {
+		return fmt.Errorf("key must have at least %d bits", minRSABits)
+	}
+	return nil
+}
+
+// signedCert is a certificate signed by the PKI of a user, all PEM encoded.
+type signedCert struct {
+	Certificate string
+	Serial      string
+	// CAChain starts with the issuing CA.
+	CAChain []string
+}
+
+// chainPEM returns the certificate followed by its CA chain.
+func (c signedCert) chainPEM() string {
+	parts := append([]string{c.Certificate}, c.CAChain...)
+	return strings.Join(parts, "\n") + "\n"
+}
+
+// chainDER returns the certificate and its CA chain as certs-only PKCS#7 (.p7b), the usual DER
+// container for certificate chains.
+func (c signedCert) chainDER() ([]byte, error) {
+	var certs []byte
+	for _, p := range append([]string{c.Certificate}, c.CAChain...) {
+		rest := []byte(p)
+		for {
+			var b *pem.Block
+			b, rest = pem.Decode(rest)
+			if b == nil {
+				break
+			}
+			certs = append(certs, b.Bytes...)
+		}
+	}
+	return pkcs7CertsOnly(certs)
+}
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// pkcs7ContentInfo is ContentInfo of RFC 2315. Content is [0] EXPLICIT, which has to be set up
+// manually, since encoding/asn1 does not add explicit tags to a RawValue.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      asn1.RawValue
+}
+
+// pkcs7CertsOnly wraps concatenated DER certificates into a degenerate SignedData without signers,
+// see RFC 2315 section 9.
+func pkcs7CertsOnly(certs []byte) ([]byte, error) {
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+// SignCSR signs a PKCS#10 request, PEM or DER encoded, of the authenticated user. The chain is
+// returned as PEM, or as PKCS#7 if DER is asked for with ?format=der or the Accept header. The
+// private key never leaves the device of the user.
+func (s server) SignCSR(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("uid", id)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCSRSize))
+	if err != nil {
+		s.httpBadRequest(w, "Could not read body.")
+		return
+	}
+	csr, err := parseCSR(body)
+	if err != nil {
+		l.WithError(err).Warn("Invalid CSR.")
+		s.httpBadRequest(w, fmt.Sprintf("Invalid CSR: %v", err))
+		return
+	}
+	if err := validateCSR(csr, s.cfg.certEmail(id)); err != nil {
+		l.WithError(err).Warn("CSR does not match the user.")
+		s.httpBadRequest(w, fmt.Sprintf("Invalid CSR: %v", err))
+		return
+	}
+
+	vc, err := s.vaultForUser(id, r.Header.Get(authorization))
+	if err != nil {
+		l.WithError(err).Error("Failed to create vault client.")
+		s.httpUnauthorized(w)
+		return
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	cert, err := vc.SignCSR(r.Context(), id, string(csrPEM))
+	if err != nil {
+		l.WithError(err).Error("Failed to sign CSR.")
+		s.httpInternalError(w, fmt.Errorf("failed to sign certificate"))
+		return
+	}
+	l.WithField("serial", cert.Serial).Info("Signed CSR.")
+
+	if r.URL.Query().Get("format") == "der" || strings.Contains(r.Header.Get("Accept"), "application/pkcs7-mime") {
+		der, err := cert.chainDER()
+		if err != nil {
+			s.httpInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=cert.p7b")
+		w.Header().Set("Content-Type", "application/pkcs7-mime")
+		w.Write(der)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=cert.pem")
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	fmt.Fprint(w, cert.chainPEM())
+}
+
+// certificates parses the certificate and its CA chain.
+func (c signedCert) certificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, p := range append([]string{c.Certificate}, c.CAChain...) {
+		rest := []byte(p)
+		for {
+			var b *pem.Block
+			b, rest = pem.Decode(rest)
+			if b == nil {
+				break
+			}
+			cert, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return certs, nil
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#1, SEC 1 or PKCS#8 private key.
+func parsePrivateKey(data string) (interface{}, error) {
+	b, _ := pem.Decode([]byte(data))
+	if b == nil {
+		return nil, fmt.Errorf("no PEM encoded private key")
+	}
+	switch b.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(b.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(b.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(b.Bytes)
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q", b.Type)
+}
+
+// pkcs12Request is the body of requests for a new key and certificate.
+type pkcs12Request struct {
+	// Password protects the bundle, it must not be empty.
+	Password string `json:"password"`
+	// Profile is pkcs12Modern, the default, or pkcs12Legacy.
+	Profile string `json:"profile"`
+}
+
+// readPKCS12Request reads and checks the export options of a request. On failure the response has
+// already been written and ok is false.
+func (s server) readPKCS12Request(w http.ResponseWriter, r *http.Request) (req pkcs12Request, ok bool) {
+	if err := readJSON(r, &req); err != nil {
+		s.httpBadRequest(w, "Could not parse body.")
+		return req, false
+	}
+	if req.Password == "" {
+		s.httpBadRequest(w, "An export password is required.")
+		return req, false
+	}
+	if req.Profile == "" {
+		req.Profile = pkcs12Modern
+	}
+	if req.Profile != pkcs12Modern && req.Profile != pkcs12Legacy {
+		s.httpBadRequest(w, fmt.Sprintf("Profile must be %s or %s.", pkcs12Modern, pkcs12Legacy))
+		return req, false
+	}
+	if _, err := bmpString(req.Password); err != nil {
+		s.httpBadRequest(w, "The export password contains unsupported characters.")
+		return req, false
+	}
+	return req, true
+}
+
+// pkcs12 bundles the key with the certificate and its chain.
+func (ic issuedCert) pkcs12(password string, profile string, friendlyName string) ([]byte, error) {
+	key, err := parsePrivateKey(ic.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := ic.certificates()
+	if err != nil {
+		return nil, err
+	}
+	return encodePKCS12(key, certs, password, profile, friendlyName)
+}
+
+// writePKCS12 sends a PKCS#12 bundle as download.
+func writePKCS12(w http.ResponseWriter, p12 []byte) {
+	w.Header().Set("Content-Disposition", "attachment; filename=cert.p12")
+	w.Header().Set("Content-Type", "application/x-pkcs12")
+	w.Write(p12)
+}
+
+// IssueCert issues a new key and certificate for the authenticated user and returns them as
+// PKCS#12 protected by the export password of the request. The bundle is built in memory.
+func (s server) IssueCert(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("uid", id)
+	req, ok := s.readPKCS12Request(w, r)
+	if !ok {
+		return
+	}
+
+	vc, err := s.vaultForUser(id, r.Header.Get(authorization))
+	if err != nil {
+		l.WithError(err).Error("Failed to create vault client.")
+		s.httpUnauthorized(w)
+		return
+	}
+	ic, err := vc.IssueCert(r.Context(), id)
+	if err != nil {
+		l.WithError(err).Error("Failed to issue certificate.")
+		s.httpInternalError(w, fmt.Errorf("failed to issue certificate"))
+		return
+	}
+	p12, err := ic.pkcs12(req.Password, req.Profile, s.cfg.certEmail(id))
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	l.WithFields(log.Fields{"serial": ic.Serial, "profile": req.Profile}).Info("Issued PKCS#12 bundle.")
+	writePKCS12(w, p12)
+}
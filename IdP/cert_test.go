@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newCSR(t *testing.T, key interface{}, tmpl x509.CertificateRequest) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &tmpl, key)
+	if err != nil {
+		t.Fatalf("Failed to create CSR. %v", err)
+	}
+	return der
+}
+
+func TestValidateCSR(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key. %v", err)
+	}
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	subject := pkix.Name{CommonName: "a3@fadalax.tech"}
+
+	for name, tc := range map[string]struct {
+		key   interface{}
+		tmpl  x509.CertificateRequest
+		valid bool
+	}{
+		"valid":        {key, x509.CertificateRequest{Subject: subject}, true},
+		"valid email":  {key, x509.CertificateRequest{Subject: subject, EmailAddresses: []string{"a3@fadalax.tech"}}, true},
+		"other user":   {key, x509.CertificateRequest{Subject: pkix.Name{CommonName: "ps@fadalax.tech"}}, false},
+		"other email":  {key, x509.CertificateRequest{Subject: subject, EmailAddresses: []string{"ps@fadalax.tech"}}, false},
+		"dns name":     {key, x509.CertificateRequest{Subject: subject, DNSNames: []string{"fadalax.tech"}}, false},
+		"small key":    {small, x509.CertificateRequest{Subject: subject}, false},
+		"ecdsa key":    {ec, x509.CertificateRequest{Subject: subject}, false},
+		"bare uid":     {key, x509.CertificateRequest{Subject: pkix.Name{CommonName: "a3"}}, false},
+		"other domain": {key, x509.CertificateRequest{Subject: pkix.Name{CommonName: "a3@evil.com"}}, false},
+	} {
+		der := newCSR(t, tc.key, tc.tmpl)
+		csr, err := parseCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+		if err != nil {
+			t.Fatalf("%s: failed to parse CSR. %v", name, err)
+		}
+		if err := validateCSR(csr, "a3@fadalax.tech"); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%v, got %v", name, tc.valid, err)
+		}
+	}
+
+	der := newCSR(t, key, x509.CertificateRequest{Subject: subject})
+	if _, err := parseCSR(der); err != nil {
+		t.Errorf("Failed to parse DER CSR. %v", err)
+	}
+	der[len(der)-1] ^= 0xff
+	if _, err := parseCSR(der); err == nil {
+		t.Error("CSR with broken signature accepted.")
+	}
+}
+
+func TestChainDER(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var pems []string
+	for i := 1; i <= 2; i++ {
+		tmpl := x509.Certificate{SerialNumber: big.NewInt(int64(i)), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
+		if err != nil {
+			t.Fatalf("Failed to create certificate. %v", err)
+		}
+		pems = append(pems, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	}
+	p7, err := signedCert{Certificate: pems[0], CAChain: pems[1:]}.chainDER()
+	if err != nil {
+		t.Fatalf("Failed to encode chain. %v", err)
+	}
+
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(p7, &ci); err != nil || !ci.ContentType.Equal(oidPKCS7SignedData) {
+		t.Fatalf("Failed to parse content info %v. %v", ci.ContentType, err)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("Failed to parse signed data. %v", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil || len(certs) != 2 || certs[0].SerialNumber.Int64() != 1 {
+		t.Errorf("Unexpected certificates %v. %v", certs, err)
+	}
+}
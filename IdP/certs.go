@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Revocation reasons of RFC 5280 section 5.3.1 users may give. The others only make sense for CAs
+// or are not supported by Vault.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+}
+
+// parseRevocationReason accepts the name or code of a reason, the empty string is unspecified.
+func parseRevocationReason(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if code, ok := revocationReasons[s]; ok {
+		return code, nil
+	}
+	if code, err := strconv.Atoi(s); err == nil {
+		for _, c := range revocationReasons {
+			if c == code {
+				return code, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason %q", s)
+}
+
+func revocationReasonName(code int) string {
+	for name, c := range revocationReasons {
+		if c == code {
+			return name
+		}
+	}
+	return strconv.Itoa(code)
+}
+
+// normalizeSerial converts a serial number in hex, optionally separated by colons or dashes, into
+// the lower case, colon separated form Vault uses.
+func normalizeSerial(serial string) (string, error) {
+	s := strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(serial))
+	if s == "" || len(s)%2 != 0 {
+		return "", fmt.Errorf("invalid serial %q", serial)
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", fmt.Errorf("invalid serial %q", serial)
+	}
+	elems := make([]string, len(s)/2)
+	for i := 0; i < len(s); i += 2 {
+		elems[i/2] = s[i : i+2]
+	}
+	return strings.Join(elems, ":"), nil
+}
+
+// certInfo describes a certificate of a user.
+type certInfo struct {
+	Serial    string     `json:"serial"`
+	Subject   string     `json:"subject"`
+	NotBefore time.Time  `json:"notBefore"`
+	NotAfter  time.Time  `json:"notAfter"`
+	Revoked   bool       `json:"revoked"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+// parseVaultCert returns the parsed certificate, which is nil for CA certificates and the OCSP
+// responder certificates of the IdP. Neither belongs to the user.
+func parseVaultCert(c vaultCert) (*x509.Certificate, error) {
+	b, _ := pem.Decode([]byte(c.Certificate))
+	if b == nil {
+		return nil, fmt.Errorf("certificate %s is not PEM encoded", c.Serial)
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if cert.IsCA || isOCSPResponder(cert) {
+		return nil, nil
+	}
+	return cert, nil
+}
+
+// isOCSPResponder reports whether cert is a delegated OCSP responder certificate, see newResponder.
+func isOCSPResponder(cert *x509.Certificate) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
+
+func newCertInfo(c vaultCert, cert *x509.Certificate, reasons map[string]int) certInfo {
+	serial, err := normalizeSerial(c.Serial)
+	if err != nil {
+		serial = c.Serial
+	}
+	info := certInfo{
+		Serial:    serial,
+		Subject:   cert.Subject.CommonName,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+	if !c.RevokedAt.IsZero() {
+		at := c.RevokedAt
+		info.Revoked = true
+		info.RevokedAt = &at
+		info.Reason = revocationReasonName(reasons[serial])
+	}
+	return info
+}
+
+// certVault issues certificates with the PKIs of users and gives access to them.
+type certVault interface {
+	IssueCert(ctx context.Context, name string) (issuedCert, error)
+	SignCSR(ctx context.Context, name string, csr string) (signedCert, error)
+	RevokeCerts(ctx context.Context, name string) error
+	ListCerts(ctx context.Context, name string) ([]vaultCert, error)
+	ReadCert(ctx context.Context, name string, serial string) (vaultCert, error)
+	RevokeCert(ctx context.Context, name string, serial string) (time.Time, error)
+}
+
+// userVault authenticates the request and returns the uid and a Vault client acting as the user.
+// On failure the response has already been written and ok is false.
+func (s server) userVault(w http.ResponseWriter, r *http.Request) (id string, vc certVault, ok bool) {
+	id, ok = s.authenticate(w, r)
+	if !ok {
+		return "", nil, false
+	}
+	vc, err := s.vaultForUser(id, r.Header.Get(authorization))
+	if err != nil {
+		log.WithError(err).WithField("uid", id).Error("Failed to create vault client.")
+		s.httpUnauthorized(w)
+		return "", nil, false
+	}
+	return id, vc, true
+}
+
+// ListCertificates lists the certificates of the authenticated user, newest first.
+func (s server) ListCertificates(w http.ResponseWriter, r *http.Request) {
+	id, vc, ok := s.userVault(w, r)
+	if !ok {
+		return
+	}
+	s.writeCertList(w, r, vc, id)
+}
+
+func (s server) writeCertList(w http.ResponseWriter, r *http.Request, vc certVault, uid string) {
+	l := log.WithField("uid", uid)
+	certs, err := vc.ListCerts(r.Context(), uid)
+	if err != nil {
+		s.httpInternalError(w, fmt.Errorf("failed to list certificates"))
+		return
+	}
+	reasons, err := s.db.RevocationReasons(r.Context(), uid)
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	infos := []certInfo{}
+	for _, c := range certs {
+		cert, err := parseVaultCert(c)
+		if err != nil {
+			l.WithError(err).WithField("serial", c.Serial).Warn("Skipping unparsable certificate.")
+			continue
+		}
+		if cert == nil {
+			continue
+		}
+		infos = append(infos, newCertInfo(c, cert, reasons))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].NotBefore.After(infos[j].NotBefore) })
+	s.writeJSON(w, http.StatusOK, infos)
+}
+
+// readUserCert reads the certificate with the serial of the request. On failure the response has
+// already been written and ok is false.
+func (s server) readUserCert(w http.ResponseWriter, r *http.Request, vc certVault, id string) (vaultCert, *x509.Certificate, bool) {
+	serial, err := normalizeSerial(mux.Vars(r)["serial"])
+	if err != nil {
+		s.httpBadRequest(w, err.Error())
+		return vaultCert{}, nil, false
+	}
+	c, err := vc.ReadCert(r.Context(), id, serial)
+	if err == errCertNotFound {
+		s.httpNotFound(w)
+		return vaultCert{}, nil, false
+	}
+	if err != nil {
+		s.httpInternalError(w, fmt.Errorf("failed to read certificate"))
+		return vaultCert{}, nil, false
+	}
+	cert, err := parseVaultCert(c)
+	if err != nil {
+		s.httpInternalError(w, err)
+		return vaultCert{}, nil, false
+	}
+	if cert == nil {
+		s.httpNotFound(w)
+		return vaultCert{}, nil, false
+	}
+	c.Serial = serial
+	return c, cert, true
+}
+
+// GetCertificate returns a certificate of the authenticated user, as PEM or, if asked for with
+// ?format=der or the Accept header, as DER.
+func (s server) GetCertificate(w http.ResponseWriter, r *http.Request) {
+	id, vc, ok := s.userVault(w, r)
+	if !ok {
+		return
+	}
+	_, cert, ok := s.readUserCert(w, r, vc, id)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("format") == "der" || strings.Contains(r.Header.Get("Accept"), "application/pkix-cert") {
+		w.Header().Set("Content-Disposition", "attachment; filename=cert.cer")
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(cert.Raw)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=cert.pem")
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// RevokeCertificate revokes a single certificate of the authenticated user. The reason is passed
+// as ?reason=, by name or RFC 5280 code, and defaults to unspecified.
+func (s server) RevokeCertificate(w http.ResponseWriter, r *http.Request) {
+	if _, err := parseRevocationReason(r.URL.Query().Get("reason")); err != nil {
+		s.httpBadRequest(w, err.Error())
+		return
+	}
+	id, vc, ok := s.userVault(w, r)
+	if !ok {
+		return
+	}
+	s.revokeUserCert(w, r, vc, id)
+}
+
+func (s server) revokeUserCert(w http.ResponseWriter, r *http.Request, vc certVault, uid string) {
+	reason, err := parseRevocationReason(r.URL.Query().Get("reason"))
+	if err != nil {
+		s.httpBadRequest(w, err.Error())
+		return
+	}
+	c, cert, ok := s.readUserCert(w, r, vc, uid)
+	if !ok {
+		return
+	}
+	l := log.WithFields(log.Fields{"uid": uid, "serial": c.Serial})
+	if !c.RevokedAt.IsZero() {
+		http.Error(w, "Certificate has already been revoked.", http.StatusConflict)
+		return
+	}
+	at, err := vc.RevokeCert(r.Context(), uid, c.Serial)
+	if err != nil {
+		s.httpInternalError(w, fmt.Errorf("failed to revoke certificate"))
+		return
+	}
+	c.RevokedAt = at
+	err = s.db.SetRevocationReason(r.Context(), uid, c.Serial, reason)
+	if s.revocations != nil {
+		s.revocations.RefreshIssuer(r.Context(), uid)
+	}
+	if err != nil {
+		l.WithError(err).Error("Certificate revoked, but failed to record the reason.")
+		s.httpInternalError(w, err)
+		return
+	}
+	l.WithField("reason", revocationReasonName(reason)).Info("Revoked certificate.")
+	s.writeJSON(w, http.StatusOK, newCertInfo(c, cert, map[string]int{c.Serial: reason}))
+}
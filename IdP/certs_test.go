@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestNormalizeSerial(t *testing.T) {
+	for in, want := range map[string]string{
+		"39DD2E90":    "39:dd:2e:90",
+		"39:dd:2e:90": "39:dd:2e:90",
+		"39-DD-2E-90": "39:dd:2e:90",
+	} {
+		if got, err := normalizeSerial(in); got != want || err != nil {
+			t.Errorf("normalizeSerial(%q) = %q, expected %q. %v", in, got, want, err)
+		}
+	}
+	for _, in := range []string{"", "39D", "zz:dd", "../ca"} {
+		if _, err := normalizeSerial(in); err == nil {
+			t.Errorf("Accepted invalid serial %q", in)
+		}
+	}
+}
+
+func TestRevocationReason(t *testing.T) {
+	for in, want := range map[string]int{"": 0, "keyCompromise": 1, "4": 4} {
+		if got, err := parseRevocationReason(in); got != want || err != nil {
+			t.Errorf("parseRevocationReason(%q) = %d, expected %d. %v", in, got, want, err)
+		}
+	}
+	for _, in := range []string{"cACompromise", "2", "removeFromCRL", "x"} {
+		if _, err := parseRevocationReason(in); err == nil {
+			t.Errorf("Accepted reason %q", in)
+		}
+	}
+	if revocationReasonName(1) != "keyCompromise" {
+		t.Errorf("Unexpected name %s", revocationReasonName(1))
+	}
+}
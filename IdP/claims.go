@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// userClaimScopes maps the standard claims derived from the user record to the scope granting
+// them, see OpenID Connect Core section 5.4.
+var userClaimScopes = map[string]string{
+	"name":           "profile",
+	"given_name":     "profile",
+	"family_name":    "profile",
+	"email":          "email",
+	"email_verified": "email",
+}
+
+// reservedClaims are set by Hydra and cannot be overridden by client metadata. Neither can the
+// user claims and the role claim, see isCustomClaim.
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+	"auth_time": true, "nonce": true, "acr": true, "amr": true, "azp": true, "at_hash": true,
+	"c_hash": true, "sid": true, "scp": true, "client_id": true,
+}
+
+// userClaims returns the standard claims of u that the granted scopes allow.
+func userClaims(u User, granted []string) map[string]interface{} {
+	all := map[string]interface{}{
+		"name":           strings.TrimSpace(u.FirstName + " " + u.LastName),
+		"given_name":     u.FirstName,
+		"family_name":    u.LastName,
+		"email":          u.Email,
+		"email_verified": u.EmailVerified,
+	}
+	isGranted := map[string]bool{}
+	for _, s := range granted {
+		isGranted[s] = true
+	}
+	claims := map[string]interface{}{}
+	for name, v := range all {
+		if !isGranted[userClaimScopes[name]] || v == "" {
+			continue
+		}
+		claims[name] = v
+	}
+	return claims
+}
+
+// clientClaims are custom claims of an OAuth 2.0 client, set in the metadata of the client in
+// Hydra:
+//
+//	{"id_token_claims": {"tenant": "imovies"}, "access_token_claims": {"tier": "internal"}}
+type clientClaims struct {
+	IDToken     map[string]interface{} `json:"id_token_claims"`
+	AccessToken map[string]interface{} `json:"access_token_claims"`
+}
+
+// parseClientClaims reads the custom claims from the metadata of a client. Metadata of another
+// shape has no custom claims.
+func parseClientClaims(metadata json.RawMessage) clientClaims {
+	var c clientClaims
+	if len(metadata) > 0 {
+		json.Unmarshal(metadata, &c)
+	}
+	return c
+}
+
+// consentSession returns the claims Hydra adds to the tokens issued for a consent. The ID token
+// gets the user claims allowed by the granted scopes, the access token only those listed in
+// tokens.access_token_claims. Both list adminRole in roleClaim if u is an admin. Custom claims of
+// the client never set user claims, not even those left out, nor roleClaim, which grants access to
+// the admin APIs.
+func consentSession(u User, granted []string, client OAuth2Client, accessTokenClaims []string, roleClaim string, adminRole string) ConsentSession {
+	user := userClaims(u, granted)
+	custom := parseClientClaims(client.Metadata)
+	session := ConsentSession{IDToken: map[string]interface{}{}, AccessToken: map[string]interface{}{}}
+	for name, v := range custom.IDToken {
+		if isCustomClaim(name, roleClaim) {
+			session.IDToken[name] = v
+		}
+	}
+	for name, v := range custom.AccessToken {
+		if isCustomClaim(name, roleClaim) {
+			session.AccessToken[name] = v
+		}
+	}
+	for name, v := range user {
+		session.IDToken[name] = v
+	}
+	for _, name := range accessTokenClaims {
+		if v, ok := user[name]; ok {
+			session.AccessToken[name] = v
+		}
+	}
+	if roleClaim != "" && adminRole != "" && u.Admin {
+		session.IDToken[roleClaim] = []string{adminRole}
+		session.AccessToken[roleClaim] = []string{adminRole}
+	}
+	return session
+}
+
+// isCustomClaim reports whether client metadata may set the claim name.
+func isCustomClaim(name string, roleClaim string) bool {
+	_, user := userClaimScopes[name]
+	return !reservedClaims[name] && !user && name != roleClaim
+}
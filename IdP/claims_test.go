@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestConsentSession(t *testing.T) {
+	u := User{UserID: "a3", FirstName: "Andres", LastName: "Anderson", Email: "anderson@imovies.ch", EmailVerified: true}
+	client := OAuth2Client{ClientID: "frontend", Metadata: json.RawMessage(`{
+		"id_token_claims": {"tenant": "imovies", "email": "spoofed@example.com", "sub": "ps", "roles": ["ca-admin"]},
+		"access_token_claims": {"tier": "internal", "roles": ["ca-admin"]}
+	}`)}
+
+	s := consentSession(u, []string{"openid", "email"}, client, []string{"email", "name"}, "roles", "ca-admin")
+	wantID := map[string]interface{}{"tenant": "imovies", "email": "anderson@imovies.ch", "email_verified": true}
+	if !reflect.DeepEqual(s.IDToken, wantID) {
+		t.Errorf("Unexpected ID token claims %v, want %v", s.IDToken, wantID)
+	}
+	// name is configured, but profile was not granted.
+	wantAccess := map[string]interface{}{"tier": "internal", "email": "anderson@imovies.ch"}
+	if !reflect.DeepEqual(s.AccessToken, wantAccess) {
+		t.Errorf("Unexpected access token claims %v, want %v", s.AccessToken, wantAccess)
+	}
+
+	s = consentSession(u, []string{"openid", "profile"}, OAuth2Client{Metadata: json.RawMessage(`"just a note"`)}, nil, "roles", "ca-admin")
+	wantID = map[string]interface{}{"name": "Andres Anderson", "given_name": "Andres", "family_name": "Anderson"}
+	if !reflect.DeepEqual(s.IDToken, wantID) || len(s.AccessToken) != 0 {
+		t.Errorf("Unexpected claims %+v", s)
+	}
+
+	// Admins get the admin role, whatever the client or the granted scopes.
+	u.Admin = true
+	s = consentSession(u, []string{"openid"}, client, nil, "roles", "ca-admin")
+	wantID = map[string]interface{}{"tenant": "imovies", "roles": []string{"ca-admin"}}
+	wantAccess = map[string]interface{}{"tier": "internal", "roles": []string{"ca-admin"}}
+	if !reflect.DeepEqual(s.IDToken, wantID) || !reflect.DeepEqual(s.AccessToken, wantAccess) {
+		t.Errorf("Unexpected claims of admin %+v", s)
+	}
+}
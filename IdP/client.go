@@ -2,173 +2,464 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"strings"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tokenIntrospectionPath = "/oauth2/introspect"
+	// clientPageSize is how many clients ListClients requests at once.
+	clientPageSize = 100
+)
+
+// Error codes login and consent requests are rejected with, which Hydra passes on to the client,
+// see RFC 6749 section 4.1.2.1 and OpenID Connect Core section 3.1.2.6.
+const (
+	oauthAccessDenied  = "access_denied"
+	oauthLoginRequired = "login_required"
+)
+
+var (
+	// errRequestExpired matches a HydraError for a login or consent request Hydra does not know
+	// (anymore), usually because it expired.
+	errRequestExpired = errors.New("login or consent request expired")
+	// errRequestHandled matches a HydraError for a login or consent request that was already
+	// accepted or rejected, e.g. when the user submits a form twice.
+	errRequestHandled = errors.New("login or consent request already handled")
+	// errHydraUnavailable matches a HydraError for a server side failure of Hydra.
+	errHydraUnavailable = errors.New("hydra unavailable")
+	// errClientNotFound and errClientExists match a HydraError for an OAuth 2.0 client that does
+	// not exist, or already does when creating it.
+	errClientNotFound = errors.New("client not found")
+	errClientExists   = errors.New("client already exists")
 )
 
-const tokenIntrospectionPath = "/oauth2/introspect"
+// HydraError is a non-2xx response of the admin API. Use errors.Is with errRequestExpired,
+// errRequestHandled, errClientNotFound, errClientExists and errHydraUnavailable to tell the cases
+// apart.
+type HydraError struct {
+	StatusCode  int    `json:"status_code"`
+	Name        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *HydraError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("hydra: %d %s: %s", e.StatusCode, e.Name, e.Description)
+	}
+	return fmt.Sprintf("hydra: %d %s", e.StatusCode, e.Name)
+}
+
+func (e *HydraError) Is(target error) bool {
+	switch target {
+	case errRequestExpired, errClientNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case errRequestHandled, errClientExists:
+		return e.StatusCode == http.StatusConflict
+	case errHydraUnavailable:
+		return e.StatusCode >= 500
+	}
+	return false
+}
 
+// HydraClient talks to the admin API of Hydra.
 type HydraClient struct {
 	client   *http.Client
 	adminUrl string
+	// timeout bounds every attempt of a call. Zero means only the context of the call applies.
+	timeout time.Duration
+	// retries is how often a call failing with a network error or a 5xx response is repeated, see
+	// retryable. The first retry waits backoff, every further one twice as long as the one before.
+	retries int
+	backoff time.Duration
 }
 
-type LoginInfo struct {
-	Skip           bool     `json:"skip"`
-	Subject        string   `json:"subject"`
-	RequestedScope []string `json:"requested_scope"`
+// NewHydraClient returns a client of the admin API at adminURL.
+func NewHydraClient(adminURL string, client *http.Client, timeout time.Duration, retries int, backoff time.Duration) *HydraClient {
+	return &HydraClient{client: client, adminUrl: adminURL, timeout: timeout, retries: retries, backoff: backoff}
+}
+
+// do calls the admin API and decodes the JSON response into out, unless out is nil. in, if not
+// nil, is sent as JSON body.
+func (c HydraClient) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	u := c.adminUrl + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	idempotent := method == http.MethodGet || method == http.MethodDelete
+	return c.send(ctx, method, u, "application/json", body, idempotent, out)
 }
 
-func (c HydraClient) GetLoginInfo(challenge string) (LoginInfo, error) {
-	//fetch information about the request
-	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/oauth2/auth/requests/login?login_challenge=%s", c.adminUrl, challenge), nil)
+// send makes the request, retrying it as configured.
+func (c HydraClient) send(ctx context.Context, method string, u string, contentType string, body []byte, idempotent bool, out interface{}) error {
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, u, contentType, body, out)
+		if err == nil || attempt >= c.retries || !retryable(err, idempotent) || ctx.Err() != nil {
+			return err
+		}
+		log.WithError(err).WithField("url", u).Warnf("Hydra call failed, retrying in %s.", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+	}
+}
+
+func (c HydraClient) attempt(ctx context.Context, method string, u string, contentType string, body []byte, out interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
 	if err != nil {
-		return LoginInfo{}, err
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
 	}
-	res, err := c.client.Do(request)
+	req.Header.Set("Accept", "application/json")
+	res, err := c.client.Do(req)
 	if err != nil {
-		return LoginInfo{}, err
+		return err
 	}
-	buf, err := ioutil.ReadAll(res.Body)
+	defer res.Body.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
 	if err != nil {
-		return LoginInfo{}, err
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		hErr := &HydraError{}
+		if json.Unmarshal(buf, hErr) != nil || hErr.Name == "" {
+			hErr.Name = http.StatusText(res.StatusCode)
+		}
+		// Proxies in front of Hydra do not set the status in the body.
+		hErr.StatusCode = res.StatusCode
+		return hErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// retryable reports whether a call failing with err may succeed when repeated. Errors Hydra
+// reports for the request itself, like an expired challenge, never do. Calls changing state, like
+// accepting a login, are only repeated if the connection could not even be made. Hydra may have
+// applied them otherwise, and would answer the retry with a conflict.
+func retryable(err error, idempotent bool) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
 	}
-	logInfo := LoginInfo{}
-	err = json.Unmarshal(buf, &logInfo)
+	if !idempotent {
+		return false
+	}
+	var hErr *HydraError
+	if errors.As(err, &hErr) {
+		return errors.Is(hErr, errHydraUnavailable)
+	}
+	return true
+}
+
+type LoginInfo struct {
+	Skip           bool     `json:"skip"`
+	Subject        string   `json:"subject"`
+	RequestedScope []string `json:"requested_scope"`
+}
+
+func (c HydraClient) GetLoginInfo(ctx context.Context, challenge string) (LoginInfo, error) {
+	info := LoginInfo{}
+	err := c.do(ctx, http.MethodGet, "/oauth2/auth/requests/login", url.Values{"login_challenge": {challenge}}, nil, &info)
 	if err != nil {
 		return LoginInfo{}, err
 	}
-	return logInfo, nil
+	return info, nil
 }
 
 type AcceptLoginRequest struct {
 	Subject     string `json:"subject"`
 	Remember    bool   `json:"remember"`
 	RememberFor int    `json:"remember_for"`
+	// ACR and AMR end up in the ID token, see acrSingleFactor and the amr* constants.
+	ACR string   `json:"acr,omitempty"`
+	AMR []string `json:"amr,omitempty"`
 }
 
 type AcceptLoginResponse struct {
 	RedirectTo string `json:"redirect_to"`
 }
 
-func (c HydraClient) AcceptLogin(challenge string, req AcceptLoginRequest) (AcceptLoginResponse, error) {
-	buf, err := json.Marshal(req)
-	if err != nil {
-		return AcceptLoginResponse{}, err
-	}
-	url := fmt.Sprintf("%s/oauth2/auth/requests/login/accept?login_challenge=%s", c.adminUrl, challenge)
-	request, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(buf))
-	if err != nil {
-		return AcceptLoginResponse{}, err
-	}
-	res, err := c.client.Do(request)
-	if err != nil {
-		return AcceptLoginResponse{}, err
-	}
-	buf, err = ioutil.ReadAll(res.Body)
-	if err != nil {
-		return AcceptLoginResponse{}, err
-	}
+func (c HydraClient) AcceptLogin(ctx context.Context, challenge string, req AcceptLoginRequest) (AcceptLoginResponse, error) {
 	accRes := AcceptLoginResponse{}
-	err = json.Unmarshal(buf, &accRes)
+	err := c.do(ctx, http.MethodPut, "/oauth2/auth/requests/login/accept", url.Values{"login_challenge": {challenge}}, req, &accRes)
 	if err != nil {
 		return AcceptLoginResponse{}, err
 	}
 	return accRes, nil
 }
 
-type ConsentInfo struct {
-	Skip              bool     `json:"skip"`
-	Subject           string   `json:"subject"`
-	RequestedScope    []string `json:"requested_scope"`
-	RequestedAudience []string `json:"requested_access_token_audience"`
+// RejectRequest is the error the client gets for a rejected login or consent request.
+type RejectRequest struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	ErrorHint        string `json:"error_hint,omitempty"`
+	StatusCode       int    `json:"status_code,omitempty"`
 }
 
-func (c HydraClient) GetConsentInfo(challenge string) (ConsentInfo, error) {
-	//fetch information about the request
-	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/oauth2/auth/requests/consent?consent_challenge=%s", c.adminUrl, challenge), nil)
+type RejectResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+func (c HydraClient) RejectLogin(ctx context.Context, challenge string, req RejectRequest) (RejectResponse, error) {
+	rejRes := RejectResponse{}
+	err := c.do(ctx, http.MethodPut, "/oauth2/auth/requests/login/reject", url.Values{"login_challenge": {challenge}}, req, &rejRes)
 	if err != nil {
-		return ConsentInfo{}, err
+		return RejectResponse{}, err
 	}
-	res, err := c.client.Do(request)
-	if err != nil {
-		return ConsentInfo{}, err
+	return rejRes, nil
+}
+
+// OAuth2Client is an OAuth 2.0 client registered with Hydra.
+type OAuth2Client struct {
+	ClientID   string `json:"client_id"`
+	ClientName string `json:"client_name,omitempty"`
+	// ClientSecret is only returned when creating a client. Updates without it keep the secret.
+	ClientSecret           string   `json:"client_secret,omitempty"`
+	RedirectURIs           []string `json:"redirect_uris,omitempty"`
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+	GrantTypes             []string `json:"grant_types,omitempty"`
+	ResponseTypes          []string `json:"response_types,omitempty"`
+	// Scope is a space separated list.
+	Scope                   string   `json:"scope,omitempty"`
+	Audience                []string `json:"audience,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	PolicyURI               string   `json:"policy_uri,omitempty"`
+	TosURI                  string   `json:"tos_uri,omitempty"`
+	// Metadata is free form, see clientClaims for what the IdP reads from it.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+func clientPath(id string) string {
+	return "/clients/" + url.PathEscape(id)
+}
+
+// ListClients returns all clients registered with Hydra.
+func (c HydraClient) ListClients(ctx context.Context) ([]OAuth2Client, error) {
+	clients := []OAuth2Client{}
+	for offset := 0; ; offset += clientPageSize {
+		var page []OAuth2Client
+		q := url.Values{"limit": {strconv.Itoa(clientPageSize)}, "offset": {strconv.Itoa(offset)}}
+		if err := c.do(ctx, http.MethodGet, "/clients", q, nil, &page); err != nil {
+			return nil, err
+		}
+		clients = append(clients, page...)
+		if len(page) < clientPageSize {
+			return clients, nil
+		}
 	}
-	buf, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return ConsentInfo{}, err
+}
+
+func (c HydraClient) GetClient(ctx context.Context, id string) (OAuth2Client, error) {
+	client := OAuth2Client{}
+	if err := c.do(ctx, http.MethodGet, clientPath(id), nil, nil, &client); err != nil {
+		return OAuth2Client{}, err
 	}
-	conInfo := ConsentInfo{}
-	err = json.Unmarshal(buf, &conInfo)
+	return client, nil
+}
+
+// CreateClient registers client. Hydra generates a secret if none is set and the client
+// authenticates with one, which is only returned here.
+func (c HydraClient) CreateClient(ctx context.Context, client OAuth2Client) (OAuth2Client, error) {
+	created := OAuth2Client{}
+	if err := c.do(ctx, http.MethodPost, "/clients", nil, client, &created); err != nil {
+		return OAuth2Client{}, err
+	}
+	return created, nil
+}
+
+// UpdateClient replaces the registration of client.ClientID.
+func (c HydraClient) UpdateClient(ctx context.Context, client OAuth2Client) (OAuth2Client, error) {
+	updated := OAuth2Client{}
+	if err := c.do(ctx, http.MethodPut, clientPath(client.ClientID), nil, client, &updated); err != nil {
+		return OAuth2Client{}, err
+	}
+	return updated, nil
+}
+
+// DeleteClient removes the registration of the client.
+func (c HydraClient) DeleteClient(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, clientPath(id), nil, nil, nil)
+}
+
+type ConsentInfo struct {
+	Skip              bool         `json:"skip"`
+	Subject           string       `json:"subject"`
+	RequestedScope    []string     `json:"requested_scope"`
+	RequestedAudience []string     `json:"requested_access_token_audience"`
+	Client            OAuth2Client `json:"client"`
+	// LoginSessionID identifies the login session of the browser the consent was given in.
+	LoginSessionID string `json:"login_session_id"`
+}
+
+func (c HydraClient) GetConsentInfo(ctx context.Context, challenge string) (ConsentInfo, error) {
+	info := ConsentInfo{}
+	err := c.do(ctx, http.MethodGet, "/oauth2/auth/requests/consent", url.Values{"consent_challenge": {challenge}}, nil, &info)
 	if err != nil {
 		return ConsentInfo{}, err
 	}
-	return conInfo, nil
+	return info, nil
 }
 
 type AcceptConsentRequest struct {
 	GrantScope               []string `json:"grant_scope"`
 	GrantAccessTokenAudience []string `json:"grant_access_token_audience"`
 	Remember                 bool     `json:"remember"`
-	RememberFor              int      `json:"remember_for"`
-	//TODO: evt. add session
+	// RememberFor is in seconds, zero remembers the consent until it is revoked.
+	RememberFor int            `json:"remember_for"`
+	Session     ConsentSession `json:"session"`
+}
+
+// ConsentSession are the claims Hydra adds to the ID token and to the access token, the latter
+// being visible in introspection and in the ext claim of JWT access tokens.
+type ConsentSession struct {
+	IDToken     map[string]interface{} `json:"id_token,omitempty"`
+	AccessToken map[string]interface{} `json:"access_token,omitempty"`
 }
 type AcceptConsentResponse struct {
 	RedirectTo string `json:"redirect_to"`
 }
 
-func (c HydraClient) AcceptConsent(challenge string, req AcceptConsentRequest) (AcceptConsentResponse, error) {
-	buf, err := json.Marshal(req)
+func (c HydraClient) AcceptConsent(ctx context.Context, challenge string, req AcceptConsentRequest) (AcceptConsentResponse, error) {
+	conRes := AcceptConsentResponse{}
+	err := c.do(ctx, http.MethodPut, "/oauth2/auth/requests/consent/accept", url.Values{"consent_challenge": {challenge}}, req, &conRes)
 	if err != nil {
 		return AcceptConsentResponse{}, err
 	}
+	return conRes, nil
+}
 
-	url := fmt.Sprintf("%s/oauth2/auth/requests/consent/accept?consent_challenge=%s", c.adminUrl, challenge)
-	request, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(buf))
+func (c HydraClient) RejectConsent(ctx context.Context, challenge string, req RejectRequest) (RejectResponse, error) {
+	rejRes := RejectResponse{}
+	err := c.do(ctx, http.MethodPut, "/oauth2/auth/requests/consent/reject", url.Values{"consent_challenge": {challenge}}, req, &rejRes)
 	if err != nil {
-		return AcceptConsentResponse{}, err
+		return RejectResponse{}, err
 	}
-	res, err := c.client.Do(request)
+	return rejRes, nil
+}
+
+type LogoutInfo struct {
+	Subject   string `json:"subject"`
+	SessionID string `json:"sid"`
+	// RPInitiated is true if a client asked for the logout, rather than the user visiting the
+	// logout endpoint of Hydra.
+	RPInitiated bool   `json:"rp_initiated"`
+	RequestURL  string `json:"request_url"`
+}
+
+type AcceptLogoutResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+func (c HydraClient) GetLogoutInfo(ctx context.Context, challenge string) (LogoutInfo, error) {
+	info := LogoutInfo{}
+	err := c.do(ctx, http.MethodGet, "/oauth2/auth/requests/logout", url.Values{"logout_challenge": {challenge}}, nil, &info)
 	if err != nil {
-		return AcceptConsentResponse{}, err
+		return LogoutInfo{}, err
 	}
-	buf, err = ioutil.ReadAll(res.Body)
+	return info, nil
+}
+
+func (c HydraClient) AcceptLogout(ctx context.Context, challenge string) (AcceptLogoutResponse, error) {
+	accRes := AcceptLogoutResponse{}
+	err := c.do(ctx, http.MethodPut, "/oauth2/auth/requests/logout/accept", url.Values{"logout_challenge": {challenge}}, nil, &accRes)
 	if err != nil {
-		return AcceptConsentResponse{}, err
+		return AcceptLogoutResponse{}, err
 	}
-	//redirect
-	responseRedirect := AcceptConsentResponse{}
-	err = json.Unmarshal(buf, &responseRedirect)
+	return accRes, nil
+}
+
+// RejectLogout keeps the user logged in. Hydra has nowhere to send the browser to in that case.
+func (c HydraClient) RejectLogout(ctx context.Context, challenge string) error {
+	return c.do(ctx, http.MethodPut, "/oauth2/auth/requests/logout/reject", url.Values{"logout_challenge": {challenge}}, nil, nil)
+}
+
+// RevokeLoginSessions logs subject out of all browsers, so that Hydra asks for a login again.
+func (c HydraClient) RevokeLoginSessions(ctx context.Context, subject string) error {
+	return c.do(ctx, http.MethodDelete, "/oauth2/auth/sessions/login", url.Values{"subject": {subject}}, nil, nil)
+}
+
+// RevokeConsentSessions revokes the consents subject gave to all clients, and the tokens issued
+// for them.
+func (c HydraClient) RevokeConsentSessions(ctx context.Context, subject string) error {
+	return c.do(ctx, http.MethodDelete, "/oauth2/auth/sessions/consent", url.Values{"subject": {subject}, "all": {"true"}}, nil, nil)
+}
+
+// RevokeClientConsentSessions is like RevokeConsentSessions, but only for the client clientID.
+func (c HydraClient) RevokeClientConsentSessions(ctx context.Context, subject string, clientID string) error {
+	return c.do(ctx, http.MethodDelete, "/oauth2/auth/sessions/consent", url.Values{"subject": {subject}, "client": {clientID}}, nil, nil)
+}
+
+// PreviousConsentSession is a consent Hydra remembers.
+type PreviousConsentSession struct {
+	ConsentRequest           ConsentInfo `json:"consent_request"`
+	GrantScope               []string    `json:"grant_scope"`
+	GrantAccessTokenAudience []string    `json:"grant_access_token_audience"`
+	Remember                 bool        `json:"remember"`
+	RememberFor              int         `json:"remember_for"`
+	HandledAt                time.Time   `json:"handled_at"`
+}
+
+// ListConsentSessions returns the consents of subject Hydra remembers, for all clients.
+func (c HydraClient) ListConsentSessions(ctx context.Context, subject string) ([]PreviousConsentSession, error) {
+	sessions := []PreviousConsentSession{}
+	err := c.do(ctx, http.MethodGet, "/oauth2/auth/sessions/consent", url.Values{"subject": {subject}}, nil, &sessions)
 	if err != nil {
-		return AcceptConsentResponse{}, err
+		return nil, err
 	}
-	return responseRedirect, nil
+	return sessions, nil
 }
 
 type TokenIntrospectionResponse struct {
-	active bool
+	Active  bool   `json:"active"`
+	Subject string `json:"sub"`
 }
 
-func (c HydraClient) IntrospectToken(jwtToken string) (string, error) {
-	url := fmt.Sprintf("%s%s", c.adminUrl, tokenIntrospectionPath)
-	log.Info(jwtToken)
-	res, err := http.Post(url, "application/x-www-form-urlencoded", strings.NewReader(jwtToken))
-	if err != nil {
-		log.WithError(err).Error("Failed to sent token introspection request.")
-		return "", err
-	}
-	defer res.Body.Close()
-	d := json.NewDecoder(res.Body)
+func (c HydraClient) IntrospectToken(ctx context.Context, jwtToken string) (TokenIntrospectionResponse, error) {
 	i := TokenIntrospectionResponse{}
-	err = d.Decode(&i)
-	log.Info(i)
+	form := url.Values{"token": {jwtToken}}.Encode()
+	// Introspection only reads, despite being a POST.
+	err := c.send(ctx, http.MethodPost, c.adminUrl+tokenIntrospectionPath, "application/x-www-form-urlencoded", []byte(form), true, &i)
 	if err != nil {
-		log.WithError(err).Error("Failed to unmarshal token introspection response.")
-		return "", err
+		log.WithError(err).Error("Failed to introspect token.")
+		return TokenIntrospectionResponse{}, err
 	}
-	return "", nil
-}
\ No newline at end of file
+	return i, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHydraClientErrors(t *testing.T) {
+	h := newFakeHydra()
+	defer h.Close()
+	h.logins["a&b=c d"] = LoginInfo{Subject: "a3"}
+	c := h.client()
+	ctx := context.Background()
+
+	info, err := c.GetLoginInfo(ctx, "a&b=c d")
+	if err != nil || info.Subject != "a3" {
+		t.Fatalf("Failed to get login with escaped challenge %+v. %v", info, err)
+	}
+	if _, err := c.AcceptLogin(ctx, "a&b=c d", AcceptLoginRequest{Subject: "a3"}); err != nil {
+		t.Fatalf("Failed to accept login. %v", err)
+	}
+
+	tests := map[string]struct {
+		call func() error
+		want error
+	}{
+		"expired": {func() error {
+			_, err := c.GetLoginInfo(ctx, "unknown")
+			return err
+		}, errRequestExpired},
+		"handled": {func() error {
+			_, err := c.AcceptLogin(ctx, "a&b=c d", AcceptLoginRequest{Subject: "a3"})
+			return err
+		}, errRequestHandled},
+		"unavailable": {func() error {
+			_, err := c.GetConsentInfo(ctx, "broken")
+			return err
+		}, errHydraUnavailable},
+	}
+	for name, tc := range tests {
+		err := tc.call()
+		var hErr *HydraError
+		if !errors.As(err, &hErr) || !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+		}
+		for _, other := range []error{errRequestExpired, errRequestHandled, errHydraUnavailable} {
+			if other != tc.want && errors.Is(err, other) {
+				t.Errorf("%s: %v also matches %v", name, err, other)
+			}
+		}
+	}
+}
+
+func TestHydraClientRetries(t *testing.T) {
+	var calls, status int32
+	respond := func(code int) {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&status, int32(code))
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if code := int(atomic.LoadInt32(&status)); code != http.StatusOK {
+			hydraError(w, code, "")
+			return
+		}
+		w.Write([]byte(`{"subject": "a3"}`))
+	}))
+	defer ts.Close()
+	c := NewHydraClient(ts.URL, ts.Client(), time.Second, 2, time.Millisecond)
+	ctx := context.Background()
+
+	respond(http.StatusServiceUnavailable)
+	if _, err := c.GetLoginInfo(ctx, "c"); !errors.Is(err, errHydraUnavailable) || calls != 3 {
+		t.Errorf("Expected 3 calls failing with 503, got %d. %v", calls, err)
+	}
+
+	respond(http.StatusNotFound)
+	if _, err := c.GetLoginInfo(ctx, "c"); !errors.Is(err, errRequestExpired) || calls != 1 {
+		t.Errorf("Expected a single call failing with 404, got %d. %v", calls, err)
+	}
+
+	respond(http.StatusOK)
+	if info, err := c.GetLoginInfo(ctx, "c"); err != nil || info.Subject != "a3" || calls != 1 {
+		t.Errorf("Unexpected login info %+v after %d calls. %v", info, calls, err)
+	}
+
+	// Hydra may have accepted the login before failing, a retry would fail with a conflict.
+	respond(http.StatusBadGateway)
+	if _, err := c.AcceptLogin(ctx, "c", AcceptLoginRequest{Subject: "a3"}); !errors.Is(err, errHydraUnavailable) || calls != 1 {
+		t.Errorf("Expected a single call accepting the login, got %d. %v", calls, err)
+	}
+
+	// Unless the connection could not be made.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	down := NewHydraClient(closed.URL, closed.Client(), time.Second, 2, time.Millisecond)
+	var opErr *net.OpError
+	if _, err := down.AcceptLogin(ctx, "c", AcceptLoginRequest{}); !errors.As(err, &opErr) || !retryable(err, false) {
+		t.Errorf("Expected a retryable dial error. %v", err)
+	}
+
+	// Retries stop with the context of the call.
+	respond(http.StatusBadGateway)
+	c.backoff = time.Hour
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.GetLoginInfo(ctx, "c"); err == nil || time.Since(start) > 5*time.Second || calls != 1 {
+		t.Errorf("Expected to give up on context deadline after 1 call, got %d. %v", calls, err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+var clientIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+var (
+	clientGrantTypes    = map[string]bool{"authorization_code": true, "refresh_token": true, "client_credentials": true, "implicit": true}
+	clientResponseTypes = map[string]bool{"code": true, "token": true, "id_token": true}
+	// clientAuthMethods are how clients authenticate at the token endpoint. Hydra defaults to
+	// client_secret_basic.
+	clientAuthMethods = map[string]bool{"": true, "client_secret_basic": true, "client_secret_post": true, "private_key_jwt": true, "none": true}
+)
+
+// ClientConfig is an OAuth 2.0 client as set in the config file, see Config.Clients, and as
+// managed through the admin API:
+//
+//	client "fadalax-frontend" {
+//	  name          = "fadalax"
+//	  secret        = "..."
+//	  redirect_uris = ["https://fadalax.tech/index.html"]
+//	  grant_types   = ["authorization_code", "refresh_token"]
+//	  scopes        = ["openid", "offline", "profile", "email"]
+//	}
+type ClientConfig struct {
+	ID   string `hcl:",key" json:"clientId"`
+	Name string `hcl:"name" json:"clientName,omitempty"`
+	// Secret is only returned when Hydra generated it, or after rotating it. Left empty on update,
+	// the secret does not change.
+	Secret                 string   `hcl:"secret" json:"clientSecret,omitempty"`
+	RedirectURIs           []string `hcl:"redirect_uris" json:"redirectUris"`
+	PostLogoutRedirectURIs []string `hcl:"post_logout_redirect_uris" json:"postLogoutRedirectUris"`
+	GrantTypes             []string `hcl:"grant_types" json:"grantTypes"`
+	// ResponseTypes may combine types, as in "code id_token".
+	ResponseTypes           []string `hcl:"response_types" json:"responseTypes"`
+	Scopes                  []string `hcl:"scopes" json:"scopes"`
+	Audience                []string `hcl:"audience" json:"audience"`
+	TokenEndpointAuthMethod string   `hcl:"token_endpoint_auth_method" json:"tokenEndpointAuthMethod,omitempty"`
+	LogoURI                 string   `hcl:"logo_uri" json:"logoUri,omitempty"`
+	PolicyURI               string   `hcl:"policy_uri" json:"policyUri,omitempty"`
+	TosURI                  string   `hcl:"tos_uri" json:"tosUri,omitempty"`
+}
+
+func newClientConfig(c OAuth2Client) ClientConfig {
+	return ClientConfig{
+		ID:                      c.ClientID,
+		Name:                    c.ClientName,
+		Secret:                  c.ClientSecret,
+		RedirectURIs:            nonNil(c.RedirectURIs),
+		PostLogoutRedirectURIs:  nonNil(c.PostLogoutRedirectURIs),
+		GrantTypes:              nonNil(c.GrantTypes),
+		ResponseTypes:           nonNil(c.ResponseTypes),
+		Scopes:                  append([]string{}, strings.Fields(c.Scope)...),
+		Audience:                nonNil(c.Audience),
+		TokenEndpointAuthMethod: c.TokenEndpointAuthMethod,
+		LogoURI:                 c.LogoURI,
+		PolicyURI:               c.PolicyURI,
+		TosURI:                  c.TosURI,
+	}
+}
+
+func nonNil(l []string) []string {
+	if l == nil {
+		return []string{}
+	}
+	return l
+}
+
+// oauth2Client returns the registration of c in Hydra, keeping the metadata of the current one,
+// which the IdP does not manage.
+func (c ClientConfig) oauth2Client(current OAuth2Client) OAuth2Client {
+	return OAuth2Client{
+		ClientID:                c.ID,
+		ClientName:              c.Name,
+		ClientSecret:            c.Secret,
+		RedirectURIs:            c.RedirectURIs,
+		PostLogoutRedirectURIs:  c.PostLogoutRedirectURIs,
+		GrantTypes:              c.GrantTypes,
+		ResponseTypes:           c.ResponseTypes,
+		Scope:                   strings.Join(c.Scopes, " "),
+		Audience:                c.Audience,
+		TokenEndpointAuthMethod: c.TokenEndpointAuthMethod,
+		LogoURI:                 c.LogoURI,
+		PolicyURI:               c.PolicyURI,
+		TosURI:                  c.TosURI,
+		Metadata:                current.Metadata,
+	}
+}
+
+// validate checks what Hydra would reject, so that the config is rejected before anything is
+// changed.
+func (c ClientConfig) validate() error {
+	if !clientIDRegex.MatchString(c.ID) {
+		return fmt.Errorf("invalid client id %q", c.ID)
+	}
+	for _, u := range append(append([]string{}, c.RedirectURIs...), c.PostLogoutRedirectURIs...) {
+		if p, err := url.Parse(u); err != nil || p.Scheme == "" || p.Host == "" || p.Fragment != "" {
+			return fmt.Errorf("%q is not an absolute URL without fragment", u)
+		}
+	}
+	redirects := false
+	for _, g := range c.GrantTypes {
+		if !clientGrantTypes[g] {
+			return fmt.Errorf("unknown grant type %q", g)
+		}
+		redirects = redirects || g == "authorization_code" || g == "implicit"
+	}
+	if redirects && len(c.RedirectURIs) == 0 {
+		return fmt.Errorf("redirect uris are needed for the authorization code and implicit grants")
+	}
+	for _, rt := range c.ResponseTypes {
+		for _, t := range strings.Fields(rt) {
+			if !clientResponseTypes[t] {
+				return fmt.Errorf("unknown response type %q", t)
+			}
+		}
+	}
+	for _, s := range c.Scopes {
+		if s == "" || strings.ContainsAny(s, " \t\n") {
+			return fmt.Errorf("invalid scope %q", s)
+		}
+	}
+	if !clientAuthMethods[c.TokenEndpointAuthMethod] {
+		return fmt.Errorf("unknown token endpoint auth method %q", c.TokenEndpointAuthMethod)
+	}
+	if c.TokenEndpointAuthMethod == "none" && c.Secret != "" {
+		return fmt.Errorf("public clients have no secret")
+	}
+	return nil
+}
+
+// usesSecret reports whether the client authenticates with a client secret.
+func (c ClientConfig) usesSecret() bool {
+	return c.TokenEndpointAuthMethod != "none" && c.TokenEndpointAuthMethod != "private_key_jwt"
+}
+
+func generateClientSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// syncClients makes the clients registered with Hydra match the configured ones. Missing clients
+// are created and existing ones replaced. With prune, clients that are not configured are deleted.
+func syncClients(ctx context.Context, hydra hydraAdminClient, clients []ClientConfig, prune bool) error {
+	registered, err := hydra.ListClients(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list clients: %v", err)
+	}
+	current := map[string]OAuth2Client{}
+	for _, c := range registered {
+		current[c.ClientID] = c
+	}
+	configured := map[string]bool{}
+	for _, c := range clients {
+		configured[c.ID] = true
+		l := log.WithField("client", c.ID)
+		if cur, ok := current[c.ID]; ok {
+			if _, err := hydra.UpdateClient(ctx, c.oauth2Client(cur)); err != nil {
+				return fmt.Errorf("failed to update client %s: %v", c.ID, err)
+			}
+			l.Info("Updated client.")
+			continue
+		}
+		if _, err := hydra.CreateClient(ctx, c.oauth2Client(OAuth2Client{})); err != nil {
+			return fmt.Errorf("failed to create client %s: %v", c.ID, err)
+		}
+		l.Info("Created client.")
+	}
+	if !prune {
+		return nil
+	}
+	for _, c := range registered {
+		if configured[c.ClientID] {
+			continue
+		}
+		if err := hydra.DeleteClient(ctx, c.ClientID); err != nil && !errors.Is(err, errClientNotFound) {
+			return fmt.Errorf("failed to delete client %s: %v", c.ClientID, err)
+		}
+		log.WithField("client", c.ClientID).Info("Deleted client.")
+	}
+	return nil
+}
+
+// clientFailed responds to a failed call of the client API of Hydra. Hydra's reasons for rejecting
+// a registration are passed on, other failures are only logged.
+func (s server) clientFailed(w http.ResponseWriter, l *log.Entry, err error, msg string) {
+	var hErr *HydraError
+	switch {
+	case errors.Is(err, errClientNotFound):
+		s.httpNotFound(w)
+	case errors.Is(err, errClientExists):
+		http.Error(w, "client already exists", http.StatusConflict)
+	case errors.As(err, &hErr) && hErr.StatusCode == http.StatusBadRequest:
+		s.httpBadRequest(w, hErr.Description)
+	default:
+		l.WithError(err).Error("Hydra client API failed.")
+		s.httpInternalError(w, fmt.Errorf("failed to %s", msg))
+	}
+}
+
+// AdminListClients lists the OAuth 2.0 clients registered with Hydra.
+func (s server) AdminListClients(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	registered, err := s.hydra.ListClients(r.Context())
+	if err != nil {
+		s.clientFailed(w, log.WithField("admin", admin), err, "list clients")
+		return
+	}
+	clients := []ClientConfig{}
+	for _, c := range registered {
+		clients = append(clients, newClientConfig(c))
+	}
+	s.writeJSON(w, http.StatusOK, clients)
+}
+
+func (s server) AdminGetClient(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	c, err := s.hydra.GetClient(r.Context(), id)
+	if err != nil {
+		s.clientFailed(w, log.WithFields(log.Fields{"admin": admin, "client": id}), err, "get client")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, newClientConfig(c))
+}
+
+// AdminCreateClient registers a client. If it authenticates with a secret and none is given,
+// Hydra generates one, which is only returned in the response.
+func (s server) AdminCreateClient(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req ClientConfig
+	if err := readJSON(r, &req); err != nil {
+		s.httpBadRequest(w, "Could not parse body.")
+		return
+	}
+	if err := req.validate(); err != nil {
+		s.httpBadRequest(w, err.Error())
+		return
+	}
+	l := log.WithFields(log.Fields{"admin": admin, "client": req.ID})
+	created, err := s.hydra.CreateClient(r.Context(), req.oauth2Client(OAuth2Client{}))
+	if err != nil {
+		s.clientFailed(w, l, err, "create client")
+		return
+	}
+	l.Info("Created client.")
+	s.writeJSON(w, http.StatusCreated, newClientConfig(created))
+}
+
+// AdminUpdateClient replaces the registration of the client in the path. Clients in the config
+// file are reset at the next start of the IdP.
+func (s server) AdminUpdateClient(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	l := log.WithFields(log.Fields{"admin": admin, "client": id})
+	var req ClientConfig
+	if err := readJSON(r, &req); err != nil {
+		s.httpBadRequest(w, "Could not parse body.")
+		return
+	}
+	if req.ID != "" && req.ID != id {
+		s.httpBadRequest(w, "client id does not match path")
+		return
+	}
+	req.ID = id
+	if err := req.validate(); err != nil {
+		s.httpBadRequest(w, err.Error())
+		return
+	}
+	cur, err := s.hydra.GetClient(r.Context(), id)
+	if err != nil {
+		s.clientFailed(w, l, err, "update client")
+		return
+	}
+	updated, err := s.hydra.UpdateClient(r.Context(), req.oauth2Client(cur))
+	if err != nil {
+		s.clientFailed(w, l, err, "update client")
+		return
+	}
+	l.Info("Updated client.")
+	c := newClientConfig(updated)
+	c.Secret = ""
+	s.writeJSON(w, http.StatusOK, c)
+}
+
+// AdminDeleteClient removes the client in the path. The client of the frontend cannot be deleted,
+// as the admin API itself depends on it.
+func (s server) AdminDeleteClient(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	l := log.WithFields(log.Fields{"admin": admin, "client": id})
+	if id == s.cfg.Tokens.Audience {
+		s.httpBadRequest(w, "Reserved id")
+		return
+	}
+	if err := s.hydra.DeleteClient(r.Context(), id); err != nil {
+		s.clientFailed(w, l, err, "delete client")
+		return
+	}
+	l.Info("Deleted client.")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// AdminRotateClientSecret sets a new random secret for the client in the path and returns it. The
+// old secret stops working immediately.
+func (s server) AdminRotateClientSecret(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	l := log.WithFields(log.Fields{"admin": admin, "client": id})
+	cur, err := s.hydra.GetClient(r.Context(), id)
+	if err != nil {
+		s.clientFailed(w, l, err, "rotate client secret")
+		return
+	}
+	c := newClientConfig(cur)
+	if !c.usesSecret() {
+		s.httpBadRequest(w, "client does not authenticate with a secret")
+		return
+	}
+	if c.Secret, err = generateClientSecret(); err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	updated, err := s.hydra.UpdateClient(r.Context(), c.oauth2Client(cur))
+	if err != nil {
+		s.clientFailed(w, l, err, "rotate client secret")
+		return
+	}
+	l.Info("Rotated client secret.")
+	res := newClientConfig(updated)
+	res.Secret = c.Secret
+	s.writeJSON(w, http.StatusOK, res)
+}
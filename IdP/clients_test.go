@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateClient(t *testing.T) {
+	valid := ClientConfig{
+		ID:            "fadalax-frontend",
+		RedirectURIs:  []string{"https://fadalax.tech/index.html"},
+		GrantTypes:    []string{"authorization_code", "refresh_token"},
+		ResponseTypes: []string{"code", "code id_token"},
+		Scopes:        []string{"openid", "offline"},
+	}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("Valid client rejected. %v", err)
+	}
+	for name, tc := range map[string]struct {
+		edit func(c *ClientConfig)
+		err  string
+	}{
+		"id":              {func(c *ClientConfig) { c.ID = "a b" }, "invalid client id"},
+		"relative uri":    {func(c *ClientConfig) { c.RedirectURIs = []string{"/index.html"} }, "not an absolute URL"},
+		"fragment":        {func(c *ClientConfig) { c.PostLogoutRedirectURIs = []string{"https://fadalax.tech/#/"} }, "not an absolute URL"},
+		"grant type":      {func(c *ClientConfig) { c.GrantTypes = []string{"password"} }, "unknown grant type"},
+		"no redirect uri": {func(c *ClientConfig) { c.RedirectURIs = nil }, "redirect uris are needed"},
+		"response type":   {func(c *ClientConfig) { c.ResponseTypes = []string{"code device"} }, "unknown response type"},
+		"scope":           {func(c *ClientConfig) { c.Scopes = []string{"openid email"} }, "invalid scope"},
+		"auth method":     {func(c *ClientConfig) { c.TokenEndpointAuthMethod = "tls_client_auth" }, "unknown token endpoint auth method"},
+		"public secret": {func(c *ClientConfig) {
+			c.TokenEndpointAuthMethod = "none"
+			c.Secret = "secret"
+		}, "public clients have no secret"},
+	} {
+		c := valid
+		tc.edit(&c)
+		if err := c.validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestSyncClients(t *testing.T) {
+	h := newFakeHydra()
+	defer h.Close()
+	hydra := h.client()
+	ctx := context.Background()
+	metadata := json.RawMessage(`{"id_token_claims":{"tenant":"imovies"}}`)
+	h.clients["vault"] = OAuth2Client{ClientID: "vault", ClientSecret: "old", Scope: "openid", Metadata: metadata}
+	h.clients["legacy"] = OAuth2Client{ClientID: "legacy"}
+
+	clients := []ClientConfig{
+		{ID: "vault", RedirectURIs: []string{"https://vault.fadalax.tech/callback"}, Scopes: []string{"openid", "offline"}},
+		{ID: "fadalax-frontend", Secret: "frontend-secret", RedirectURIs: []string{"https://fadalax.tech/index.html"}},
+	}
+	if err := syncClients(ctx, hydra, clients, false); err != nil {
+		t.Fatalf("Failed to sync clients. %v", err)
+	}
+	vault := h.clients["vault"]
+	if vault.Scope != "openid offline" || vault.ClientSecret != "old" || string(vault.Metadata) != string(metadata) {
+		t.Errorf("Unexpected update of vault %+v", vault)
+	}
+	if f := h.clients["fadalax-frontend"]; f.ClientSecret != "frontend-secret" || !reflect.DeepEqual(f.RedirectURIs, clients[1].RedirectURIs) {
+		t.Errorf("Unexpected registration of the frontend %+v", f)
+	}
+	if _, ok := h.clients["legacy"]; !ok {
+		t.Error("Unconfigured client deleted without prune.")
+	}
+
+	if err := syncClients(ctx, hydra, clients, true); err != nil {
+		t.Fatalf("Failed to sync clients. %v", err)
+	}
+	if _, ok := h.clients["legacy"]; ok || len(h.clients) != 2 {
+		t.Errorf("Unexpected clients after pruning %v", h.clients)
+	}
+}
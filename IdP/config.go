@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+)
+
+// Config is what differs between organizations running the IdP. It is read from an HCL or JSON
+// file, see loadConfig, and fields left empty get defaults derived from the domain.
+//
+//	domain          = "fadalax.tech"
+//	cors_origins    = ["https://fadalax.tech", "https://*.fadalax.tech"]
+//	public_url      = "https://idp.fadalax.tech"
+//	issuer          = "https://hydra.fadalax.tech:9000/"
+//	hydra_admin_url = "https://localhost:9001"
+//	vault_url       = "https://vault.fadalax.tech:8200"
+//
+//	pki {
+//	  organization = "imovies"
+//	  country      = "CH"
+//	  ca_ttl       = "43800h"
+//	  cert_ttl     = "336h"
+//	}
+//
+//	tokens {
+//	  audience            = "fadalax-frontend"
+//	  access_token_claims = ["email"]
+//	}
+//
+//	listen {
+//	  address         = ":8088"
+//	  trusted_proxies = ["127.0.0.1", "::1"]
+//	}
+//
+//	client "vault" {
+//	  secret        = "..."
+//	  redirect_uris = ["https://vault.fadalax.tech:8200/ui/vault/auth/oidc/oidc/callback"]
+//	  scopes        = ["openid"]
+//	}
+//
+// Every setting, except for clients, can be overridden by the environment variable in its env tag.
+// Lists are comma separated there.
+type Config struct {
+	// Domain users get certificates for, as uid@domain.
+	Domain string `hcl:"domain" env:"IDP_DOMAIN"`
+	// CORSOrigins may call the API from a browser. An entry is a host, optionally with scheme. A
+	// leading "*." matches all subdomains. Ports are ignored.
+	CORSOrigins []string `hcl:"cors_origins" env:"IDP_CORS_ORIGINS"`
+	// PublicURL is where users reach the IdP, used in links sent by mail.
+	PublicURL string `hcl:"public_url" env:"IDP_PUBLIC_URL"`
+	// Issuer is the OpenID Connect issuer of the tokens, that is Hydra.
+	Issuer string `hcl:"issuer" env:"IDP_ISSUER"`
+	// HydraAdminURL and VaultURL are the APIs the IdP calls.
+	HydraAdminURL string       `hcl:"hydra_admin_url" env:"IDP_HYDRA_ADMIN_URL"`
+	VaultURL      string       `hcl:"vault_url" env:"IDP_VAULT_URL"`
+	PKI           PKIConfig    `hcl:"pki"`
+	Tokens        TokenConfig  `hcl:"tokens"`
+	Listen        ListenConfig `hcl:"listen"`
+	// Clients are registered with Hydra at startup, replacing existing registrations, see
+	// syncClients. Clients not listed are left alone, unless PruneClients is set.
+	Clients      []ClientConfig `hcl:"client"`
+	PruneClients bool           `hcl:"prune_clients"`
+}
+
+// PKIConfig are the parameters of the per user PKIs in Vault.
+type PKIConfig struct {
+	// Organization and Country are set in the subject of user certificates.
+	Organization string `hcl:"organization" env:"IDP_PKI_ORGANIZATION"`
+	Country      string `hcl:"country" env:"IDP_PKI_COUNTRY"`
+	// CATTL is the lifetime of the intermediate CA of a user, and the maximum lease of its mounts.
+	CATTL string `hcl:"ca_ttl" env:"IDP_PKI_CA_TTL"`
+	// CertTTL is the lifetime of user certificates.
+	CertTTL string `hcl:"cert_ttl" env:"IDP_PKI_CERT_TTL"`
+	// VaultRedirectURI is where the Vault UI receives the OIDC logins of users.
+	VaultRedirectURI string `hcl:"vault_redirect_uri" env:"IDP_PKI_VAULT_REDIRECT_URI"`
+}
+
+// TokenConfig are the audiences and claims of tokens issued by Hydra.
+type TokenConfig struct {
+	// Audience of the access tokens of the frontend, accepted by the API and the Vault JWT login.
+	Audience string `hcl:"audience" env:"IDP_TOKEN_AUDIENCE"`
+	// VaultAudience of the ID tokens the Vault UI logs in with.
+	VaultAudience string `hcl:"vault_audience" env:"IDP_TOKEN_VAULT_AUDIENCE"`
+	// AccessTokenClaims are the user claims, like email, also added to access tokens if the
+	// granted scopes allow them. ID tokens get all allowed ones.
+	AccessTokenClaims []string `hcl:"access_token_claims" env:"IDP_TOKEN_ACCESS_TOKEN_CLAIMS"`
+}
+
+// ListenConfig are the listeners of the IdP, see mtls.go.
+type ListenConfig struct {
+	Address string `hcl:"address" env:"IDP_LISTEN"`
+	// TLSAddress enables the mTLS listener.
+	TLSAddress     string   `hcl:"tls_address" env:"IDP_TLS_LISTEN"`
+	TLSCert        string   `hcl:"tls_cert" env:"IDP_TLS_CERT"`
+	TLSKey         string   `hcl:"tls_key" env:"IDP_TLS_KEY"`
+	TrustedProxies []string `hcl:"trusted_proxies" env:"IDP_TRUSTED_PROXIES"`
+}
+
+// loadConfig reads the config file at path, if not empty, and applies the environment overrides.
+// Defaults are not yet set, so that command line flags can still override, see setDefaults.
+func loadConfig(path string, env func(string) string) (Config, error) {
+	var c Config
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := decodeConfig(b, &c); err != nil {
+			return Config{}, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	applyEnv(reflect.ValueOf(&c).Elem(), env)
+	return c, nil
+}
+
+// decodeConfig decodes HCL or JSON into c. Unknown keys are errors, as they are most likely typos.
+func decodeConfig(b []byte, c *Config) error {
+	var raw map[string]interface{}
+	if err := hcl.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if unknown := unknownKeys(raw, reflect.TypeOf(*c), ""); len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings %s", strings.Join(unknown, ", "))
+	}
+	return hcl.Unmarshal(b, c)
+}
+
+// unknownKeys returns the keys of raw which have no field in the struct type t.
+func unknownKeys(raw map[string]interface{}, t reflect.Type, prefix string) []string {
+	var unknown []string
+	for k, v := range raw {
+		f, ok := fieldByTag(t, "hcl", k)
+		if !ok {
+			unknown = append(unknown, prefix+k)
+			continue
+		}
+		// Blocks are decoded as lists of objects.
+		objs, _ := v.([]map[string]interface{})
+		if m, ok := v.(map[string]interface{}); ok {
+			objs = append(objs, m)
+		}
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			for _, m := range objs {
+				unknown = append(unknown, unknownKeys(m, f.Type, prefix+k+".")...)
+			}
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			// Labeled blocks, like client "vault" {...}, are objects of the label.
+			for _, m := range objs {
+				for label, b := range m {
+					blocks, _ := b.([]map[string]interface{})
+					for _, bm := range blocks {
+						unknown = append(unknown, unknownKeys(bm, f.Type.Elem(), prefix+k+"."+label+".")...)
+					}
+				}
+			}
+		}
+	}
+	return unknown
+}
+
+func fieldByTag(t reflect.Type, tag string, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get(tag) == name {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// applyEnv sets the fields of the struct v whose environment variable is set.
+func applyEnv(v reflect.Value, env func(string) string) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			applyEnv(f, env)
+			continue
+		}
+		name := v.Type().Field(i).Tag.Get("env")
+		val := env(name)
+		if name == "" || val == "" {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(val)
+		case reflect.Slice:
+			f.Set(reflect.ValueOf(splitList(val)))
+		}
+	}
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// setDefaults fills the settings left empty. Most defaults are those of the fadalax deployment or
+// derived from the domain.
+func (c *Config) setDefaults() {
+	setString := func(s *string, def string) {
+		if *s == "" {
+			*s = def
+		}
+	}
+	setString(&c.Domain, "fadalax.tech")
+	if len(c.CORSOrigins) == 0 {
+		c.CORSOrigins = []string{c.Domain, "*." + c.Domain}
+	}
+	setString(&c.PublicURL, "http://idp."+c.Domain)
+	setString(&c.Issuer, fmt.Sprintf("https://hydra.%s:9000/", c.Domain))
+	setString(&c.HydraAdminURL, "https://localhost:9001")
+	setString(&c.VaultURL, fmt.Sprintf("https://vault.%s:8200", c.Domain))
+	setString(&c.PKI.Organization, "imovies")
+	setString(&c.PKI.Country, "CH")
+	setString(&c.PKI.CATTL, "43800h")
+	setString(&c.PKI.CertTTL, "336h")
+	setString(&c.PKI.VaultRedirectURI, fmt.Sprintf("https://vault.%s:8200/ui/vault/auth/oidc/oidc/callback", c.Domain))
+	setString(&c.Tokens.Audience, "fadalax-frontend")
+	setString(&c.Tokens.VaultAudience, "vault")
+	setString(&c.Listen.Address, ":8088")
+	if c.Listen.TrustedProxies == nil {
+		c.Listen.TrustedProxies = []string{"127.0.0.1", "::1"}
+	}
+}
+
+var (
+	domainRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,}$`)
+	// Unlike domains, hosts may be e.g. localhost.
+	hostRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+)
+
+// validate checks the complete config and reports all problems at once.
+func (c Config) validate() error {
+	var errs []string
+	bad := func(setting string, format string, args ...interface{}) {
+		errs = append(errs, setting+": "+fmt.Sprintf(format, args...))
+	}
+
+	if !domainRegex.MatchString(c.Domain) {
+		bad("domain", "%q is not a lower case domain name", c.Domain)
+	}
+	for _, o := range c.CORSOrigins {
+		scheme, host := splitOrigin(o)
+		if (scheme != "" && scheme != "http" && scheme != "https") || !hostRegex.MatchString(strings.TrimPrefix(host, "*.")) {
+			bad("cors_origins", "%q is not a host with optional scheme", o)
+		}
+	}
+	for setting, v := range map[string]string{"public_url": c.PublicURL, "issuer": c.Issuer, "hydra_admin_url": c.HydraAdminURL, "vault_url": c.VaultURL} {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			bad(setting, "%q is not an http or https URL", v)
+		}
+	}
+
+	if c.PKI.Organization == "" {
+		bad("pki.organization", "must not be empty")
+	}
+	if len(c.PKI.Country) != 2 {
+		bad("pki.country", "%q is not a two letter country code", c.PKI.Country)
+	}
+	caTTL, err := time.ParseDuration(c.PKI.CATTL)
+	if err != nil || caTTL <= 0 {
+		bad("pki.ca_ttl", "%q is not a positive duration", c.PKI.CATTL)
+	}
+	certTTL, err := time.ParseDuration(c.PKI.CertTTL)
+	if err != nil || certTTL <= 0 {
+		bad("pki.cert_ttl", "%q is not a positive duration", c.PKI.CertTTL)
+	} else if caTTL > 0 && certTTL > caTTL {
+		bad("pki.cert_ttl", "%s exceeds pki.ca_ttl %s", c.PKI.CertTTL, c.PKI.CATTL)
+	}
+	if u, err := url.Parse(c.PKI.VaultRedirectURI); err != nil || u.Scheme != "https" || u.Host == "" {
+		bad("pki.vault_redirect_uri", "%q is not an https URL", c.PKI.VaultRedirectURI)
+	}
+
+	if c.Tokens.Audience == "" {
+		bad("tokens.audience", "must not be empty")
+	}
+	if c.Tokens.VaultAudience == "" {
+		bad("tokens.vault_audience", "must not be empty")
+	}
+	for _, name := range c.Tokens.AccessTokenClaims {
+		if _, ok := userClaimScopes[name]; !ok {
+			bad("tokens.access_token_claims", "%q is not a user claim", name)
+		}
+	}
+
+	if c.Listen.Address == "" {
+		bad("listen.address", "must not be empty")
+	}
+	if c.Listen.TLSAddress != "" && (c.Listen.TLSCert == "" || c.Listen.TLSKey == "") {
+		bad("listen.tls_address", "needs listen.tls_cert and listen.tls_key")
+	}
+	if _, err := parseTrustedProxies(strings.Join(c.Listen.TrustedProxies, ",")); err != nil {
+		bad("listen.trusted_proxies", "%v", err)
+	}
+
+	seen := map[string]bool{}
+	for _, cl := range c.Clients {
+		if seen[cl.ID] {
+			bad("client", "%q is defined more than once", cl.ID)
+		}
+		seen[cl.ID] = true
+		if err := cl.validate(); err != nil {
+			bad("client."+cl.ID, "%v", err)
+		}
+	}
+	if c.PruneClients && len(c.Clients) == 0 {
+		bad("prune_clients", "would delete all clients, as none are configured")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// allowOrigin reports whether a browser may call the API from origin, see Config.CORSOrigins.
+func (c Config) allowOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := u.Hostname()
+	for _, o := range c.CORSOrigins {
+		scheme, pattern := splitOrigin(o)
+		if scheme != "" && scheme != u.Scheme {
+			continue
+		}
+		if host == pattern || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// certEmail returns the identity bound into the certificates of uid, uid@domain.
+func (c Config) certEmail(uid string) string {
+	return uid + "@" + c.Domain
+}
+
+// splitOrigin splits a CORS origin pattern into the optional scheme and the host.
+func splitOrigin(o string) (scheme string, host string) {
+	if i := strings.Index(o, "://"); i >= 0 {
+		return o[:i], o[i+3:]
+	}
+	return "", o
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, dir string, name string, content string) string {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	noEnv := func(string) string { return "" }
+
+	hclPath := writeConfig(t, dir, "idp.hcl", `
+domain = "example.org"
+
+pki {
+  organization = "Example"
+  cert_ttl     = "720h"
+}
+
+listen {
+  trusted_proxies = ["proxy", "10.0.0.0/8"]
+}
+`)
+	c, err := loadConfig(hclPath, noEnv)
+	if err != nil {
+		t.Fatalf("Failed to load HCL config. %v", err)
+	}
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		t.Fatalf("Valid config rejected. %v", err)
+	}
+	want := Config{
+		Domain:        "example.org",
+		CORSOrigins:   []string{"example.org", "*.example.org"},
+		PublicURL:     "http://idp.example.org",
+		Issuer:        "https://hydra.example.org:9000/",
+		HydraAdminURL: "https://localhost:9001",
+		VaultURL:      "https://vault.example.org:8200",
+		PKI: PKIConfig{
+			Organization:     "Example",
+			Country:          "CH",
+			CATTL:            "43800h",
+			CertTTL:          "720h",
+			VaultRedirectURI: "https://vault.example.org:8200/ui/vault/auth/oidc/oidc/callback",
+		},
+		Tokens: TokenConfig{Audience: "fadalax-frontend", VaultAudience: "vault"},
+		Listen: ListenConfig{Address: ":8088", TrustedProxies: []string{"proxy", "10.0.0.0/8"}},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Unexpected config\n%+v\nwant\n%+v", c, want)
+	}
+
+	jsonPath := writeConfig(t, dir, "idp.json", `{"domain": "example.org", "tokens": {"audience": "example-frontend"}}`)
+	env := map[string]string{"IDP_DOMAIN": "example.com", "IDP_CORS_ORIGINS": "https://app.example.com, localhost", "IDP_ISSUER": "https://auth.example.com/"}
+	c, err = loadConfig(jsonPath, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("Failed to load JSON config. %v", err)
+	}
+	c.setDefaults()
+	if c.Domain != "example.com" || c.Tokens.Audience != "example-frontend" || !reflect.DeepEqual(c.CORSOrigins, []string{"https://app.example.com", "localhost"}) ||
+		c.Issuer != "https://auth.example.com/" || c.VaultURL != "https://vault.example.com:8200" {
+		t.Errorf("Environment not applied %+v", c)
+	}
+
+	clientsPath := writeConfig(t, dir, "clients.hcl", `
+prune_clients = true
+
+client "vault" {
+  redirect_uris = ["https://vault.example.org/callback"]
+  scopes        = ["openid"]
+}
+
+client "example-frontend" {
+  name          = "Example"
+  redirect_uris = ["https://example.org/index.html"]
+}
+`)
+	c, err = loadConfig(clientsPath, noEnv)
+	if err != nil {
+		t.Fatalf("Failed to load clients. %v", err)
+	}
+	wantClients := []ClientConfig{
+		{ID: "vault", RedirectURIs: []string{"https://vault.example.org/callback"}, Scopes: []string{"openid"}},
+		{ID: "example-frontend", Name: "Example", RedirectURIs: []string{"https://example.org/index.html"}},
+	}
+	if !c.PruneClients || !reflect.DeepEqual(c.Clients, wantClients) {
+		t.Errorf("Unexpected clients %+v", c.Clients)
+	}
+
+	typo := writeConfig(t, dir, "typo.hcl", "domian = \"example.org\"\npki {\n  ttl = \"1h\"\n}\nclient \"vault\" {\n  scope = [\"openid\"]\n}\n")
+	_, err = loadConfig(typo, noEnv)
+	if err == nil || !strings.Contains(err.Error(), "unknown settings client.vault.scope, domian, pki.ttl") {
+		t.Errorf("Expected unknown settings error, got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	var c Config
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		t.Fatalf("Defaults rejected. %v", err)
+	}
+
+	c.Domain = "Example"
+	c.Issuer = "hydra.example.org"
+	c.PKI.Country = "CHE"
+	c.PKI.CertTTL = "50000h"
+	c.Listen.TLSAddress = ":8443"
+	c.Listen.TrustedProxies = []string{"10.0.0.0/33"}
+	c.Tokens.AccessTokenClaims = []string{"email", "password"}
+	c.Clients = []ClientConfig{{ID: "vault", GrantTypes: []string{"password"}}, {ID: "vault"}}
+	err := c.validate()
+	if err == nil {
+		t.Fatal("Invalid config accepted.")
+	}
+	for _, setting := range []string{"domain:", "issuer:", "pki.country:", "pki.cert_ttl:", "tokens.access_token_claims:", "listen.tls_address:", "listen.trusted_proxies:", "client.vault:", "defined more than once"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("Missing error about %s in %v", setting, err)
+		}
+	}
+}
+
+func TestValidatePruneClients(t *testing.T) {
+	var c Config
+	c.setDefaults()
+	c.PruneClients = true
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "prune_clients:") {
+		t.Errorf("Pruning all clients accepted, got %v", err)
+	}
+}
+
+func TestAllowOrigin(t *testing.T) {
+	c := Config{CORSOrigins: []string{"fadalax.tech", "*.fadalax.tech", "http://localhost"}}
+	for origin, want := range map[string]bool{
+		"https://fadalax.tech":          true,
+		"https://www.fadalax.tech:4200": true,
+		"https://evilfadalax.tech":      false,
+		"https://fadalax.tech.evil.com": false,
+		"http://localhost:4200":         true,
+		"https://localhost":             false,
+		"null":                          false,
+	} {
+		if got := c.allowOrigin(origin); got != want {
+			t.Errorf("allowOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	c := Config{Domain: "example.org"}
+	if e := c.certEmail("a3"); e != "a3@example.org" {
+		t.Errorf("Unexpected certificate email %s", e)
+	}
+	if uid, ok := c.certUID("CN=a3@example.org", ""); !ok || uid != "a3" {
+		t.Errorf("Certificate of a3 not recognized, got %q", uid)
+	}
+	if _, ok := c.certUID("CN=a3@fadalax.tech", ""); ok {
+		t.Error("Certificate of another domain accepted.")
+	}
+}
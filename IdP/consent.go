@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// scopeInfo describes a scope on the consent page. Required scopes are always granted if
+// requested, the user can only deny the whole request.
+type scopeInfo struct {
+	Description string
+	Required    bool
+}
+
+// scopes are the scopes the consent page knows a description for. Other scopes are listed by name
+// and are optional.
+var scopes = map[string]scopeInfo{
+	"openid":         {Description: "Sign you in with your fadalax account.", Required: true},
+	"profile":        {Description: "Read your name."},
+	"email":          {Description: "Read your email address."},
+	"offline":        {Description: "Stay signed in while you are away."},
+	"offline_access": {Description: "Stay signed in while you are away."},
+}
+
+// consentScope is a requested scope as listed on the consent page.
+type consentScope struct {
+	Name string
+	scopeInfo
+}
+
+func consentScopes(requested []string) []consentScope {
+	var l []consentScope
+	for _, name := range requested {
+		info, ok := scopes[name]
+		if !ok {
+			info = scopeInfo{Description: name}
+		}
+		l = append(l, consentScope{Name: name, scopeInfo: info})
+	}
+	return l
+}
+
+// grantedScopes returns the requested scopes the user chose on the consent page, and the required
+// ones. Scopes that were not requested are ignored.
+func grantedScopes(requested []string, chosen []string) []string {
+	isChosen := map[string]bool{}
+	for _, name := range chosen {
+		isChosen[name] = true
+	}
+	granted := []string{}
+	for _, name := range requested {
+		if scopes[name].Required || isChosen[name] {
+			granted = append(granted, name)
+		}
+	}
+	return granted
+}
+
+func (s server) renderConsent(w http.ResponseWriter, info ConsentInfo) {
+	client := info.Client.ClientName
+	if client == "" {
+		client = info.Client.ClientID
+	}
+	err := s.templateConsent.Execute(w, map[string]interface{}{
+		"Client":      client,
+		"LogoURI":     info.Client.LogoURI,
+		"PolicyURI":   info.Client.PolicyURI,
+		"TosURI":      info.Client.TosURI,
+		"Scopes":      consentScopes(info.RequestedScope),
+		"RememberFor": rememberText(s.consentRememberFor),
+	})
+	if err != nil {
+		s.httpInternalError(w, err)
+	}
+}
+
+// rememberText describes how long a remembered consent lasts, zero meaning forever as for Hydra.
+func rememberText(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "until you revoke it"
+	case d%(24*time.Hour) == 0:
+		if days := d / (24 * time.Hour); days > 1 {
+			return fmt.Sprintf("for %d days", days)
+		}
+		return "for a day"
+	default:
+		return "for " + d.String()
+	}
+}
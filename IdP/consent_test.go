@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGrantedScopes(t *testing.T) {
+	requested := []string{"openid", "profile", "offline"}
+	for _, tc := range []struct {
+		chosen []string
+		want   []string
+	}{
+		{nil, []string{"openid"}},
+		{[]string{"offline", "profile"}, []string{"openid", "profile", "offline"}},
+		{[]string{"email", "openid"}, []string{"openid"}},
+	} {
+		if got := grantedScopes(requested, tc.chosen); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("grantedScopes(%v) = %v, want %v", tc.chosen, got, tc.want)
+		}
+	}
+	if got := grantedScopes([]string{"profile"}, nil); got == nil || len(got) != 0 {
+		t.Errorf("Expected no scopes, got %#v", got)
+	}
+}
+
+func TestRememberText(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                   "until you revoke it",
+		24 * time.Hour:      "for a day",
+		30 * 24 * time.Hour: "for 30 days",
+		90 * time.Minute:    "for 1h30m0s",
+	} {
+		if got := rememberText(d); got != want {
+			t.Errorf("rememberText(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
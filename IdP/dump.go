@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parseUsersDump reads the users of a mysqldump such as imovies_users.dump. Only the column list of
+// `CREATE TABLE users` and the `INSERT INTO users` statements are interpreted, everything else is
+// ignored.
+func parseUsersDump(r io.Reader) ([]dbUser, error) {
+	var columns []string
+	var users []dbUser
+	inCreate := false
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024) // extended inserts can produce very long lines
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "CREATE TABLE `users`"):
+			inCreate = true
+			columns = nil
+		case inCreate && strings.HasPrefix(line, ")"):
+			inCreate = false
+		case inCreate && strings.HasPrefix(line, "`"):
+			columns = append(columns, line[1:1+strings.IndexByte(line[1:], '`')])
+		case strings.HasPrefix(line, "INSERT INTO `users` VALUES "):
+			if columns == nil {
+				return nil, fmt.Errorf("INSERT before CREATE TABLE")
+			}
+			rows, err := parseValues(strings.TrimPrefix(line, "INSERT INTO `users` VALUES "))
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range rows {
+				u, err := dbUserFromRow(columns, row)
+				if err != nil {
+					return nil, err
+				}
+				users = append(users, u)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func dbUserFromRow(columns []string, row []string) (dbUser, error) {
+	if len(columns) != len(row) {
+		return dbUser{}, fmt.Errorf("row has %d values, expected %d", len(row), len(columns))
+	}
+	u := dbUser{}
+	for i, c := range columns {
+		switch c {
+		case "uid":
+			u.uid = row[i]
+		case "firstname":
+			u.firstname = row[i]
+		case "lastname":
+			u.lastname = row[i]
+		case "email":
+			u.email = row[i]
+		case "pwd":
+			u.pwd = row[i]
+		}
+	}
+	return u, nil
+}
+
+// parseValues parses the tuples of an extended insert: ('a','b'),('c','d');
+func parseValues(s string) ([][]string, error) {
+	var rows [][]string
+	var row []string
+	var cur strings.Builder
+	inTuple, inString, quoted := false, false, false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inString && c == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(unescapeMySQL(s[i]))
+		case inString && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+			cur.WriteByte('\'')
+		case inString && c == '\'':
+			inString = false
+		case inString:
+			cur.WriteByte(c)
+		case !inTuple && c == '(':
+			inTuple = true
+			row = nil
+			cur.Reset()
+		case !inTuple && (c == ',' || c == ';' || c == ' '):
+		case inTuple && c == '\'':
+			inString, quoted = true, true
+		case inTuple && (c == ',' || c == ')'):
+			v := strings.TrimSpace(cur.String())
+			if !quoted && v == "NULL" {
+				v = ""
+			}
+			row = append(row, v)
+			cur.Reset()
+			quoted = false
+			if c == ')' {
+				rows = append(rows, row)
+				inTuple = false
+			}
+		case inTuple:
+			cur.WriteByte(c)
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+		}
+	}
+	if inTuple || inString {
+		return nil, fmt.Errorf("unterminated values")
+	}
+	return rows, nil
+}
+
+func unescapeMySQL(c byte) byte {
+	switch c {
+	case '0':
+		return 0
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'Z':
+		return 0x1a
+	default:
+		return c
+	}
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// testIdP is the IdP wired to fakes of all services it talks to.
+type testIdP struct {
+	hydra  *fakeHydra
+	issuer *fakeIssuer
+	vault  *fakeVault
+	db     storageClient
+	router *mux.Router
+	// consentRememberFor is how long the IdP asks Hydra to remember consents.
+	consentRememberFor time.Duration
+}
+
+// newTestIdP returns the IdP and a function to shut the fakes down. Certificate headers are trusted
+// from 192.0.2.1, the remote address of httptest.NewRequest.
+func newTestIdP(t *testing.T) (*testIdP, func()) {
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, err := NewStorage("memory://?seed="+usersDump, hasher)
+	if err != nil {
+		t.Fatalf("Failed to create storage. %v", err)
+	}
+	idp := &testIdP{hydra: newFakeHydra(), issuer: newFakeIssuer(), vault: newFakeVault(t), db: db}
+	closeAll := func() {
+		idp.hydra.Close()
+		idp.issuer.Close()
+	}
+
+	cfg := testConfig()
+	auth, err := NewValidator(idp.issuer.URL, cfg.Tokens.Audience, "roles")
+	if err != nil {
+		closeAll()
+		t.Fatalf("Failed to create validator. %v", err)
+	}
+	proxies, _ := parseTrustedProxies("192.0.2.1")
+	s := server{
+		hydra:    idp.hydra.client(),
+		db:       db,
+		vault:    idp.vault,
+		auth:     auth,
+		stateKey: []byte("test state key"),
+		// Failed logins must not delay the following test cases.
+		throttle: newLoginThrottle(5, time.Minute, time.Nanosecond),
+		proxies:  proxies,
+		cfg:      cfg,
+		// As NewValidator above.
+		roleClaim:   "roles",
+		caAdminRole: "ca-admin",
+		vaultForUser: func(uid string, authHeader string) (certVault, error) {
+			return idp.vault, nil
+		},
+		consentRememberFor: 30 * 24 * time.Hour,
+	}
+	if err := s.parseTemplates("./template"); err != nil {
+		closeAll()
+		t.Fatalf("Failed to parse templates. %v", err)
+	}
+	idp.consentRememberFor = s.consentRememberFor
+	idp.router = mux.NewRouter()
+	s.router = idp.router
+	s.routes(idp.router)
+	return idp, closeAll
+}
+
+// flowTest is a request to the IdP and what is expected of the response.
+type flowTest struct {
+	name   string
+	method string
+	target string
+	body   string
+	header map[string]string
+	remote string
+	status int
+	check  func(t *testing.T, w *httptest.ResponseRecorder)
+}
+
+func (idp *testIdP) run(t *testing.T, tests []flowTest) {
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if strings.Contains(tc.body, "=") && !strings.HasPrefix(tc.body, "{") {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+			if tc.remote != "" {
+				r.RemoteAddr = tc.remote
+			}
+			w := httptest.NewRecorder()
+			idp.router.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if tc.check != nil {
+				tc.check(t, w)
+			}
+		})
+	}
+}
+
+// bodyContains checks that the response contains s.
+func bodyContains(s string) func(*testing.T, *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("Response does not contain %q:\n%s", s, w.Body.String())
+		}
+	}
+}
+
+// loginAccepted checks that the login request with challenge was accepted for subject.
+func (idp *testIdP) loginAccepted(challenge string, subject string, amr ...string) func(*testing.T, *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		if loc := w.Header().Get("Location"); !strings.HasSuffix(loc, "login_challenge="+challenge) {
+			t.Errorf("Unexpected redirect to %q", loc)
+		}
+		req, ok := idp.hydra.acceptedLogins[challenge]
+		if !ok {
+			t.Fatal("Login not accepted.")
+		}
+		if req.Subject != subject || !reflect.DeepEqual(req.AMR, amr) {
+			t.Errorf("Unexpected accepted login %+v", req)
+		}
+	}
+}
+
+// loginRejected checks that the login request with challenge was rejected with the OAuth 2.0 error
+// code.
+func (idp *testIdP) loginRejected(challenge string, code string) func(*testing.T, *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		if loc := w.Header().Get("Location"); !strings.HasSuffix(loc, "login_challenge="+challenge) {
+			t.Errorf("Unexpected redirect to %q", loc)
+		}
+		if req, ok := idp.hydra.rejectedLogins[challenge]; !ok || req.Error != code {
+			t.Errorf("Login not rejected with %s: %+v", code, req)
+		}
+		if _, ok := idp.hydra.acceptedLogins[challenge]; ok {
+			t.Error("Login accepted.")
+		}
+	}
+}
+
+func (idp *testIdP) loginNotAccepted(challenge string) func(*testing.T, *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		if _, ok := idp.hydra.acceptedLogins[challenge]; ok {
+			t.Error("Login accepted.")
+		}
+	}
+}
+
+func TestLoginFlow(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	ctx := context.Background()
+	valid, err := idp.vault.IssueCert(ctx, "a3")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate. %v", err)
+	}
+	revoked, _ := idp.vault.IssueCert(ctx, "a3")
+	idp.vault.RevokeCert(ctx, "a3", revoked.Serial)
+	disabled, _ := idp.vault.IssueCert(ctx, "lb")
+	for _, uid := range []string{"a3", "lb", "ps"} {
+		idp.db.ChangePassword(ctx, uid, "secret "+uid)
+	}
+	idp.db.SetUserDisabled(ctx, "lb", true)
+	for _, c := range []string{"cert", "cert-untrusted", "cert-revoked", "cert-other", "cert-disabled", "page", "pw", "pw-wrong", "disabled", "new-pki", "cancel", "totp-expired"} {
+		idp.hydra.logins[c] = LoginInfo{}
+	}
+	idp.hydra.logins["skip"] = LoginInfo{Skip: true, Subject: "a3"}
+	certHeaders := func(dn string, serial string) map[string]string {
+		return map[string]string{fadalaxAuthHeader: dn, fadalaxCertSerialHeader: serial}
+	}
+
+	idp.run(t, []flowTest{
+		{name: "no challenge", method: http.MethodGet, target: "/login", status: http.StatusBadRequest},
+		{name: "hydra fails", method: http.MethodGet, target: "/login?login_challenge=broken", status: http.StatusInternalServerError},
+		{name: "expired", method: http.MethodGet, target: "/login?login_challenge=expired", status: http.StatusGone,
+			check: bodyContains("log in again")},
+		{name: "login page", method: http.MethodGet, target: "/login?login_challenge=page", status: http.StatusOK,
+			check: bodyContains(`name="password"`)},
+		{name: "certificate", method: http.MethodGet, target: "/login?login_challenge=cert",
+			header: certHeaders("C=CH,O=imovies,CN=a3@fadalax.tech", valid.Serial), status: http.StatusFound,
+			check: idp.loginAccepted("cert", "a3", amrCertificate)},
+		{name: "certificate from untrusted source", method: http.MethodGet, target: "/login?login_challenge=cert-untrusted",
+			header: certHeaders("CN=a3@fadalax.tech", valid.Serial), remote: "198.51.100.7:4711", status: http.StatusOK,
+			check: idp.loginNotAccepted("cert-untrusted")},
+		{name: "revoked certificate", method: http.MethodGet, target: "/login?login_challenge=cert-revoked",
+			header: certHeaders("CN=a3@fadalax.tech", revoked.Serial), status: http.StatusOK,
+			check: idp.loginNotAccepted("cert-revoked")},
+		{name: "certificate of other domain", method: http.MethodGet, target: "/login?login_challenge=cert-other",
+			header: certHeaders("CN=a3@example.com", valid.Serial), status: http.StatusOK,
+			check: idp.loginNotAccepted("cert-other")},
+		{name: "skip", method: http.MethodGet, target: "/login?login_challenge=skip", status: http.StatusFound,
+			check: idp.loginAccepted("skip", "a3")},
+		{name: "wrong password", method: http.MethodPost, target: "/login?login_challenge=pw-wrong",
+			body: "username=a3&password=wrong", status: http.StatusOK,
+			check: bodyContains(loginErrInvalid)},
+		{name: "password", method: http.MethodPost, target: "/login?login_challenge=pw",
+			body: "username=a3&password=secret+a3", status: http.StatusFound,
+			check: idp.loginAccepted("pw", "a3", amrPassword)},
+		{name: "already handled", method: http.MethodPost, target: "/login?login_challenge=pw",
+			body: "username=a3&password=secret+a3", status: http.StatusGone,
+			check: bodyContains("log in again")},
+		{name: "disabled user", method: http.MethodPost, target: "/login?login_challenge=disabled",
+			body: "username=lb&password=secret+lb", status: http.StatusOK,
+			check: idp.loginNotAccepted("disabled")},
+		{name: "certificate of disabled user", method: http.MethodGet, target: "/login?login_challenge=cert-disabled",
+			header: certHeaders("CN=lb@fadalax.tech", disabled.Serial), status: http.StatusFound,
+			check: idp.loginRejected("cert-disabled", oauthAccessDenied)},
+		{name: "cancel", method: http.MethodPost, target: "/login?login_challenge=cancel",
+			body: "username=&password=&action=cancel", status: http.StatusFound,
+			check: idp.loginRejected("cancel", oauthAccessDenied)},
+		{name: "invalid second factor state", method: http.MethodPost, target: "/login?login_challenge=totp-expired",
+			body: "step=totp&state=expired&code=123456", status: http.StatusFound,
+			check: idp.loginRejected("totp-expired", oauthLoginRequired)},
+		{name: "creates PKI", method: http.MethodPost, target: "/login?login_challenge=new-pki",
+			body: "username=ps&password=secret+ps", status: http.StatusFound,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if _, ok := idp.vault.certs["ps"]; !ok {
+					t.Error("No PKI created for ps.")
+				}
+			}},
+	})
+}
+
+func TestLoginResetsFailures(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	idp.db.ChangePassword(context.Background(), "ps", "secret ps")
+	for _, c := range []string{"wrong", "first", "second"} {
+		idp.hydra.logins[c] = LoginInfo{}
+	}
+	wrong := flowTest{method: http.MethodPost, target: "/login?login_challenge=wrong",
+		body: "username=ps&password=wrong", status: http.StatusOK, check: bodyContains(loginErrInvalid)}
+	tests := []flowTest{}
+	for i := 0; i < 4; i++ {
+		wrong.name = fmt.Sprintf("wrong password %d", i+1)
+		tests = append(tests, wrong)
+	}
+	wrong.name = "wrong password after login"
+	tests = append(tests,
+		flowTest{name: "password", method: http.MethodPost, target: "/login?login_challenge=first",
+			body: "username=ps&password=secret+ps", status: http.StatusFound, check: idp.loginAccepted("first", "ps", amrPassword)},
+		wrong,
+		flowTest{name: "not locked", method: http.MethodPost, target: "/login?login_challenge=second",
+			body: "username=ps&password=secret+ps", status: http.StatusFound, check: idp.loginAccepted("second", "ps", amrPassword)},
+	)
+	idp.run(t, tests)
+}
+
+func TestConsentFlow(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	info := ConsentInfo{
+		Subject:           "a3",
+		RequestedScope:    []string{"openid", "profile", "offline"},
+		RequestedAudience: []string{"fadalax-frontend"},
+		Client:            OAuth2Client{ClientID: "frontend", ClientName: "iMovies CA", PolicyURI: "https://fadalax.tech/privacy"},
+	}
+	for _, c := range []string{"page", "post", "remember", "deny"} {
+		idp.hydra.consents[c] = info
+	}
+	info.Skip = true
+	idp.hydra.consents["skip"] = info
+	remember := int(idp.consentRememberFor / time.Second)
+	accepted := func(challenge string, scope []string, rememberFor int) func(*testing.T, *httptest.ResponseRecorder) {
+		return func(t *testing.T, w *httptest.ResponseRecorder) {
+			req, ok := idp.hydra.acceptedConsents[challenge]
+			if !ok {
+				t.Fatal("Consent not accepted.")
+			}
+			if !reflect.DeepEqual(req.GrantScope, scope) || !reflect.DeepEqual(req.GrantAccessTokenAudience, info.RequestedAudience) ||
+				req.Remember != (rememberFor > 0) || req.RememberFor != rememberFor {
+				t.Errorf("Unexpected accepted consent %+v", req)
+			}
+		}
+	}
+
+	idp.run(t, []flowTest{
+		{name: "no challenge", method: http.MethodGet, target: "/consent", status: http.StatusBadRequest},
+		{name: "hydra fails", method: http.MethodGet, target: "/consent?consent_challenge=broken", status: http.StatusInternalServerError},
+		{name: "expired", method: http.MethodGet, target: "/consent?consent_challenge=expired", status: http.StatusGone},
+		{name: "consent page", method: http.MethodGet, target: "/consent?consent_challenge=page", status: http.StatusOK,
+			check: bodyContains(`<form method="post">`)},
+		{name: "client", method: http.MethodGet, target: "/consent?consent_challenge=page", status: http.StatusOK,
+			check: bodyContains(`<strong>iMovies CA</strong>`)},
+		{name: "policy", method: http.MethodGet, target: "/consent?consent_challenge=page", status: http.StatusOK,
+			check: bodyContains(`href="https://fadalax.tech/privacy"`)},
+		{name: "optional scope", method: http.MethodGet, target: "/consent?consent_challenge=page", status: http.StatusOK,
+			check: bodyContains(`name="scope" value="profile" checked`)},
+		{name: "remember duration", method: http.MethodGet, target: "/consent?consent_challenge=page", status: http.StatusOK,
+			check: bodyContains("Remember this decision for 30 days")},
+		{name: "skip", method: http.MethodGet, target: "/consent?consent_challenge=skip", status: http.StatusFound,
+			check: accepted("skip", info.RequestedScope, 0)},
+		{name: "deny button", method: http.MethodGet, target: "/consent?consent_challenge=page", status: http.StatusOK,
+			check: bodyContains(`value="deny"`)},
+		{name: "no action", method: http.MethodPost, target: "/consent?consent_challenge=post", status: http.StatusBadRequest},
+		{name: "consent", method: http.MethodPost, target: "/consent?consent_challenge=post", body: "action=accept&scope=profile&scope=admin", status: http.StatusFound,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				accepted("post", []string{"openid", "profile"}, 0)(t, w)
+				u, _ := idp.db.GetUser(context.Background(), "a3")
+				id := idp.hydra.acceptedConsents["post"].Session.IDToken
+				if id["family_name"] != u.LastName || id["given_name"] != u.FirstName || id["email"] != nil {
+					t.Errorf("Unexpected ID token claims %v", id)
+				}
+			}},
+		{name: "remember", method: http.MethodPost, target: "/consent?consent_challenge=remember", body: "action=accept&remember=1", status: http.StatusFound,
+			check: accepted("remember", []string{"openid"}, remember)},
+		{name: "already handled", method: http.MethodPost, target: "/consent?consent_challenge=post", body: "action=accept", status: http.StatusGone},
+		{name: "deny", method: http.MethodPost, target: "/consent?consent_challenge=deny", body: "action=deny", status: http.StatusFound,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if req, ok := idp.hydra.rejectedConsents["deny"]; !ok || req.Error != oauthAccessDenied {
+					t.Errorf("Consent not rejected with access_denied: %+v", req)
+				}
+				if _, ok := idp.hydra.acceptedConsents["deny"]; ok {
+					t.Error("Consent accepted.")
+				}
+			}},
+	})
+}
+
+// TestAdminRoleClaim follows the admin role from the user record through the consent into a token
+// accepted by the CA admin API.
+func TestAdminRoleClaim(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	admin := User{UserID: "ad", FirstName: "Ada", LastName: "Admin", Email: "ada@imovies.ch", Admin: true}
+	if err := idp.db.CreateUser(context.Background(), admin, "secret ad"); err != nil {
+		t.Fatalf("Failed to create admin. %v", err)
+	}
+	for _, uid := range []string{"ad", "a3"} {
+		idp.hydra.consents[uid] = ConsentInfo{Subject: uid, Skip: true, RequestedScope: []string{"openid"},
+			RequestedAudience: []string{"fadalax-frontend"}, Client: OAuth2Client{ClientID: "fadalax-frontend"}}
+	}
+	token := func(uid string) map[string]string {
+		return map[string]string{authorization: idp.issuer.token(t, uid, "fadalax-frontend", idp.hydra.acceptedConsents[uid].Session.AccessToken)}
+	}
+
+	idp.run(t, []flowTest{
+		{name: "consent of admin", method: http.MethodGet, target: "/consent?consent_challenge=ad", status: http.StatusFound},
+		{name: "consent of user", method: http.MethodGet, target: "/consent?consent_challenge=a3", status: http.StatusFound},
+	})
+	idp.run(t, []flowTest{
+		{name: "admin", method: http.MethodGet, target: "/admin/ca", header: token("ad"), status: http.StatusOK},
+		{name: "user", method: http.MethodGet, target: "/admin/ca", header: token("a3"), status: http.StatusForbidden},
+	})
+}
+
+func TestLogoutFlow(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	for _, c := range []string{"page", "logout", "everywhere", "stay"} {
+		idp.hydra.logouts[c] = LogoutInfo{Subject: "a3", SessionID: "sid-" + c, RPInitiated: true}
+	}
+	loggedOut := func(challenge string, everywhere bool) func(*testing.T, *httptest.ResponseRecorder) {
+		return func(t *testing.T, w *httptest.ResponseRecorder) {
+			if loc := w.Header().Get("Location"); !strings.HasSuffix(loc, "logout_challenge="+challenge) {
+				t.Errorf("Unexpected redirect to %q", loc)
+			}
+			if !idp.hydra.acceptedLogouts[challenge] {
+				t.Error("Logout not accepted.")
+			}
+			revoked := len(idp.hydra.revokedLogins) > 0 && len(idp.hydra.revokedConsents) > 0
+			if revoked != everywhere {
+				t.Errorf("Unexpected revocations, logins %v, consents %v", idp.hydra.revokedLogins, idp.hydra.revokedConsents)
+			}
+		}
+	}
+
+	idp.run(t, []flowTest{
+		{name: "no challenge", method: http.MethodGet, target: "/logout", status: http.StatusBadRequest},
+		{name: "expired", method: http.MethodGet, target: "/logout?logout_challenge=expired", status: http.StatusGone,
+			check: bodyContains("log out again")},
+		{name: "confirmation page", method: http.MethodGet, target: "/logout?logout_challenge=page", status: http.StatusOK,
+			check: bodyContains(`name="everywhere"`)},
+		{name: "no action", method: http.MethodPost, target: "/logout?logout_challenge=logout", status: http.StatusBadRequest},
+		{name: "logout", method: http.MethodPost, target: "/logout?logout_challenge=logout", body: "action=accept", status: http.StatusFound,
+			check: loggedOut("logout", false)},
+		{name: "already handled", method: http.MethodPost, target: "/logout?logout_challenge=logout", body: "action=accept", status: http.StatusGone},
+		{name: "stay logged in", method: http.MethodPost, target: "/logout?logout_challenge=stay", body: "action=deny", status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				bodyContains(logoutMsgStay)(t, w)
+				if !idp.hydra.rejectedLogouts["stay"] || idp.hydra.acceptedLogouts["stay"] {
+					t.Error("Logout not rejected.")
+				}
+			}},
+		{name: "everywhere", method: http.MethodPost, target: "/logout?logout_challenge=everywhere", body: "action=accept&everywhere=1", status: http.StatusFound,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				loggedOut("everywhere", true)(t, w)
+				if !reflect.DeepEqual(idp.hydra.revokedLogins, []string{"a3"}) || !reflect.DeepEqual(idp.hydra.revokedConsents, []string{"a3"}) {
+					t.Errorf("Unexpected revocations, logins %v, consents %v", idp.hydra.revokedLogins, idp.hydra.revokedConsents)
+				}
+			}},
+	})
+}
+
+func TestSessionAPI(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	bearer := map[string]string{authorization: idp.issuer.token(t, "a3", "fadalax-frontend", nil)}
+	t0 := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	session := func(client string, sid string, at time.Time, rememberFor int) PreviousConsentSession {
+		return PreviousConsentSession{
+			ConsentRequest: ConsentInfo{Subject: "a3", Client: OAuth2Client{ClientID: client, ClientName: strings.ToUpper(client)}, LoginSessionID: sid},
+			GrantScope:     []string{"openid"},
+			Remember:       true,
+			RememberFor:    rememberFor,
+			HandledAt:      at,
+		}
+	}
+	idp.hydra.consentSessions["a3"] = []PreviousConsentSession{
+		session("frontend", "s1", t0, 0),
+		session("vault", "s1", t0.Add(time.Hour), 3600),
+		session("frontend", "s2", t0.Add(2*time.Hour), 0),
+	}
+	decode := func(v interface{}) func(*testing.T, *httptest.ResponseRecorder) {
+		return func(t *testing.T, w *httptest.ResponseRecorder) {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("Failed to decode %s. %v", w.Body.String(), err)
+			}
+		}
+	}
+	var consents []appConsent
+	var sessions []userSession
+
+	idp.run(t, []flowTest{
+		{name: "no token", method: http.MethodGet, target: "/user/consents", status: http.StatusForbidden},
+		{name: "consents", method: http.MethodGet, target: "/user/consents", header: bearer, status: http.StatusOK, check: decode(&consents)},
+		{name: "sessions", method: http.MethodGet, target: "/user/sessions", header: bearer, status: http.StatusOK, check: decode(&sessions)},
+		{name: "revoke client", method: http.MethodDelete, target: "/user/consents/vault", header: bearer, status: http.StatusOK},
+		{name: "revoke all", method: http.MethodDelete, target: "/user/consents", header: bearer, status: http.StatusOK},
+		{name: "sign out everywhere", method: http.MethodDelete, target: "/user/sessions", header: bearer, status: http.StatusOK},
+	})
+
+	expires := t0.Add(2 * time.Hour)
+	wantConsents := []appConsent{
+		{ClientID: "frontend", ClientName: "FRONTEND", Scopes: []string{"openid"}, GrantedAt: t0.Add(2 * time.Hour)},
+		{ClientID: "vault", ClientName: "VAULT", Scopes: []string{"openid"}, GrantedAt: t0.Add(time.Hour), ExpiresAt: &expires},
+	}
+	if !reflect.DeepEqual(consents, wantConsents) {
+		t.Errorf("Unexpected consents %+v", consents)
+	}
+	wantSessions := []userSession{
+		{ID: "s2", Clients: []string{"frontend"}, LastActive: t0.Add(2 * time.Hour)},
+		{ID: "s1", Clients: []string{"frontend", "vault"}, LastActive: t0.Add(time.Hour)},
+	}
+	if !reflect.DeepEqual(sessions, wantSessions) {
+		t.Errorf("Unexpected sessions %+v", sessions)
+	}
+	if !reflect.DeepEqual(idp.hydra.revokedConsents, []string{"a3/vault", "a3"}) || !reflect.DeepEqual(idp.hydra.revokedLogins, []string{"a3"}) {
+		t.Errorf("Unexpected revocations, consents %v, logins %v", idp.hydra.revokedConsents, idp.hydra.revokedLogins)
+	}
+}
+
+func TestClientAPI(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	admin := map[string]string{authorization: idp.issuer.token(t, caAdminUID, "fadalax-frontend", nil)}
+	idp.hydra.clients["fadalax-frontend"] = OAuth2Client{ClientID: "fadalax-frontend", ClientSecret: "frontend"}
+	var rotated ClientConfig
+
+	idp.run(t, []flowTest{
+		{name: "not an admin", method: http.MethodGet, target: "/admin/clients",
+			header: map[string]string{authorization: idp.issuer.token(t, "a3", "fadalax-frontend", nil)}, status: http.StatusForbidden},
+		{name: "invalid", method: http.MethodPost, target: "/admin/clients", header: admin, status: http.StatusBadRequest,
+			body: `{"clientId": "vault", "grantTypes": ["password"]}`},
+		{name: "create", method: http.MethodPost, target: "/admin/clients", header: admin, status: http.StatusCreated,
+			body: `{"clientId": "vault", "redirectUris": ["https://vault.fadalax.tech/callback"], "scopes": ["openid", "offline"]}`,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var c ClientConfig
+				if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || c.ID != "vault" || c.Secret != "generated-vault" {
+					t.Errorf("Unexpected client %+v %v", c, err)
+				}
+			}},
+		{name: "exists", method: http.MethodPost, target: "/admin/clients", header: admin, status: http.StatusConflict,
+			body: `{"clientId": "vault", "redirectUris": ["https://vault.fadalax.tech/callback"]}`},
+		{name: "list", method: http.MethodGet, target: "/admin/clients", header: admin, status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var l []ClientConfig
+				if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil || len(l) != 2 || l[0].ID != "fadalax-frontend" || l[1].Secret != "" {
+					t.Errorf("Unexpected clients %+v %v", l, err)
+				}
+			}},
+		{name: "update", method: http.MethodPut, target: "/admin/clients/vault", header: admin, status: http.StatusOK,
+			body: `{"redirectUris": ["https://vault.fadalax.tech/callback"], "scopes": ["openid"], "audience": ["vault"]}`},
+		{name: "update other id", method: http.MethodPut, target: "/admin/clients/vault", header: admin, status: http.StatusBadRequest,
+			body: `{"clientId": "other"}`},
+		{name: "update unknown", method: http.MethodPut, target: "/admin/clients/nope", header: admin, status: http.StatusNotFound,
+			body: `{"scopes": ["openid"]}`},
+		{name: "get", method: http.MethodGet, target: "/admin/clients/vault", header: admin, status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var c ClientConfig
+				if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || !reflect.DeepEqual(c.Scopes, []string{"openid"}) || !reflect.DeepEqual(c.Audience, []string{"vault"}) {
+					t.Errorf("Unexpected client %+v %v", c, err)
+				}
+			}},
+		{name: "rotate secret", method: http.MethodPost, target: "/admin/clients/vault/secret", header: admin, status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if err := json.Unmarshal(w.Body.Bytes(), &rotated); err != nil {
+					t.Errorf("Failed to decode %s. %v", w.Body.String(), err)
+				}
+			}},
+		{name: "delete frontend", method: http.MethodDelete, target: "/admin/clients/fadalax-frontend", header: admin, status: http.StatusBadRequest},
+		{name: "delete", method: http.MethodDelete, target: "/admin/clients/vault", header: admin, status: http.StatusOK},
+		{name: "deleted", method: http.MethodGet, target: "/admin/clients/vault", header: admin, status: http.StatusNotFound},
+	})
+
+	if len(rotated.Secret) < 40 || rotated.Secret == "generated-vault" {
+		t.Errorf("Secret not rotated %+v", rotated)
+	}
+}
+
+func TestUserAPI(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token := idp.issuer.token(t, "a3", "fadalax-frontend", nil)
+	bearer := func(tok string) map[string]string { return map[string]string{authorization: tok} }
+
+	idp.run(t, []flowTest{
+		{name: "no token", method: http.MethodGet, target: "/user", status: http.StatusForbidden},
+		{name: "malformed", method: http.MethodGet, target: "/user", header: bearer("Basic YTM6QXN0cmlk"), status: http.StatusForbidden},
+		{name: "other audience", method: http.MethodGet, target: "/user",
+			header: bearer(idp.issuer.token(t, "a3", "vault", nil)), status: http.StatusForbidden},
+		{name: "expired", method: http.MethodGet, target: "/user",
+			header: bearer(idp.issuer.sign(t, idp.issuer.key, "a3", "fadalax-frontend", time.Now().Add(-time.Minute), nil)), status: http.StatusForbidden},
+		{name: "other key", method: http.MethodGet, target: "/user",
+			header: bearer(idp.issuer.sign(t, otherKey, "a3", "fadalax-frontend", time.Now().Add(time.Hour), nil)), status: http.StatusForbidden},
+		{name: "unknown user", method: http.MethodGet, target: "/user",
+			header: bearer(idp.issuer.token(t, "nobody", "fadalax-frontend", nil)), status: http.StatusForbidden},
+		{name: "user", method: http.MethodGet, target: "/user", header: bearer(token), status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var u User
+				if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil || u.UserID != "a3" || u.LastName != "Anderson" {
+					t.Errorf("Unexpected user %+v %v", u, err)
+				}
+			}},
+	})
+}
+
+func TestDisableUser(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	user := map[string]string{authorization: idp.issuer.token(t, "a3", "fadalax-frontend", nil)}
+	admin := map[string]string{authorization: idp.issuer.token(t, caAdminUID, "fadalax-frontend", nil)}
+
+	idp.run(t, []flowTest{
+		{name: "enabled", method: http.MethodGet, target: "/user", header: user, status: http.StatusOK},
+		{name: "disable", method: http.MethodPost, target: "/admin/users/a3/disable", header: admin, status: http.StatusOK},
+		{name: "disabled certs", method: http.MethodGet, target: "/certs", header: user, status: http.StatusForbidden},
+		{name: "disabled get user", method: http.MethodGet, target: "/user", header: user, status: http.StatusForbidden},
+		{name: "disabled edit user", method: http.MethodPut, target: "/user", header: user,
+			body: `{"uid": "a3", "firstName": "Mallory", "lastName": "Mallory", "email": "mallory@evil.com"}`, status: http.StatusForbidden},
+		{name: "disabled revoke cert", method: http.MethodDelete, target: "/cert", header: user, status: http.StatusForbidden},
+		{name: "enable", method: http.MethodPost, target: "/admin/users/a3/enable", header: admin, status: http.StatusOK},
+		{name: "enabled again", method: http.MethodGet, target: "/user", header: user, status: http.StatusOK},
+	})
+
+	if u, _ := idp.db.GetUser(context.Background(), "a3"); u.FirstName == "Mallory" || u.PendingEmail != "" {
+		t.Errorf("Disabled user edited the profile %+v", u)
+	}
+	if !reflect.DeepEqual(idp.hydra.revokedConsents, []string{"a3"}) || !reflect.DeepEqual(idp.hydra.revokedLogins, []string{"a3"}) {
+		t.Errorf("Unexpected revocations, consents %v, logins %v", idp.hydra.revokedConsents, idp.hydra.revokedLogins)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	idp.vault.CreatePKIUser("a3")
+	user := map[string]string{authorization: idp.issuer.token(t, "a3", "fadalax-frontend", nil)}
+	admin := map[string]string{authorization: idp.issuer.token(t, caAdminUID, "fadalax-frontend", nil)}
+	create := func(uid string) string {
+		return fmt.Sprintf(`{"uid": %q, "firstName": "New", "lastName": "User", "email": "new@imovies.ch"}`, uid)
+	}
+
+	idp.run(t, []flowTest{
+		{name: "delete", method: http.MethodDelete, target: "/admin/users/a3", header: admin, status: http.StatusOK},
+		{name: "token of deleted user", method: http.MethodGet, target: "/certs", header: user, status: http.StatusForbidden},
+		{name: "recovery of deleted user", method: http.MethodGet, target: "/recovery", header: user, status: http.StatusForbidden},
+		{name: "reuse uid with PKI", method: http.MethodPost, target: "/admin/users", header: admin, body: create("a3"), status: http.StatusConflict},
+		{name: "create", method: http.MethodPost, target: "/admin/users", header: admin, body: create("n3"), status: http.StatusCreated},
+	})
+
+	if !reflect.DeepEqual(idp.hydra.revokedConsents, []string{"a3"}) || !reflect.DeepEqual(idp.hydra.revokedLogins, []string{"a3"}) {
+		t.Errorf("Unexpected revocations, consents %v, logins %v", idp.hydra.revokedConsents, idp.hydra.revokedLogins)
+	}
+}
+
+func TestDisableTOTPThrottled(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	secret, _ := generateTOTPSecret()
+	idp.db.SetTOTP(context.Background(), "a3", TOTPConfig{Secret: secret, Enabled: true})
+	key, _ := totpEncoding.DecodeString(secret)
+	bearer := map[string]string{authorization: idp.issuer.token(t, "a3", "fadalax-frontend", nil)}
+
+	var tests []flowTest
+	for i := 0; i < 5; i++ {
+		tests = append(tests, flowTest{name: fmt.Sprintf("wrong code %d", i+1), method: http.MethodDelete, target: "/user/totp",
+			header: bearer, body: `{"code": "000000"}`, status: http.StatusBadRequest})
+	}
+	tests = append(tests, flowTest{name: "valid code when locked", method: http.MethodDelete, target: "/user/totp",
+		header: bearer, body: fmt.Sprintf(`{"code": %q}`, hotp(key, uint64(totpStep(time.Now())))), status: http.StatusTooManyRequests})
+	idp.run(t, tests)
+
+	if tc, _ := idp.db.GetTOTP(context.Background(), "a3"); !tc.Enabled {
+		t.Error("TOTP disabled while locked.")
+	}
+}
+
+func TestCertAPI(t *testing.T) {
+	idp, closeAll := newTestIdP(t)
+	defer closeAll()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	csr := func(cn string) string {
+		der := newCSR(t, key, x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}})
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	}
+	a3 := map[string]string{authorization: idp.issuer.token(t, "a3", "fadalax-frontend", nil)}
+
+	idp.run(t, []flowTest{
+		{name: "sign without token", method: http.MethodPost, target: "/cert", body: csr(testConfig().certEmail("a3")), status: http.StatusForbidden},
+		{name: "sign for other user", method: http.MethodPost, target: "/cert", body: csr(testConfig().certEmail("ps")), header: a3, status: http.StatusBadRequest},
+		{name: "sign garbage", method: http.MethodPost, target: "/cert", body: "garbage", header: a3, status: http.StatusBadRequest},
+		{name: "sign", method: http.MethodPost, target: "/cert", body: csr(testConfig().certEmail("a3")), header: a3, status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				b, rest := pem.Decode(w.Body.Bytes())
+				if b == nil || b.Type != "CERTIFICATE" || !strings.Contains(string(rest), "CERTIFICATE") {
+					t.Fatalf("Expected certificate and chain, got %s", w.Body.String())
+				}
+				c, _ := x509.ParseCertificate(b.Bytes)
+				if c.Subject.CommonName != testConfig().certEmail("a3") || len(idp.vault.certs["a3"]) != 1 {
+					t.Errorf("Unexpected certificate %v", c.Subject)
+				}
+			}},
+		{name: "pkcs12 without password", method: http.MethodPost, target: "/cert/pkcs12", body: `{}`, header: a3, status: http.StatusBadRequest},
+		{name: "pkcs12", method: http.MethodPost, target: "/cert/pkcs12", body: `{"password": "export", "profile": "` + pkcs12Legacy + `"}`,
+			header: a3, status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				blocks, err := pkcs12.ToPEM(w.Body.Bytes(), "export")
+				if err != nil || len(blocks) != 3 {
+					t.Fatalf("Unexpected PKCS#12 bundle. %v", err)
+				}
+				for _, b := range blocks {
+					if c, err := x509.ParseCertificate(b.Bytes); err == nil && c.Subject.CommonName == testConfig().certEmail("a3") {
+						return
+					}
+				}
+				t.Error("No certificate of a3 in PKCS#12 bundle.")
+			}},
+		{name: "revoke all", method: http.MethodDelete, target: "/cert", header: a3, status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				for _, c := range idp.vault.certs["a3"] {
+					if c.RevokedAt.IsZero() {
+						t.Errorf("Certificate %s not revoked.", c.Serial)
+					}
+				}
+			}},
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	emailTokenTTL = 24 * time.Hour
+
+	emailMsgInvalid   = "This link is invalid or has expired. Please change your email address again to get a new one."
+	emailMsgConfirmed = "Your email address has been changed."
+)
+
+// startEmailChange stores email as pending address of u and mails a verification link to it. A
+// previous pending change is replaced.
+func (s server) startEmailChange(ctx context.Context, u User, email string) error {
+	token, hash, err := generateToken()
+	if err != nil {
+		return err
+	}
+	err = s.db.SetPendingEmail(ctx, u.UserID, email, hash, time.Now().Add(emailTokenTTL))
+	if err != nil {
+		return err
+	}
+	link := s.publicURL + "/email/confirm?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hello %s\n\n"+
+		"Please confirm that this is the new email address of your account %s by opening\n\n"+
+		"%s\n\n"+
+		"The link is valid for %v. Until then, your old address stays in use. If you did not ask for this, you can ignore this mail.\n",
+		u.FirstName, u.UserID, link, emailTokenTTL)
+	err = s.mailer.Send(email, "Confirm your new email address", body)
+	if err != nil {
+		return fmt.Errorf("failed to send verification mail: %v", err)
+	}
+	log.WithFields(log.Fields{"uid": u.UserID, "email": email}).Info("Sent email verification mail.")
+	return nil
+}
+
+// ConfirmEmail commits a pending email change. It is opened from the link in the verification mail.
+func (s server) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.db.ConfirmEmail(r.Context(), hashToken(r.URL.Query().Get("token")), time.Now())
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).Error("Failed to confirm email.")
+		}
+		s.renderMessage(w, emailMsgInvalid)
+		return
+	}
+	log.WithField("uid", uid).Info("Confirmed email change.")
+	s.renderMessage(w, emailMsgConfirmed)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestEmailChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idp-email")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir. %v", err)
+	}
+	defer os.RemoveAll(dir)
+	mails := filepath.Join(dir, "mails")
+	m, _ := NewMailer("file://" + mails)
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, err := NewStorage("memory://?seed="+usersDump, hasher)
+	if err != nil {
+		t.Fatalf("Failed to create storage. %v", err)
+	}
+	s := server{
+		db:              db,
+		auth:            staticValidator{},
+		mailer:          m,
+		publicURL:       "https://idp.example.com",
+		templateMessage: template.Must(template.ParseFiles("./template/message.html")),
+	}
+
+	body := `{"uid":"a3","firstName":"Andrea","lastName":"Anderson","email":"andrea@imovies.ch"}`
+	r := httptest.NewRequest(http.MethodPut, "/user", strings.NewReader(body))
+	r.Header.Set(authorization, "Bearer a3")
+	w := httptest.NewRecorder()
+	s.EditUser(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to edit user: %d %s", w.Code, w.Body.String())
+	}
+	var u User
+	json.Unmarshal(w.Body.Bytes(), &u)
+	if u.FirstName != "Andrea" || u.Email != "anderson@imovies.ch" || u.PendingEmail != "andrea@imovies.ch" {
+		t.Errorf("Unexpected user %+v", u)
+	}
+
+	mail, err := ioutil.ReadFile(mails)
+	if err != nil || !strings.Contains(string(mail), "To: andrea@imovies.ch") {
+		t.Fatalf("No verification mail sent to the new address. %v\n%s", err, mail)
+	}
+	link := regexp.MustCompile(`https://idp\.example\.com(/email/confirm\?token=[\w-]+)`).FindStringSubmatch(string(mail))
+	if link == nil {
+		t.Fatalf("No link in mail:\n%s", mail)
+	}
+	w = httptest.NewRecorder()
+	s.ConfirmEmail(w, httptest.NewRequest(http.MethodGet, link[1], nil))
+	if !strings.Contains(w.Body.String(), emailMsgConfirmed) {
+		t.Errorf("Email not confirmed: %s", w.Body.String())
+	}
+	if u, _ := db.GetUser(context.Background(), "a3"); u.Email != "andrea@imovies.ch" || !u.EmailVerified {
+		t.Errorf("Unexpected user %+v", u)
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// This file has stand-ins for the services the IdP talks to: Hydra, Vault and the OIDC issuer
+// of access tokens. The storage has a real in-memory implementation, see storage_memory.go.
+
+// staticValidator accepts every token as belonging to the user it names. Roles follow the user,
+// separated by spaces, e.g. "Bearer a3 ca-admin".
+type staticValidator struct{}
+
+func (v staticValidator) Validate(ctx context.Context, authHeader string) (string, error) {
+	id, err := v.Identity(ctx, authHeader)
+	return id.Subject, err
+}
+
+func (staticValidator) Identity(ctx context.Context, authHeader string) (tokenIdentity, error) {
+	fields := strings.Fields(strings.TrimPrefix(authHeader, "Bearer "))
+	if len(fields) == 0 {
+		return tokenIdentity{}, fmt.Errorf("empty token")
+	}
+	return tokenIdentity{Subject: fields[0], Roles: fields[1:]}, nil
+}
+
+// fakeVault keeps the certificates of the user PKIs and escrowed keys in memory. If ca is set, it
+// is the issuer of all user PKIs, root is the root CA.
+type fakeVault struct {
+	cfg    Config
+	certs  map[string][]vaultCert
+	escrow map[string]issuedCert
+	ca     *x509.Certificate
+	caKey  crypto.Signer
+	root   *x509.Certificate
+	serial int64
+}
+
+func (v *fakeVault) PKIRoleExists(role string) (bool, error) {
+	_, ok := v.certs[role]
+	return ok, nil
+}
+
+func (v *fakeVault) CreatePKIUser(name string) error {
+	v.certs[name] = nil
+	return nil
+}
+
+func (v *fakeVault) CertificateIsValid(pkiMount, serial string) (bool, error) {
+	for _, certs := range v.certs {
+		for _, c := range certs {
+			if c.Serial == serial {
+				return c.RevokedAt.IsZero(), nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (v *fakeVault) ListUserPKIs() ([]string, error) {
+	var names []string
+	for name := range v.certs {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (v *fakeVault) ListCerts(ctx context.Context, name string) ([]vaultCert, error) {
+	return v.certs[name], nil
+}
+
+func (v *fakeVault) ReadCert(ctx context.Context, name string, serial string) (vaultCert, error) {
+	for _, c := range v.certs[name] {
+		if c.Serial == serial {
+			return c, nil
+		}
+	}
+	return vaultCert{}, errCertNotFound
+}
+
+func (v *fakeVault) RevokeCert(ctx context.Context, name string, serial string) (time.Time, error) {
+	for i, c := range v.certs[name] {
+		if c.Serial == serial {
+			v.certs[name][i].RevokedAt = time.Now()
+			return v.certs[name][i].RevokedAt, nil
+		}
+	}
+	return time.Time{}, errCertNotFound
+}
+
+func (v *fakeVault) UpdateKVPolicies(ctx context.Context) error {
+	return nil
+}
+
+func (v *fakeVault) ReadEscrowedKey(ctx context.Context, name string, serial string) (issuedCert, error) {
+	ic, ok := v.escrow[name+"/"+serial]
+	if !ok {
+		return issuedCert{}, errKeyNotEscrowed
+	}
+	return ic, nil
+}
+
+func (v *fakeVault) ReadRootCA(ctx context.Context) ([]byte, error) {
+	if v.root == nil {
+		return nil, errCertNotFound
+	}
+	return v.root.Raw, nil
+}
+
+func (v *fakeVault) ReadIssuer(ctx context.Context, name string) ([]byte, error) {
+	if v.ca == nil {
+		return nil, errCertNotFound
+	}
+	return v.ca.Raw, nil
+}
+
+func (v *fakeVault) ReadCRL(ctx context.Context, name string) ([]byte, error) {
+	if v.ca == nil {
+		return nil, errCertNotFound
+	}
+	var revoked []pkix.RevokedCertificate
+	for _, c := range v.certs[name] {
+		if !c.RevokedAt.IsZero() {
+			b, _ := pem.Decode([]byte(c.Certificate))
+			cert, _ := x509.ParseCertificate(b.Bytes)
+			revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: c.RevokedAt})
+		}
+	}
+	return v.ca.CreateCRL(rand.Reader, v.caKey, revoked, time.Now(), time.Now().Add(time.Hour))
+}
+
+func (v *fakeVault) SignOCSPResponder(ctx context.Context, name string, csr string, ttl time.Duration) (string, error) {
+	b, _ := pem.Decode([]byte(csr))
+	req, err := x509.ParseCertificateRequest(b.Bytes)
+	if err != nil {
+		return "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      req.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, v.ca, req.PublicKey, v.caKey)
+	if err != nil {
+		return "", err
+	}
+	// Like Vault, the PKI stores the certificates it signs.
+	p := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	v.certs[name] = append(v.certs[name], vaultCert{Serial: formatSerial(tmpl.SerialNumber), Certificate: p})
+	return p, nil
+}
+
+// newFakeVault returns a fakeVault with a root CA and a user PKI CA signed by it.
+// testConfig returns the config of the test IdP, the defaults of the fadalax deployment.
+func testConfig() Config {
+	var c Config
+	c.setDefaults()
+	return c
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	root, rootKey := newTestCert(t, caTemplate(1, "root"), nil, nil)
+	inter, interKey := newTestCert(t, caTemplate(2, "users"), root, rootKey)
+	return &fakeVault{
+		cfg:    testConfig(),
+		certs:  map[string][]vaultCert{},
+		escrow: map[string]issuedCert{},
+		ca:     inter,
+		caKey:  interKey,
+		root:   root,
+	}
+}
+
+// sign issues a certificate for the PKI of name.
+func (v *fakeVault) sign(name string, pub crypto.PublicKey) (signedCert, error) {
+	if v.ca == nil {
+		return signedCert{}, fmt.Errorf("fake vault has no CA")
+	}
+	v.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1000 + v.serial),
+		Subject:        pkix.Name{CommonName: v.cfg.certEmail(name)},
+		EmailAddresses: []string{v.cfg.certEmail(name)},
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, v.ca, pub, v.caKey)
+	if err != nil {
+		return signedCert{}, err
+	}
+	c := signedCert{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Serial:      formatSerial(tmpl.SerialNumber),
+		CAChain:     []string{encodeCert(v.ca)},
+	}
+	v.certs[name] = append(v.certs[name], vaultCert{Serial: c.Serial, Certificate: c.Certificate})
+	return c, nil
+}
+
+func (v *fakeVault) IssueCert(ctx context.Context, name string) (issuedCert, error) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c, err := v.sign(name, key.Public())
+	if err != nil {
+		return issuedCert{}, err
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	ic := issuedCert{signedCert: c, PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))}
+	v.escrow[name+"/"+c.Serial] = ic
+	return ic, nil
+}
+
+func (v *fakeVault) SignCSR(ctx context.Context, name string, csr string) (signedCert, error) {
+	req, err := parseCSR([]byte(csr))
+	if err != nil {
+		return signedCert{}, err
+	}
+	return v.sign(name, req.PublicKey)
+}
+
+func (v *fakeVault) RevokeCerts(ctx context.Context, name string) error {
+	for i, c := range v.certs[name] {
+		if c.RevokedAt.IsZero() {
+			v.certs[name][i].RevokedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+// newTestCert creates a certificate from tmpl signed by parent, or self-signed if parent is nil.
+// Unless tmpl sets them, the certificate is valid from an hour ago for two hours.
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = tmpl.NotBefore.Add(2 * time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate. %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// caTemplate is the template of a CA certificate for newTestCert.
+func caTemplate(serial int64, cn string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+}
+
+// encodeCert PEM encodes c, as Vault returns certificates.
+func encodeCert(c *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))
+}
+
+// fakeHydra stands in for the admin API of Hydra. Login and consent requests have to be registered
+// before the IdP asks for them, the requests the IdP accepted or rejected are recorded. Like Hydra,
+// handled requests cannot be fetched or handled again. The challenge "broken" makes Hydra fail.
+type fakeHydra struct {
+	*httptest.Server
+	mu               sync.Mutex
+	logins           map[string]LoginInfo
+	consents         map[string]ConsentInfo
+	acceptedLogins   map[string]AcceptLoginRequest
+	acceptedConsents map[string]AcceptConsentRequest
+	rejectedLogins   map[string]RejectRequest
+	rejectedConsents map[string]RejectRequest
+	logouts          map[string]LogoutInfo
+	acceptedLogouts  map[string]bool
+	rejectedLogouts  map[string]bool
+	// consentSessions are the remembered consents by subject.
+	consentSessions map[string][]PreviousConsentSession
+	// revokedLogins and revokedConsents are the subjects whose sessions were revoked, followed by
+	// "/client" if only those of a client were.
+	revokedLogins   []string
+	revokedConsents []string
+	// clients are the registered OAuth 2.0 clients, with their secrets.
+	clients map[string]OAuth2Client
+}
+
+func newFakeHydra() *fakeHydra {
+	h := &fakeHydra{
+		logins:           map[string]LoginInfo{},
+		consents:         map[string]ConsentInfo{},
+		acceptedLogins:   map[string]AcceptLoginRequest{},
+		acceptedConsents: map[string]AcceptConsentRequest{},
+		rejectedLogins:   map[string]RejectRequest{},
+		rejectedConsents: map[string]RejectRequest{},
+		logouts:          map[string]LogoutInfo{},
+		acceptedLogouts:  map[string]bool{},
+		rejectedLogouts:  map[string]bool{},
+		consentSessions:  map[string][]PreviousConsentSession{},
+		clients:          map[string]OAuth2Client{},
+	}
+	loginState := func(c string) (bool, bool) {
+		_, ok := h.logins[c]
+		_, accepted := h.acceptedLogins[c]
+		_, rejected := h.rejectedLogins[c]
+		return ok, accepted || rejected
+	}
+	consentState := func(c string) (bool, bool) {
+		_, ok := h.consents[c]
+		_, accepted := h.acceptedConsents[c]
+		_, rejected := h.rejectedConsents[c]
+		return ok, accepted || rejected
+	}
+	logoutState := func(c string) (bool, bool) {
+		_, ok := h.logouts[c]
+		return ok, h.acceptedLogouts[c] || h.rejectedLogouts[c]
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/auth/requests/login", func(w http.ResponseWriter, r *http.Request) {
+		h.get(w, r, "login_challenge", loginState, func(c string) interface{} { return h.logins[c] })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/consent", func(w http.ResponseWriter, r *http.Request) {
+		h.get(w, r, "consent_challenge", consentState, func(c string) interface{} { return h.consents[c] })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/login/accept", func(w http.ResponseWriter, r *http.Request) {
+		var req AcceptLoginRequest
+		h.handle(w, r, "login_challenge", &req, loginState, func(c string) { h.acceptedLogins[c] = req })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/login/reject", func(w http.ResponseWriter, r *http.Request) {
+		var req RejectRequest
+		h.handle(w, r, "login_challenge", &req, loginState, func(c string) { h.rejectedLogins[c] = req })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/consent/accept", func(w http.ResponseWriter, r *http.Request) {
+		var req AcceptConsentRequest
+		h.handle(w, r, "consent_challenge", &req, consentState, func(c string) { h.acceptedConsents[c] = req })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/consent/reject", func(w http.ResponseWriter, r *http.Request) {
+		var req RejectRequest
+		h.handle(w, r, "consent_challenge", &req, consentState, func(c string) { h.rejectedConsents[c] = req })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/logout", func(w http.ResponseWriter, r *http.Request) {
+		h.get(w, r, "logout_challenge", logoutState, func(c string) interface{} { return h.logouts[c] })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/logout/accept", func(w http.ResponseWriter, r *http.Request) {
+		h.handle(w, r, "logout_challenge", nil, logoutState, func(c string) { h.acceptedLogouts[c] = true })
+	})
+	mux.HandleFunc("/oauth2/auth/requests/logout/reject", func(w http.ResponseWriter, r *http.Request) {
+		h.handle(w, r, "logout_challenge", nil, logoutState, func(c string) { h.rejectedLogouts[c] = true })
+	})
+	mux.HandleFunc("/oauth2/auth/sessions/login", func(w http.ResponseWriter, r *http.Request) {
+		h.revoke(w, r, &h.revokedLogins)
+	})
+	mux.HandleFunc("/oauth2/auth/sessions/consent", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			sessions := h.consentSessions[r.URL.Query().Get("subject")]
+			if sessions == nil {
+				sessions = []PreviousConsentSession{}
+			}
+			json.NewEncoder(w).Encode(sessions)
+			return
+		}
+		h.revoke(w, r, &h.revokedConsents)
+	})
+	mux.HandleFunc("/clients", h.listOrCreateClient)
+	mux.HandleFunc("/clients/", h.clientByID)
+	h.Server = httptest.NewServer(mux)
+	return h
+}
+
+// client returns a client of the admin API of h, retrying once without delay.
+func (h *fakeHydra) client() *HydraClient {
+	return NewHydraClient(h.URL, h.Client(), time.Second, 1, 0)
+}
+
+// get answers a request for a login or consent request. state reports whether the challenge
+// exists and whether it was already handled.
+func (h *fakeHydra) get(w http.ResponseWriter, r *http.Request, param string, state func(string) (bool, bool), info func(string) interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := r.URL.Query().Get(param)
+	if c == "broken" {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+		return
+	}
+	ok, handled := state(c)
+	if r.Method != http.MethodGet || !ok {
+		hydraError(w, http.StatusNotFound, "Unable to locate the requested resource")
+		return
+	}
+	if handled {
+		hydraError(w, http.StatusConflict, "The request has already been handled")
+		return
+	}
+	json.NewEncoder(w).Encode(info(c))
+}
+
+// handle accepts or rejects a login, consent or logout request. It decodes req, unless nil, and
+// passes the challenge to record.
+func (h *fakeHydra) handle(w http.ResponseWriter, r *http.Request, param string, req interface{}, state func(string) (bool, bool), record func(string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := r.URL.Query().Get(param)
+	if r.Method != http.MethodPut || (req != nil && json.NewDecoder(r.Body).Decode(req) != nil) {
+		hydraError(w, http.StatusBadRequest, "The request was malformed")
+		return
+	}
+	ok, handled := state(c)
+	if !ok {
+		hydraError(w, http.StatusNotFound, "Unable to locate the requested resource")
+		return
+	}
+	if handled {
+		hydraError(w, http.StatusConflict, "The request has already been handled")
+		return
+	}
+	record(c)
+	json.NewEncoder(w).Encode(map[string]string{"redirect_to": "https://hydra.example.com/oauth2/auth?" + url.Values{param: {c}}.Encode()})
+}
+
+// revoke records the subject whose sessions are revoked in revoked.
+func (h *fakeHydra) revoke(w http.ResponseWriter, r *http.Request, revoked *[]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subject := r.URL.Query().Get("subject")
+	if r.Method != http.MethodDelete || subject == "" {
+		hydraError(w, http.StatusBadRequest, "The request was malformed")
+		return
+	}
+	if client := r.URL.Query().Get("client"); client != "" {
+		subject += "/" + client
+	}
+	*revoked = append(*revoked, subject)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listOrCreateClient lists the clients page by page, or registers one. Like Hydra, it generates a
+// secret if none is given, and returns it only then.
+func (h *fakeHydra) listOrCreateClient(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r.Method == http.MethodGet {
+		var ids []string
+		for id := range h.clients {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		page := []OAuth2Client{}
+		for i := offset; i < len(ids) && i < offset+limit; i++ {
+			c := h.clients[ids[i]]
+			c.ClientSecret = ""
+			page = append(page, c)
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	var c OAuth2Client
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&c) != nil || c.ClientID == "" {
+		hydraError(w, http.StatusBadRequest, "The request was malformed")
+		return
+	}
+	if _, ok := h.clients[c.ClientID]; ok {
+		hydraError(w, http.StatusConflict, "Unable to insert or update resource because a resource with that value exists already")
+		return
+	}
+	if c.ClientSecret == "" && c.TokenEndpointAuthMethod != "none" {
+		c.ClientSecret = "generated-" + c.ClientID
+	}
+	h.clients[c.ClientID] = c
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// clientByID gets, replaces or deletes a client. Replacing it without a secret keeps the secret.
+func (h *fakeHydra) clientByID(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/clients/")
+	cur, ok := h.clients[id]
+	if !ok {
+		hydraError(w, http.StatusNotFound, "Unable to locate the resource")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		cur.ClientSecret = ""
+		json.NewEncoder(w).Encode(cur)
+	case http.MethodPut:
+		var c OAuth2Client
+		if json.NewDecoder(r.Body).Decode(&c) != nil || c.ClientID != id {
+			hydraError(w, http.StatusBadRequest, "The request was malformed")
+			return
+		}
+		if c.ClientSecret == "" {
+			c.ClientSecret = cur.ClientSecret
+		}
+		h.clients[id] = c
+		c.ClientSecret = ""
+		json.NewEncoder(w).Encode(c)
+	case http.MethodDelete:
+		delete(h.clients, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		hydraError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func hydraError(w http.ResponseWriter, code int, desc string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":             strings.ToLower(strings.Replace(http.StatusText(code), " ", "_", -1)),
+		"error_description": desc,
+		"status_code":       code,
+	})
+}
+
+// fakeIssuer is an OpenID Connect issuer signing tokens with a static key, so that the real
+// token validator can be used.
+type fakeIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newFakeIssuer() *fakeIssuer {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	i := &fakeIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                i.URL,
+			"authorization_endpoint":                i.URL + "/oauth2/auth",
+			"token_endpoint":                        i.URL + "/oauth2/token",
+			"jwks_uri":                              i.URL + "/.well-known/jwks.json",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	i.Server = httptest.NewServer(mux)
+	return i
+}
+
+// token returns an access token of sub for aud, valid for an hour, with the claims in extra.
+func (i *fakeIssuer) token(t *testing.T, sub string, aud string, extra map[string]interface{}) string {
+	return i.sign(t, i.key, sub, aud, time.Now().Add(time.Hour), extra)
+}
+
+func (i *fakeIssuer) sign(t *testing.T, key *rsa.PrivateKey, sub string, aud string, exp time.Time, extra map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatalf("Failed to create signer. %v", err)
+	}
+	claims := jwt.Claims{
+		Issuer:   i.URL,
+		Subject:  sub,
+		Audience: jwt.Audience{aud},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(exp),
+	}
+	tok, err := jwt.Signed(signer).Claims(claims).Claims(extra).CompactSerialize()
+	if err != nil {
+		t.Fatalf("Failed to sign token. %v", err)
+	}
+	return "Bearer " + tok
+}
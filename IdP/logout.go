@@ -0,0 +1,86 @@
+package main
+
+import (
+	"html"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	logoutMsgExpired = "Your logout request has expired or was already completed. Please go back to the application and log out again."
+	logoutMsgStay    = "You are still logged in. You can close this page."
+)
+
+// Logout is the logout provider of Hydra. Logouts are always confirmed by the user, as anyone can
+// send the browser to the logout endpoint of Hydra. Signing out everywhere also revokes the login
+// sessions of the user in all browsers and the consents given to all clients. Once the logout is
+// accepted, Hydra runs the front- and back-channel logouts of the clients of the session.
+func (s server) Logout(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("%s, %q", r.Method, html.EscapeString(r.URL.Path))
+	challenge := r.URL.Query().Get("logout_challenge")
+	if challenge == "" {
+		log.Info("No logout challenge provided")
+		s.httpBadRequest(w, "no logout challenge provided")
+		return
+	}
+	info, err := s.hydra.GetLogoutInfo(r.Context(), challenge)
+	if err != nil {
+		log.WithError(err).Error("Error getting logout info")
+		s.hydraFailed(w, err, logoutMsgExpired)
+		return
+	}
+	l := log.WithField("subject", info.Subject)
+
+	if r.Method == http.MethodGet {
+		err := s.templateLogout.Execute(w, map[string]interface{}{
+			"Subject": info.Subject,
+		})
+		if err != nil {
+			s.httpInternalError(w, err)
+		}
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		s.httpBadRequest(w, "invalid form")
+		return
+	}
+	switch r.PostFormValue("action") {
+	case actionAccept:
+	case actionDeny:
+		l.Info("Logout cancelled.")
+		if err := s.hydra.RejectLogout(r.Context(), challenge); err != nil {
+			l.WithError(err).Error("Error rejecting logout.")
+			s.hydraFailed(w, err, logoutMsgExpired)
+			return
+		}
+		s.renderMessage(w, logoutMsgStay)
+		return
+	default:
+		s.httpBadRequest(w, "invalid form")
+		return
+	}
+
+	if r.PostFormValue("everywhere") != "" && info.Subject != "" {
+		l.Info("Signing out everywhere.")
+		if err := s.hydra.RevokeConsentSessions(r.Context(), info.Subject); err != nil {
+			l.WithError(err).Error("Failed to revoke consent sessions.")
+			s.httpInternalError(w, err)
+			return
+		}
+		if err := s.hydra.RevokeLoginSessions(r.Context(), info.Subject); err != nil {
+			l.WithError(err).Error("Failed to revoke login sessions.")
+			s.httpInternalError(w, err)
+			return
+		}
+	}
+	accRes, err := s.hydra.AcceptLogout(r.Context(), challenge)
+	if err != nil {
+		l.WithError(err).Error("Error accepting logout.")
+		s.hydraFailed(w, err, logoutMsgExpired)
+		return
+	}
+	l.Info("Logged out.")
+	http.Redirect(w, r, accRes.RedirectTo, http.StatusFound)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	loginStepTOTP = "totp"
+
+	// Authentication method references, see RFC 8176.
+	amrPassword    = "pwd"
+	amrCertificate = "swk" // proof-of-possession of a software-secured key, i.e. the client certificate
+	amrOTP         = "otp"
+
+	// Authentication context class references passed to Hydra.
+	acrSingleFactor = "1"
+	acrMultiFactor  = "2"
+)
+
+// checkSecondFactor checks code, which is either a TOTP code or a recovery code. Both can only be
+// used once.
+func (s server) checkSecondFactor(ctx context.Context, uid string, code string) (bool, error) {
+	tc, err := s.db.GetTOTP(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	if !tc.Enabled {
+		return false, nil
+	}
+	if strings.ContainsRune(code, '-') || len(strings.TrimSpace(code)) > totpDigits {
+		ok, err := s.db.UseRecoveryCode(ctx, uid, hashRecoveryCode(code))
+		if ok {
+			log.WithField("uid", uid).Info("Used recovery code.")
+		}
+		return ok, err
+	}
+	step, err := checkTOTP(tc.Secret, code, time.Now())
+	if err != nil || step < 0 {
+		return false, err
+	}
+	return s.db.UseTOTPStep(ctx, uid, step)
+}
+
+func (s server) renderTOTP(w http.ResponseWriter, state string, errMsg string) {
+	err := s.templateTOTP.Execute(w, map[string]interface{}{
+		"State": state,
+		"Step":  loginStepTOTP,
+		"Error": errMsg,
+	})
+	if err != nil {
+		s.httpInternalError(w, err)
+	}
+}
+
+type totpStatus struct {
+	Enabled bool `json:"enabled"`
+	// Pending is true if an enrollment has been started but not confirmed yet.
+	Pending bool `json:"pending"`
+}
+
+func (s server) GetTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	tc, err := s.db.GetTOTP(r.Context(), id)
+	if err != nil {
+		log.WithError(err).WithField("uid", id).Error("Failed to get TOTP config.")
+		s.httpInternalError(w, fmt.Errorf("failed to get totp"))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, totpStatus{Enabled: tc.Enabled, Pending: !tc.Enabled && tc.Secret != ""})
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI to be shown as QR code.
+	URI string `json:"uri"`
+}
+
+// EnrollTOTP starts an enrollment by generating a new secret. The second factor is only enabled once
+// the user confirms a code, see ConfirmTOTP.
+func (s server) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("uid", id)
+	tc, err := s.db.GetTOTP(r.Context(), id)
+	if err != nil {
+		l.WithError(err).Error("Failed to get TOTP config.")
+		s.httpInternalError(w, fmt.Errorf("failed to get totp"))
+		return
+	}
+	if tc.Enabled {
+		http.Error(w, "totp already enabled", http.StatusConflict)
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	err = s.db.SetTOTP(r.Context(), id, TOTPConfig{Secret: secret})
+	if err != nil {
+		l.WithError(err).Error("Failed to store TOTP secret.")
+		s.httpInternalError(w, fmt.Errorf("failed to enroll totp"))
+		return
+	}
+	l.Info("Started TOTP enrollment.")
+	s.writeJSON(w, http.StatusOK, totpEnrollment{Secret: secret, URI: totpURI(id, secret)})
+}
+
+type totpCode struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// ConfirmTOTP enables the pending second factor if the code matches and returns fresh recovery codes.
+func (s server) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("uid", id)
+	var req totpCode
+	if err := readJSON(r, &req); err != nil {
+		l.WithError(err).Error("ConfirmTOTP invalid body")
+		s.httpBadRequest(w, "Could not parse body.")
+		return
+	}
+	tc, err := s.db.GetTOTP(r.Context(), id)
+	if err != nil {
+		l.WithError(err).Error("Failed to get TOTP config.")
+		s.httpInternalError(w, fmt.Errorf("failed to get totp"))
+		return
+	}
+	if tc.Enabled || tc.Secret == "" {
+		http.Error(w, "no pending totp enrollment", http.StatusConflict)
+		return
+	}
+	step, err := checkTOTP(tc.Secret, req.Code, time.Now())
+	if err != nil {
+		l.WithError(err).Error("Failed to check TOTP code.")
+		s.httpInternalError(w, fmt.Errorf("failed to check code"))
+		return
+	}
+	if step < 0 {
+		s.httpBadRequest(w, "invalid code")
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	err = s.db.SetRecoveryCodes(r.Context(), id, hashes)
+	if err != nil {
+		l.WithError(err).Error("Failed to store recovery codes.")
+		s.httpInternalError(w, fmt.Errorf("failed to enable totp"))
+		return
+	}
+	err = s.db.SetTOTP(r.Context(), id, TOTPConfig{Secret: tc.Secret, Enabled: true, LastStep: step})
+	if err != nil {
+		l.WithError(err).Error("Failed to enable TOTP.")
+		s.httpInternalError(w, fmt.Errorf("failed to enable totp"))
+		return
+	}
+	l.Info("Enabled TOTP.")
+	s.writeJSON(w, http.StatusOK, recoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableTOTP removes the second factor. A valid TOTP or recovery code is required, and wrong codes
+// count as failed logins, so that a stolen token is not enough to guess one.
+func (s server) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("uid", id)
+	var req totpCode
+	if err := readJSON(r, &req); err != nil {
+		l.WithError(err).Error("DisableTOTP invalid body")
+		s.httpBadRequest(w, "Could not parse body.")
+		return
+	}
+	if !s.throttle.Allow(id, s.clientIP(r)) {
+		l.Warn("Disabling TOTP throttled.")
+		http.Error(w, loginErrThrottled, http.StatusTooManyRequests)
+		return
+	}
+	valid, err := s.checkSecondFactor(r.Context(), id, req.Code)
+	if err != nil {
+		l.WithError(err).Error("Failed to check second factor.")
+		s.httpInternalError(w, fmt.Errorf("failed to check code"))
+		return
+	}
+	if !valid {
+		s.throttle.Failure(id, s.clientIP(r))
+		l.Warn("Wrong code to disable TOTP.")
+		s.httpBadRequest(w, "invalid code")
+		return
+	}
+	s.throttle.Success(id)
+	err = s.db.SetTOTP(r.Context(), id, TOTPConfig{})
+	if err == nil {
+		err = s.db.SetRecoveryCodes(r.Context(), id, nil)
+	}
+	if err != nil {
+		l.WithError(err).Error("Failed to disable TOTP.")
+		s.httpInternalError(w, fmt.Errorf("failed to disable totp"))
+		return
+	}
+	l.Info("Disabled TOTP.")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      map[string][]string
+	down    map[string][]string
+}
+
+// migrationStatus describes a migration and whether it has been applied to the database.
+type migrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrator is implemented by storage backends which own a schema. The in-memory backend does not.
+type migrator interface {
+	// MigrateUp applies all pending migrations up to and including version target, 0 meaning all.
+	MigrateUp(ctx context.Context, target int) error
+	// MigrateDown reverts the last steps applied migrations.
+	MigrateDown(ctx context.Context, steps int) error
+	MigrationStatus(ctx context.Context) ([]migrationStatus, error)
+}
+
+var schemaMigrationsTable = map[string]string{
+	"mysql": "CREATE TABLE IF NOT EXISTS `schema_migrations` (\n" +
+		"  `version` int NOT NULL,\n" +
+		"  `name` varchar(255) NOT NULL DEFAULT '',\n" +
+		"  `applied_at` datetime NOT NULL,\n" +
+		"  PRIMARY KEY (`version`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"sqlite3": `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version integer NOT NULL PRIMARY KEY,
+  name varchar(255) NOT NULL DEFAULT '',
+  applied_at datetime NOT NULL
+)`,
+}
+
+// appliedMigrations returns the applied versions and when they were applied.
+func (s *storage) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	_, err := s.db.ExecContext(ctx, schemaMigrationsTable[s.driver])
+	if err != nil {
+		log.WithError(err).Error("Failed to create schema_migrations table.")
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		log.WithError(err).Error("Failed to query applied migrations.")
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+func (s *storage) MigrateUp(ctx context.Context, target int) error {
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if target != 0 && m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		l := log.WithFields(log.Fields{"version": m.version, "name": m.name})
+		l.Info("Applying migration.")
+		err := s.runMigration(ctx, m.up[s.driver],
+			`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`, m.version, m.name, time.Now().UTC())
+		if err != nil {
+			l.WithError(err).Error("Failed to apply migration.")
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *storage) MigrateDown(ctx context.Context, steps int) error {
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		l := log.WithFields(log.Fields{"version": m.version, "name": m.name})
+		l.Info("Reverting migration.")
+		err := s.runMigration(ctx, m.down[s.driver], `DELETE FROM schema_migrations WHERE version = ?`, m.version)
+		if err != nil {
+			l.WithError(err).Error("Failed to revert migration.")
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// runMigration executes stmts followed by the bookkeeping statement. Note that MySQL implicitly
+// commits DDL statements, so there a failing migration might be partially applied.
+func (s *storage) runMigration(ctx context.Context, stmts []string, record string, args ...interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *storage) MigrationStatus(ctx context.Context) ([]migrationStatus, error) {
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]migrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		at, ok := applied[m.version]
+		status = append(status, migrationStatus{Version: m.version, Name: m.name, Applied: ok, AppliedAt: at})
+	}
+	return status, nil
+}
+
+// runMigrateCommand implements `idp migrate up [version] | down [steps] | status`.
+func runMigrateCommand(ctx context.Context, db storageClient, args []string, out io.Writer) error {
+	m, ok := db.(migrator)
+	if !ok {
+		return fmt.Errorf("storage backend has no schema to migrate")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: idp migrate up [version] | down [steps] | status")
+	}
+	n := 0
+	if len(args) > 1 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid argument %q", args[1])
+		}
+	}
+	switch args[0] {
+	case "up":
+		return m.MigrateUp(ctx, n)
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		return m.MigrateDown(ctx, n)
+	case "status":
+		status, err := m.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, st := range status {
+			at := "pending"
+			if st.Applied {
+				at = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, at)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Migration %q has version %d, expected %d", m.name, m.version, i+1)
+		}
+		for _, driver := range []string{"mysql", "sqlite3"} {
+			if _, ok := m.up[driver]; !ok {
+				t.Errorf("Migration %d has no up statements for %s", m.version, driver)
+			}
+			if _, ok := m.down[driver]; !ok {
+				t.Errorf("Migration %d has no down statements for %s", m.version, driver)
+			}
+		}
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idp-migrate")
+	if err != nil {
+		t.Fatalf("Failed to create tmp dir. %v", err)
+	}
+	defer os.RemoveAll(dir)
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, err := NewStorage("sqlite://"+filepath.Join(dir, "idp.db"), hasher)
+	if err != nil {
+		t.Fatalf("Failed to create storage. %v", err)
+	}
+	ctx := context.Background()
+
+	// Up, down all the way and up again must work.
+	for _, args := range [][]string{{"up"}, {"down", "1000"}, {"up"}} {
+		if err := runMigrateCommand(ctx, db, args, ioutil.Discard); err != nil {
+			t.Fatalf("migrate %v failed. %v", args, err)
+		}
+	}
+	// Applying twice is a no-op.
+	if err := runMigrateCommand(ctx, db, []string{"up"}, ioutil.Discard); err != nil {
+		t.Fatalf("Second migrate up failed. %v", err)
+	}
+
+	status, err := db.(migrator).MigrationStatus(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get status. %v", err)
+	}
+	for _, st := range status {
+		if !st.Applied {
+			t.Errorf("Migration %d not applied", st.Version)
+		}
+	}
+
+	if err := runMigrateCommand(ctx, db, []string{"down"}, ioutil.Discard); err != nil {
+		t.Fatalf("migrate down failed. %v", err)
+	}
+	out := &bytes.Buffer{}
+	if err := runMigrateCommand(ctx, db, []string{"status"}, out); err != nil {
+		t.Fatalf("migrate status failed. %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(migrations)+1 || !strings.HasSuffix(lines[len(lines)-1], "pending") {
+		t.Errorf("Unexpected status output:\n%s", out.String())
+	}
+
+	mem, _ := NewStorage("memory://", hasher)
+	if err := runMigrateCommand(ctx, mem, []string{"up"}, ioutil.Discard); err == nil {
+		t.Error("Expected an error when migrating the memory backend.")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+// migrations contains every schema change of the IdP, in order. Never edit a migration which has
+// been released, add a new one instead. Statements are listed per database/sql driver name and are
+// executed one by one, since the MySQL driver does not allow multiple statements per Exec.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users",
+		// Same schema as imovies_users.dump, but with room for modern password hashes.
+		up: map[string][]string{
+			"mysql": {
+				"CREATE TABLE IF NOT EXISTS `users` (\n" +
+					"  `uid` varchar(64) NOT NULL DEFAULT '',\n" +
+					"  `lastname` varchar(64) NOT NULL DEFAULT '',\n" +
+					"  `firstname` varchar(64) NOT NULL DEFAULT '',\n" +
+					"  `email` varchar(64) NOT NULL DEFAULT '',\n" +
+					"  `pwd` varchar(255) NOT NULL DEFAULT '',\n" +
+					"  PRIMARY KEY (`uid`)\n" +
+					") ENGINE=MyISAM DEFAULT CHARSET=latin1",
+			},
+			"sqlite3": {
+				`CREATE TABLE IF NOT EXISTS users (
+  uid varchar(64) NOT NULL DEFAULT '',
+  lastname varchar(64) NOT NULL DEFAULT '',
+  firstname varchar(64) NOT NULL DEFAULT '',
+  email varchar(64) NOT NULL DEFAULT '',
+  pwd varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (uid)
+)`,
+			},
+		},
+		down: map[string][]string{
+			"mysql":   {"DROP TABLE `users`"},
+			"sqlite3": {"DROP TABLE users"},
+		},
+	},
+	{
+		version: 2,
+		name:    "users innodb utf8mb4",
+		// Databases loaded from imovies_users.dump still have pwd varchar(64), which is too short for
+		// argon2id hashes.
+		up: map[string][]string{
+			"mysql": {
+				"ALTER TABLE `users` ENGINE=InnoDB",
+				"ALTER TABLE `users` CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci",
+				"ALTER TABLE `users` MODIFY `pwd` varchar(255) NOT NULL DEFAULT ''",
+			},
+			"sqlite3": {},
+		},
+		// pwd is kept at 255 characters, shrinking it would truncate the hashes.
+		down: map[string][]string{
+			"mysql": {
+				"ALTER TABLE `users` CONVERT TO CHARACTER SET latin1",
+				"ALTER TABLE `users` ENGINE=MyISAM",
+			},
+			"sqlite3": {},
+		},
+	},
+	{
+		version: 3,
+		name:    "users admin and disabled flags",
+		up: map[string][]string{
+			"mysql": {
+				"ALTER TABLE `users` ADD COLUMN `admin` tinyint(1) NOT NULL DEFAULT 0, ADD COLUMN `disabled` tinyint(1) NOT NULL DEFAULT 0",
+			},
+			"sqlite3": {
+				`ALTER TABLE users ADD COLUMN admin boolean NOT NULL DEFAULT 0`,
+				`ALTER TABLE users ADD COLUMN disabled boolean NOT NULL DEFAULT 0`,
+			},
+		},
+		// The bundled SQLite does not support DROP COLUMN yet, so the table is rebuilt.
+		down: map[string][]string{
+			"mysql": {
+				"ALTER TABLE `users` DROP COLUMN `admin`, DROP COLUMN `disabled`",
+			},
+			"sqlite3": {
+				`CREATE TABLE users_down (
+  uid varchar(64) NOT NULL DEFAULT '',
+  lastname varchar(64) NOT NULL DEFAULT '',
+  firstname varchar(64) NOT NULL DEFAULT '',
+  email varchar(64) NOT NULL DEFAULT '',
+  pwd varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (uid)
+)`,
+				`INSERT INTO users_down SELECT uid, lastname, firstname, email, pwd FROM users`,
+				`DROP TABLE users`,
+				`ALTER TABLE users_down RENAME TO users`,
+			},
+		},
+	},
+	{
+		version: 4,
+		name:    "totp second factor",
+		up: map[string][]string{
+			"mysql": {
+				"ALTER TABLE `users` ADD COLUMN `totp_secret` varchar(64) NOT NULL DEFAULT '', " +
+					"ADD COLUMN `totp_enabled` tinyint(1) NOT NULL DEFAULT 0, " +
+					"ADD COLUMN `totp_last_step` bigint NOT NULL DEFAULT 0",
+				"CREATE TABLE `recovery_codes` (\n" +
+					"  `uid` varchar(64) NOT NULL,\n" +
+					"  `code_hash` char(64) NOT NULL,\n" +
+					"  PRIMARY KEY (`uid`, `code_hash`)\n" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			},
+			"sqlite3": {
+				`ALTER TABLE users ADD COLUMN totp_secret varchar(64) NOT NULL DEFAULT ''`,
+				`ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT 0`,
+				`ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0`,
+				`CREATE TABLE recovery_codes (
+  uid varchar(64) NOT NULL,
+  code_hash char(64) NOT NULL,
+  PRIMARY KEY (uid, code_hash)
+)`,
+			},
+		},
+		down: map[string][]string{
+			"mysql": {
+				"DROP TABLE `recovery_codes`",
+				"ALTER TABLE `users` DROP COLUMN `totp_secret`, DROP COLUMN `totp_enabled`, DROP COLUMN `totp_last_step`",
+			},
+			"sqlite3": {
+				`DROP TABLE recovery_codes`,
+				`CREATE TABLE users_down (
+  uid varchar(64) NOT NULL DEFAULT '',
+  lastname varchar(64) NOT NULL DEFAULT '',
+  firstname varchar(64) NOT NULL DEFAULT '',
+  email varchar(64) NOT NULL DEFAULT '',
+  pwd varchar(255) NOT NULL DEFAULT '',
+  admin boolean NOT NULL DEFAULT 0,
+  disabled boolean NOT NULL DEFAULT 0,
+  PRIMARY KEY (uid)
+)`,
+				`INSERT INTO users_down SELECT uid, lastname, firstname, email, pwd, admin, disabled FROM users`,
+				`DROP TABLE users`,
+				`ALTER TABLE users_down RENAME TO users`,
+			},
+		},
+	},
+	{
+		version: 5,
+		name:    "password reset tokens",
+		up: map[string][]string{
+			"mysql": {
+				"CREATE TABLE `password_reset_tokens` (\n" +
+					"  `token_hash` char(64) NOT NULL,\n" +
+					"  `uid` varchar(64) NOT NULL,\n" +
+					"  `expires_at` bigint NOT NULL,\n" +
+					"  PRIMARY KEY (`token_hash`),\n" +
+					"  KEY `uid` (`uid`)\n" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			},
+			"sqlite3": {
+				`CREATE TABLE password_reset_tokens (
+  token_hash char(64) NOT NULL,
+  uid varchar(64) NOT NULL,
+  expires_at bigint NOT NULL,
+  PRIMARY KEY (token_hash)
+)`,
+				`CREATE INDEX password_reset_tokens_uid ON password_reset_tokens (uid)`,
+			},
+		},
+		down: map[string][]string{
+			"mysql":   {"DROP TABLE `password_reset_tokens`"},
+			"sqlite3": {"DROP TABLE password_reset_tokens"},
+		},
+	},
+	{
+		version: 6,
+		name:    "password history",
+		up: map[string][]string{
+			"mysql": {
+				"CREATE TABLE `password_history` (\n" +
+					"  `id` bigint NOT NULL AUTO_INCREMENT,\n" +
+					"  `uid` varchar(64) NOT NULL,\n" +
+					"  `pwd` varchar(255) NOT NULL,\n" +
+					"  PRIMARY KEY (`id`),\n" +
+					"  KEY `uid` (`uid`)\n" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			},
+			"sqlite3": {
+				`CREATE TABLE password_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  uid varchar(64) NOT NULL,
+  pwd varchar(255) NOT NULL
+)`,
+				`CREATE INDEX password_history_uid ON password_history (uid)`,
+			},
+		},
+		down: map[string][]string{
+			"mysql":   {"DROP TABLE `password_history`"},
+			"sqlite3": {"DROP TABLE password_history"},
+		},
+	},
+	{
+		version: 7,
+		name:    "email verification",
+		// Addresses entered before were set up by the operators and are trusted.
+		up: map[string][]string{
+			"mysql": {
+				"ALTER TABLE `users` ADD COLUMN `email_verified` tinyint(1) NOT NULL DEFAULT 0, " +
+					"ADD COLUMN `pending_email` varchar(64) NOT NULL DEFAULT '', " +
+					"ADD COLUMN `email_token_hash` char(64) NOT NULL DEFAULT '', " +
+					"ADD COLUMN `email_token_expires` bigint NOT NULL DEFAULT 0",
+				"UPDATE `users` SET `email_verified` = 1 WHERE `email` <> ''",
+			},
+			"sqlite3": {
+				`ALTER TABLE users ADD COLUMN email_verified boolean NOT NULL DEFAULT 0`,
+				`ALTER TABLE users ADD COLUMN pending_email varchar(64) NOT NULL DEFAULT ''`,
+				`ALTER TABLE users ADD COLUMN email_token_hash char(64) NOT NULL DEFAULT ''`,
+				`ALTER TABLE users ADD COLUMN email_token_expires bigint NOT NULL DEFAULT 0`,
+				`UPDATE users SET email_verified = 1 WHERE email <> ''`,
+			},
+		},
+		down: map[string][]string{
+			"mysql": {
+				"ALTER TABLE `users` DROP COLUMN `email_verified`, DROP COLUMN `pending_email`, " +
+					"DROP COLUMN `email_token_hash`, DROP COLUMN `email_token_expires`",
+			},
+			"sqlite3": {
+				`CREATE TABLE users_down (
+  uid varchar(64) NOT NULL DEFAULT '',
+  lastname varchar(64) NOT NULL DEFAULT '',
+  firstname varchar(64) NOT NULL DEFAULT '',
+  email varchar(64) NOT NULL DEFAULT '',
+  pwd varchar(255) NOT NULL DEFAULT '',
+  admin boolean NOT NULL DEFAULT 0,
+  disabled boolean NOT NULL DEFAULT 0,
+  totp_secret varchar(64) NOT NULL DEFAULT '',
+  totp_enabled boolean NOT NULL DEFAULT 0,
+  totp_last_step bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (uid)
+)`,
+				`INSERT INTO users_down SELECT uid, lastname, firstname, email, pwd, admin, disabled, totp_secret, totp_enabled, totp_last_step FROM users`,
+				`DROP TABLE users`,
+				`ALTER TABLE users_down RENAME TO users`,
+			},
+		},
+	},
+	{
+		version: 8,
+		name:    "certificate revocation reasons",
+		// Vault does not record why a certificate was revoked.
+		up: map[string][]string{
+			"mysql": {
+				"CREATE TABLE `cert_revocations` (\n" +
+					"  `uid` varchar(64) NOT NULL,\n" +
+					"  `serial` varchar(64) NOT NULL,\n" +
+					"  `reason` int NOT NULL,\n" +
+					"  PRIMARY KEY (`uid`, `serial`)\n" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			},
+			"sqlite3": {
+				`CREATE TABLE cert_revocations (
+  uid varchar(64) NOT NULL,
+  serial varchar(64) NOT NULL,
+  reason int NOT NULL,
+  PRIMARY KEY (uid, serial)
+)`,
+			},
+		},
+		down: map[string][]string{
+			"mysql":   {"DROP TABLE `cert_revocations`"},
+			"sqlite3": {"DROP TABLE cert_revocations"},
+		},
+	},
+	{
+		version: 9,
+		name:    "key recovery and audit log",
+		up: map[string][]string{
+			"mysql": {
+				"CREATE TABLE `key_recovery_requests` (\n" +
+					"  `id` bigint NOT NULL AUTO_INCREMENT,\n" +
+					"  `uid` varchar(64) NOT NULL,\n" +
+					"  `serial` varchar(64) NOT NULL,\n" +
+					"  `status` varchar(16) NOT NULL,\n" +
+					"  `requested_at` bigint NOT NULL,\n" +
+					"  `decided_by` varchar(64) NOT NULL DEFAULT '',\n" +
+					"  `decided_at` bigint NOT NULL DEFAULT 0,\n" +
+					"  PRIMARY KEY (`id`),\n" +
+					"  KEY `uid` (`uid`)\n" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+				"CREATE TABLE `audit_log` (\n" +
+					"  `id` bigint NOT NULL AUTO_INCREMENT,\n" +
+					"  `at` bigint NOT NULL,\n" +
+					"  `actor` varchar(64) NOT NULL,\n" +
+					"  `uid` varchar(64) NOT NULL,\n" +
+					"  `action` varchar(64) NOT NULL,\n" +
+					"  `detail` varchar(255) NOT NULL DEFAULT '',\n" +
+					"  `remote_addr` varchar(64) NOT NULL DEFAULT '',\n" +
+					"  PRIMARY KEY (`id`),\n" +
+					"  KEY `uid` (`uid`)\n" +
+					") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			},
+			"sqlite3": {
+				`CREATE TABLE key_recovery_requests (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  uid varchar(64) NOT NULL,
+  serial varchar(64) NOT NULL,
+  status varchar(16) NOT NULL,
+  requested_at bigint NOT NULL,
+  decided_by varchar(64) NOT NULL DEFAULT '',
+  decided_at bigint NOT NULL DEFAULT 0
+)`,
+				`CREATE INDEX key_recovery_requests_uid ON key_recovery_requests (uid)`,
+				`CREATE TABLE audit_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  at bigint NOT NULL,
+  actor varchar(64) NOT NULL,
+  uid varchar(64) NOT NULL,
+  action varchar(64) NOT NULL,
+  detail varchar(255) NOT NULL DEFAULT '',
+  remote_addr varchar(64) NOT NULL DEFAULT ''
+)`,
+				`CREATE INDEX audit_log_uid ON audit_log (uid)`,
+			},
+		},
+		down: map[string][]string{
+			"mysql":   {"DROP TABLE `audit_log`", "DROP TABLE `key_recovery_requests`"},
+			"sqlite3": {"DROP TABLE audit_log", "DROP TABLE key_recovery_requests"},
+		},
+	},
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// realIPHeader is set by the TLS terminating proxy to the address of the client.
+const realIPHeader = "x-real-ip"
+
+// trustedProxies are the TLS terminating proxies whose client certificate and client address
+// headers are believed. Requests from anywhere else cannot authenticate with them.
+type trustedProxies struct {
+	nets []*net.IPNet
+	// hosts are resolved on every check, as the address of a proxy container may change.
+	hosts []string
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses, CIDR ranges and host names.
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	var tp trustedProxies
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		switch {
+		case e == "":
+		case strings.Contains(e, "/"):
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return trustedProxies{}, fmt.Errorf("invalid trusted proxy %q: %v", e, err)
+			}
+			tp.nets = append(tp.nets, n)
+		case net.ParseIP(e) != nil:
+			ip := net.ParseIP(e)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			tp.nets = append(tp.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			tp.hosts = append(tp.hosts, e)
+		}
+	}
+	return tp, nil
+}
+
+// trusts reports whether r was passed on by a trusted proxy.
+func (tp trustedProxies) trusts(r *http.Request) bool {
+	ip := net.ParseIP(remoteHost(r))
+	if ip == nil {
+		return false
+	}
+	for _, n := range tp.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, h := range tp.hosts {
+		addrs, err := net.LookupIP(h)
+		if err != nil {
+			log.WithError(err).WithField("host", h).Warn("Failed to resolve trusted proxy.")
+			continue
+		}
+		for _, a := range addrs {
+			if a.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the request came from. Behind a trusted proxy that is the address
+// the proxy passed in the x-real-ip header.
+func (s server) clientIP(r *http.Request) string {
+	if s.proxies.trusts(r) {
+		if ip := net.ParseIP(r.Header.Get(realIPHeader)); ip != nil {
+			return ip.String()
+		}
+	}
+	return remoteHost(r)
+}
+
+// clientCert identifies the client certificate a request was made with.
+type clientCert struct {
+	UID string
+	// Serial is the serial number as sent by the proxy or formatted by formatSerial.
+	Serial string
+}
+
+// clientCertificate returns the client certificate of r. Certificates verified by the mTLS listener
+// take precedence. Otherwise the x-fadalax-auth and x-fadalax-serial headers are used, but only if
+// r comes from a trusted proxy. If want is not empty, only a certificate of want is accepted.
+func (s server) clientCertificate(r *http.Request, want string) (clientCert, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return s.verifiedClientCert(r.TLS.VerifiedChains[0], want)
+	}
+	authHeader := r.Header.Get(fadalaxAuthHeader)
+	if authHeader == "" {
+		return clientCert{}, false
+	}
+	if !s.proxies.trusts(r) {
+		log.WithField("remote", r.RemoteAddr).Warn("Ignoring client certificate headers from untrusted source.")
+		return clientCert{}, false
+	}
+	for _, hdr := range strings.Split(authHeader, ",") {
+		uid, ok := s.cfg.certUID(hdr, want)
+		if ok {
+			return clientCert{UID: uid, Serial: r.Header.Get(fadalaxCertSerialHeader)}, true
+		}
+	}
+	return clientCert{}, false
+}
+
+// verifiedClientCert derives the client certificate from a chain verified by the TLS stack. As the
+// CAs of all user PKIs are trusted, the certificate must also have been issued by the PKI of its
+// subject, or by the root pki mount for the CA administrator.
+func (s server) verifiedClientCert(chain []*x509.Certificate, want string) (clientCert, bool) {
+	leaf := chain[0]
+	uid, ok := s.cfg.certUID("CN="+leaf.Subject.CommonName, want)
+	if !ok || len(chain) < 2 {
+		return clientCert{}, false
+	}
+	var issuer *x509.Certificate
+	if uid == caAdminUID {
+		issuer = s.rootCA
+	} else if s.revocations != nil {
+		issuer = s.revocations.Issuer(uid)
+	}
+	if issuer == nil || !bytes.Equal(chain[1].Raw, issuer.Raw) {
+		log.WithField("uid", uid).Warn("Client certificate not issued by the PKI of its subject.")
+		return clientCert{}, false
+	}
+	return clientCert{UID: uid, Serial: formatSerial(leaf.SerialNumber)}, true
+}
+
+// certUID returns the uid of a subject DN component like CN=a3@fadalax.tech, see certEmail. If want
+// is not empty, only want is accepted.
+func (c Config) certUID(dn string, want string) (string, bool) {
+	ms := regexp.MustCompile(`^CN=([[:alnum:]]+)@` + regexp.QuoteMeta(c.Domain) + `$`).FindStringSubmatch(dn)
+	if len(ms) != 2 {
+		log.Debugf("no uid in %q", dn)
+		return "", false
+	}
+	if want != "" && want != ms[1] {
+		log.Errorf("wrong username: %v != %v", ms[1], want)
+		return "", false
+	}
+	return ms[1], true
+}
+
+// mtlsConfig returns the TLS configuration of the mTLS listener. Client certificates are optional and
+// verified against the root CA of Vault and the CAs of the user PKIs. The latter are trusted
+// directly, so that clients need not send their intermediate, and may change at runtime, so the
+// pool is built for every handshake.
+func (s server) mtlsConfig(cert tls.Certificate) *tls.Config {
+	base := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	c := base.Clone()
+	c.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		hc := base.Clone()
+		hc.ClientCAs = s.clientCAs()
+		return hc, nil
+	}
+	return c
+}
+
+// clientCAs returns the CAs client certificates are verified against.
+func (s server) clientCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if s.rootCA != nil {
+		pool.AddCert(s.rootCA)
+	}
+	if s.revocations != nil {
+		for _, c := range s.revocations.Issuers() {
+			pool.AddCert(c)
+		}
+	}
+	return pool
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	tp, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1,::1,localhost")
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies. %v", err)
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3:1234":    true,
+		"192.168.1.1:80":   true,
+		"192.168.1.2:80":   false,
+		"[::1]:80":         true,
+		"[::2]:80":         false,
+		"127.0.0.1:80":     true,
+		"not an address":   false,
+		"172.16.0.1:55555": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/login", nil)
+		r.RemoteAddr = addr
+		if got := tp.trusts(r); got != want {
+			t.Errorf("trusts(%q) = %v, want %v", addr, got, want)
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Accepted invalid CIDR range.")
+	}
+}
+
+func TestClientCertificateHeaders(t *testing.T) {
+	tp, _ := parseTrustedProxies("10.0.0.1")
+	s := server{proxies: tp, cfg: testConfig()}
+	req := func(remote string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/login", nil)
+		r.RemoteAddr = remote + ":4711"
+		r.Header.Set(fadalaxAuthHeader, "C=CH,O=imovies,CN=a3@fadalax.tech")
+		r.Header.Set(fadalaxCertSerialHeader, "0A1B")
+		r.Header.Set(realIPHeader, "192.0.2.7")
+		return r
+	}
+
+	c, ok := s.clientCertificate(req("10.0.0.1"), "")
+	if !ok || c.UID != "a3" || c.Serial != "0A1B" {
+		t.Errorf("Unexpected certificate from trusted proxy %+v %v", c, ok)
+	}
+	if _, ok := s.clientCertificate(req("10.0.0.1"), "ps"); ok {
+		t.Error("Accepted certificate of other user.")
+	}
+	if ip := s.clientIP(req("10.0.0.1")); ip != "192.0.2.7" {
+		t.Errorf("Expected address passed by proxy, got %s", ip)
+	}
+
+	if _, ok := s.clientCertificate(req("10.0.0.2"), ""); ok {
+		t.Error("Accepted certificate headers from untrusted source.")
+	}
+	if ip := s.clientIP(req("10.0.0.2")); ip != "10.0.0.2" {
+		t.Errorf("Expected remote address, got %s", ip)
+	}
+}
+
+func TestMTLSListener(t *testing.T) {
+	leafTmpl := func(serial int64, cn string, usage x509.ExtKeyUsage) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{"127.0.0.1"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+	}
+	root, rootKey := newTestCert(t, caTemplate(1, "root"), nil, nil)
+	inter, interKey := newTestCert(t, caTemplate(2, "a3.fadalax.tech"), root, rootKey)
+	other, otherKey := newTestCert(t, caTemplate(3, "other"), nil, nil)
+	srvCert, srvKey := newTestCert(t, leafTmpl(10, "idp.fadalax.tech", x509.ExtKeyUsageServerAuth), root, rootKey)
+
+	v := &fakeVault{ca: inter, caKey: interKey, root: root, certs: map[string][]vaultCert{"a3": nil}}
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, _ := NewStorage("memory://", hasher)
+	s := server{rootCA: root, cfg: testConfig(), revocations: newRevocationCache(v, db, time.Minute, time.Hour)}
+	if err := s.revocations.Refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to refresh. %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := s.clientCertificate(r, "")
+		fmt.Fprintf(w, "%s %s %v", c.UID, c.Serial, ok)
+	}))
+	ts.TLS = s.mtlsConfig(tls.Certificate{Certificate: [][]byte{srvCert.Raw}, PrivateKey: srvKey})
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(cert *x509.Certificate, key *ecdsa.PrivateKey) (string, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		cfg := &tls.Config{RootCAs: roots}
+		// Send the certificate even if the server does not list its issuer as acceptable.
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+		}
+		c := http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := c.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		var b [128]byte
+		n, _ := resp.Body.Read(b[:])
+		return string(b[:n]), nil
+	}
+
+	clientUsage := x509.ExtKeyUsageClientAuth
+	a3, a3Key := newTestCert(t, leafTmpl(0x1a2b, testConfig().certEmail("a3"), clientUsage), inter, interKey)
+	ps, psKey := newTestCert(t, leafTmpl(0x1a2c, testConfig().certEmail("ps"), clientUsage), inter, interKey)
+	admin, adminKey := newTestCert(t, leafTmpl(0x1a2d, testConfig().certEmail(caAdminUID), clientUsage), root, rootKey)
+	adminByUser, adminByUserKey := newTestCert(t, leafTmpl(0x1a2e, testConfig().certEmail(caAdminUID), clientUsage), inter, interKey)
+	forged, forgedKey := newTestCert(t, leafTmpl(0x1a2f, testConfig().certEmail("a3"), clientUsage), other, otherKey)
+
+	tests := map[string]struct {
+		cert *x509.Certificate
+		key  *ecdsa.PrivateKey
+		want string
+	}{
+		"no certificate":           {nil, nil, "  false"},
+		"user":                     {a3, a3Key, "a3 1a:2b true"},
+		"other user by PKI of a3":  {ps, psKey, "  false"},
+		"admin":                    {admin, adminKey, "admin 1a:2d true"},
+		"admin issued by user PKI": {adminByUser, adminByUserKey, "  false"},
+	}
+	for name, tc := range tests {
+		got, err := get(tc.cert, tc.key)
+		if err != nil {
+			t.Errorf("%s: request failed. %v", name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", name, got, tc.want)
+		}
+	}
+	if _, err := get(forged, forgedKey); err == nil {
+		t.Error("Handshake with certificate of unknown CA succeeded.")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	argon2idPrefix = "$argon2id$"
+	legacySHA1Len  = 40 // hex encoded, unsalted SHA1 as found in imovies_users.dump
+)
+
+// passwordHasher produces self-describing encoded password hashes which can be stored in users.pwd.
+type passwordHasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// NeedsRehash reports whether encoded was produced by a different algorithm or with different
+	// parameters than the ones this hasher currently uses.
+	NeedsRehash(encoded string) bool
+}
+
+// NewPasswordHasher returns the hasher for the given algorithm, either "argon2id" or "bcrypt".
+func NewPasswordHasher(algorithm string) (passwordHasher, error) {
+	switch algorithm {
+	case "argon2id":
+		return &argon2idHasher{time: 3, memory: 64 * 1024, threads: 2, saltLen: 16, keyLen: 32}, nil
+	case "bcrypt":
+		return &bcryptHasher{cost: bcrypt.DefaultCost}, nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", algorithm)
+	}
+}
+
+// verifyPassword checks password against any hash format we have ever stored, i.e. argon2id, bcrypt
+// and the legacy unsalted SHA1 hashes.
+func verifyPassword(password, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return verifyArgon2id(password, encoded)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case isLegacySHA1(encoded):
+		h := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(strings.ToLower(encoded))) == 1, nil
+	default:
+		return false, fmt.Errorf("unknown password hash format")
+	}
+}
+
+func isLegacySHA1(encoded string) bool {
+	if len(encoded) != legacySHA1Len {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+// generatePassword returns a random password, e.g. for newly created users.
+func generatePassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// argon2idHasher encodes hashes in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32 // in KiB
+	threads uint8
+	saltLen int
+	keyLen  uint32
+}
+
+func (a *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.time, a.memory, a.threads, a.keyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argon2idHasher) NeedsRehash(encoded string) bool {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.time != a.time || p.memory != a.memory || p.threads != a.threads ||
+		len(p.salt) != a.saltLen || uint32(len(p.key)) != a.keyLen
+}
+
+type argon2idParams struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(encoded string) (argon2idParams, error) {
+	p := argon2idParams{}
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, fmt.Errorf("malformed argon2id version: %v", err)
+	}
+	if version != argon2.Version {
+		return p, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, fmt.Errorf("malformed argon2id parameters: %v", err)
+	}
+	var err error
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, fmt.Errorf("malformed argon2id salt: %v", err)
+	}
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, fmt.Errorf("malformed argon2id key: %v", err)
+	}
+	return p, nil
+}
+
+func verifyArgon2id(password, encoded string) (bool, error) {
+	p, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+// bcryptHasher uses the modular crypt format of golang.org/x/crypto/bcrypt: $2a$<cost>$<salt+hash>
+type bcryptHasher struct {
+	cost int
+}
+
+func (b *bcryptHasher) Hash(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+func (b *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.cost
+}
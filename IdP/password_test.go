@@ -0,0 +1,78 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]passwordHasher{
+		"argon2id": &argon2idHasher{time: 1, memory: 1024, threads: 1, saltLen: 16, keyLen: 32},
+		"bcrypt":   &bcryptHasher{cost: bcrypt.MinCost},
+	}
+	for name, h := range hashers {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := h.Hash("Astrid")
+			if err != nil {
+				t.Fatalf("Failed to hash password. %v", err)
+			}
+			other, err := h.Hash("Astrid")
+			if err != nil {
+				t.Fatalf("Failed to hash password. %v", err)
+			}
+			if encoded == other {
+				t.Error("Hashing the same password twice yielded the same hash, is the salt missing?")
+			}
+			ok, err := verifyPassword("Astrid", encoded)
+			if err != nil || !ok {
+				t.Errorf("Could not verify known good password. %v", err)
+			}
+			ok, err = verifyPassword("Astrid2", encoded)
+			if err != nil || ok {
+				t.Errorf("Verified wrong password. %v", err)
+			}
+			if h.NeedsRehash(encoded) {
+				t.Error("Freshly hashed password needs rehash.")
+			}
+		})
+	}
+}
+
+func TestPHCFormat(t *testing.T) {
+	h := &argon2idHasher{time: 1, memory: 1024, threads: 1, saltLen: 16, keyLen: 32}
+	encoded, err := h.Hash("Astrid")
+	if err != nil {
+		t.Fatalf("Failed to hash password. %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Unexpected encoding %s", encoded)
+	}
+	stronger := &argon2idHasher{time: 2, memory: 1024, threads: 1, saltLen: 16, keyLen: 32}
+	if !stronger.NeedsRehash(encoded) {
+		t.Error("Hash with outdated parameters does not need rehash.")
+	}
+	if !(&bcryptHasher{cost: bcrypt.MinCost}).NeedsRehash(encoded) {
+		t.Error("argon2id hash does not need rehash when switching to bcrypt.")
+	}
+}
+
+func TestLegacySHA1(t *testing.T) {
+	// Taken from imovies_users.dump, user a3.
+	legacy := "6b97f534c330b5cc78d4cc23e01e48be3377105b"
+	ok, err := verifyPassword("Astrid", legacy)
+	if err != nil || !ok {
+		t.Errorf("Could not verify legacy hash. %v", err)
+	}
+	ok, err = verifyPassword("Astrid2", legacy)
+	if err != nil || ok {
+		t.Errorf("Verified wrong password against legacy hash. %v", err)
+	}
+	h, _ := NewPasswordHasher("argon2id")
+	if !h.NeedsRehash(legacy) {
+		t.Error("Legacy hash does not need rehash.")
+	}
+	if _, err := verifyPassword("Astrid", "garbage"); err == nil {
+		t.Error("Expected an error for an unknown hash format.")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PKCS#12 (RFC 7292) encoding of a private key and its certificate chain, done in memory.
+//
+// The modern profile protects the key with PBES2 (PBKDF2 with HMAC-SHA256, AES-256-CBC) and uses
+// a SHA-256 MAC, as OpenSSL 3 does by default. The legacy profile uses
+// pbeWithSHAAnd3-KeyTripleDES-CBC and a SHA-1 MAC, which is what older clients, e.g. macOS
+// Keychain and Windows before Server 2019, understand. In both profiles only the key bag is
+// encrypted, the certificates are public anyway.
+const (
+	pkcs12Modern = "modern"
+	pkcs12Legacy = "legacy"
+
+	pkcs12Iterations = 100000
+	pkcs12SaltLen    = 16
+)
+
+var (
+	oidCertBag               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertTypeX509          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBES2                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256        = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidPBEWithSHAAnd3KeyTDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                  = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256                = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	asn1NULL                 = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe pkcs7ContentInfo
+	MacData  macData
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkixAlgorithm
+	Digest    []byte
+}
+
+type pkixAlgorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data asn1.RawValue
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkixAlgorithm
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkixAlgorithm
+	EncryptionScheme  pkixAlgorithm
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int `asn1:"optional"`
+	PRF        pkixAlgorithm
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// encodePKCS12 bundles key and certs, the first being the one of key, protected by password.
+func encodePKCS12(key interface{}, certs []*x509.Certificate, password string, profile string, friendlyName string) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	if profile != pkcs12Modern && profile != pkcs12Legacy {
+		return nil, fmt.Errorf("unknown pkcs12 profile %q", profile)
+	}
+	bmpPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha1.Sum(certs[0].Raw)
+	attrs, err := bagAttributes(keyID[:], friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Certificates
+	var certBags []safeBag
+	for i, c := range certs {
+		cb, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: explicitTag0(mustMarshal(c.Raw))})
+		if err != nil {
+			return nil, err
+		}
+		bag := safeBag{ID: oidCertBag, Value: explicitTag0(cb)}
+		if i == 0 {
+			bag.Attributes = attrs
+		}
+		certBags = append(certBags, bag)
+	}
+	certContents, err := asn1.Marshal(certBags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Private key
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var epki encryptedPrivateKeyInfo
+	if profile == pkcs12Modern {
+		epki, err = encryptPBES2([]byte(password), pkcs8)
+	} else {
+		epki, err = encryptPBEWithSHAAnd3KeyTDES(bmpPassword, pkcs8)
+	}
+	if err != nil {
+		return nil, err
+	}
+	epkiBytes, err := asn1.Marshal(epki)
+	if err != nil {
+		return nil, err
+	}
+	keyContents, err := asn1.Marshal([]safeBag{{ID: oidPKCS8ShroudedKeyBag, Value: explicitTag0(epkiBytes), Attributes: attrs}})
+	if err != nil {
+		return nil, err
+	}
+
+	authSafe, err := asn1.Marshal([]pkcs7ContentInfo{dataContentInfo(certContents), dataContentInfo(keyContents)})
+	if err != nil {
+		return nil, err
+	}
+
+	// MAC over the authenticated safe
+	salt := make([]byte, pkcs12SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	h, hashOID := sha256.New, oidSHA256
+	if profile == pkcs12Legacy {
+		h, hashOID = sha1.New, oidSHA1
+	}
+	macKey := pkcs12KDF(h, bmpPassword, salt, pkcs12Iterations, 3, h().Size())
+	mac := hmac.New(h, macKey)
+	mac.Write(authSafe)
+
+	return asn1.Marshal(pfxPDU{
+		Version:  3,
+		AuthSafe: dataContentInfo(authSafe),
+		MacData: macData{
+			Mac:        digestInfo{Algorithm: pkixAlgorithm{Algorithm: hashOID, Parameters: asn1NULL}, Digest: mac.Sum(nil)},
+			MacSalt:    salt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// explicitTag0 wraps DER encoded b into [0] EXPLICIT.
+func explicitTag0(b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b}
+}
+
+// mustMarshal marshals values which cannot fail to encode, such as byte slices and fixed structs.
+func mustMarshal(v interface{}) []byte {
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func dataContentInfo(content []byte) pkcs7ContentInfo {
+	return pkcs7ContentInfo{ContentType: oidPKCS7Data, Content: explicitTag0(mustMarshal(content))}
+}
+
+func bagAttributes(keyID []byte, friendlyName string) ([]pkcs12Attribute, error) {
+	id, err := asn1.Marshal(keyID)
+	if err != nil {
+		return nil, err
+	}
+	attrs := []pkcs12Attribute{{ID: oidLocalKeyID, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: id}}}
+	if friendlyName != "" {
+		name, err := bmpString(friendlyName)
+		if err != nil {
+			return nil, err
+		}
+		// Without the terminating zeros, which are only part of passwords.
+		v, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: 30, Bytes: name[:len(name)-2]})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, pkcs12Attribute{ID: oidFriendlyName, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: v}})
+	}
+	return attrs, nil
+}
+
+func encryptPBES2(password []byte, data []byte) (encryptedPrivateKeyInfo, error) {
+	salt := make([]byte, pkcs12SaltLen)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	key := pbkdf2.Key(password, salt, pkcs12Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkixAlgorithm{Algorithm: oidPBKDF2, Parameters: marshalRaw(pbkdf2Params{
+			Salt:       salt,
+			Iterations: pkcs12Iterations,
+			PRF:        pkixAlgorithm{Algorithm: oidHMACWithSHA256, Parameters: asn1NULL},
+		})},
+		EncryptionScheme: pkixAlgorithm{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	return encryptedPrivateKeyInfo{
+		Algorithm:     pkixAlgorithm{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encryptCBC(block, iv, data),
+	}, nil
+}
+
+func encryptPBEWithSHAAnd3KeyTDES(bmpPassword []byte, data []byte) (encryptedPrivateKeyInfo, error) {
+	salt := make([]byte, pkcs12SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	key := pkcs12KDF(sha1.New, bmpPassword, salt, pkcs12Iterations, 1, 24)
+	iv := pkcs12KDF(sha1.New, bmpPassword, salt, pkcs12Iterations, 2, des.BlockSize)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return encryptedPrivateKeyInfo{}, err
+	}
+	return encryptedPrivateKeyInfo{
+		Algorithm:     pkixAlgorithm{Algorithm: oidPBEWithSHAAnd3KeyTDES, Parameters: marshalRaw(pbeParams{Salt: salt, Iterations: pkcs12Iterations})},
+		EncryptedData: encryptCBC(block, iv, data),
+	}, nil
+}
+
+func marshalRaw(v interface{}) asn1.RawValue {
+	return asn1.RawValue{FullBytes: mustMarshal(v)}
+}
+
+// encryptCBC encrypts data with PKCS#7 padding.
+func encryptCBC(block cipher.Block, iv []byte, data []byte) []byte {
+	pad := block.BlockSize() - len(data)%block.BlockSize()
+	padded := make([]byte, len(data), len(data)+pad)
+	copy(padded, data)
+	for i := 0; i < pad; i++ {
+		padded = append(padded, byte(pad))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	return padded
+}
+
+// bmpString returns s as big endian UTF-16 with two terminating zero bytes, the password encoding
+// of RFC 7292 appendix B.1.
+func bmpString(s string) ([]byte, error) {
+	b := make([]byte, 0, 2*len(s)+2)
+	for _, r := range s {
+		if r > 0xffff {
+			return nil, fmt.Errorf("character %q cannot be encoded as BMPString", r)
+		}
+		for _, u := range utf16.Encode([]rune{r}) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+	}
+	return append(b, 0, 0), nil
+}
+
+// pkcs12KDF derives size bytes of key material as specified in RFC 7292 appendix B.2. id is 1 for
+// keys, 2 for IVs and 3 for MAC keys.
+func pkcs12KDF(h func() hash.Hash, password []byte, salt []byte, iterations int, id byte, size int) []byte {
+	const v = 64 // block size of SHA-1 and SHA-256
+
+	D := make([]byte, v)
+	for i := range D {
+		D[i] = id
+	}
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		n := v * ((len(b) + v - 1) / v)
+		out := make([]byte, n)
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	I := append(fill(salt), fill(password)...)
+
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < size {
+		hh := h()
+		hh.Write(D)
+		hh.Write(I)
+		A := hh.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			hh.Reset()
+			hh.Write(A)
+			A = hh.Sum(A[:0])
+		}
+		out = append(out, A...)
+		if len(out) >= size {
+			break
+		}
+		B := fill(A)
+		Bn := new(big.Int).SetBytes(B[:v])
+		Bn.Add(Bn, one)
+		for j := 0; j < len(I); j += v {
+			Ij := new(big.Int).SetBytes(I[j : j+v])
+			Ij.Add(Ij, Bn)
+			b := Ij.Bytes()
+			// Keep the lowest v bytes, dropping a carry or padding with leading zeros.
+			if len(b) > v {
+				b = b[len(b)-v:]
+			}
+			copy(I[j:j+v], make([]byte, v-len(b)))
+			copy(I[j+v-len(b):j+v], b)
+		}
+	}
+	return out[:size]
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// testCertificate returns a self-signed certificate of a3 and its key.
+func testCertificate(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate) {
+	cert, key := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: testConfig().certEmail("a3")}}, nil, nil)
+	return key, cert
+}
+
+func TestBMPString(t *testing.T) {
+	b, err := bmpString("Beavis")
+	if err != nil || hex.EncodeToString(b) != "0042006500610076006900730000" {
+		t.Errorf("Unexpected encoding %x. %v", b, err)
+	}
+	if _, err := bmpString("\U0001F600"); err == nil {
+		t.Error("Encoded a character outside of the BMP.")
+	}
+}
+
+// The legacy profile is what golang.org/x/crypto/pkcs12 decodes, which also checks pkcs12KDF.
+func TestPKCS12Legacy(t *testing.T) {
+	key, cert := testCertificate(t)
+	p12, err := encodePKCS12(key, []*x509.Certificate{cert}, "s3cr3t", pkcs12Legacy, "a3")
+	if err != nil {
+		t.Fatalf("Failed to encode. %v", err)
+	}
+	decKey, decCert, err := pkcs12.Decode(p12, "s3cr3t")
+	if err != nil {
+		t.Fatalf("Failed to decode. %v", err)
+	}
+	if !reflect.DeepEqual(decKey, key) || !decCert.Equal(cert) {
+		t.Error("Decoded bundle does not match.")
+	}
+	if _, _, err := pkcs12.Decode(p12, "wrong"); err == nil {
+		t.Error("Decoded with the wrong password.")
+	}
+}
+
+func TestPKCS12Modern(t *testing.T) {
+	key, cert := testCertificate(t)
+	p12, err := encodePKCS12(key, []*x509.Certificate{cert, cert}, "s3cr3t", pkcs12Modern, "a3")
+	if err != nil {
+		t.Fatalf("Failed to encode. %v", err)
+	}
+
+	var pfx pfxPDU
+	if _, err := asn1.Unmarshal(p12, &pfx); err != nil {
+		t.Fatalf("Failed to parse PFX. %v", err)
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		t.Fatalf("Failed to parse auth safe. %v", err)
+	}
+	pw, _ := bmpString("s3cr3t")
+	mac := hmac.New(sha256.New, pkcs12KDF(sha256.New, pw, pfx.MacData.MacSalt, pfx.MacData.Iterations, 3, 32))
+	mac.Write(authSafe)
+	if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA256) || !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Fatal("MAC does not verify.")
+	}
+
+	var contents []pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil || len(contents) != 2 {
+		t.Fatalf("Failed to parse contents. %v", err)
+	}
+	bags := func(ci pkcs7ContentInfo) []safeBag {
+		var data []byte
+		var bs []safeBag
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &data); err != nil {
+			t.Fatalf("Failed to parse content. %v", err)
+		}
+		if _, err := asn1.Unmarshal(data, &bs); err != nil {
+			t.Fatalf("Failed to parse bags. %v", err)
+		}
+		return bs
+	}
+	if n := len(bags(contents[0])); n != 2 {
+		t.Errorf("Got %d certificate bags, expected 2", n)
+	}
+	keyBags := bags(contents[1])
+	if len(keyBags) != 1 || !keyBags[0].ID.Equal(oidPKCS8ShroudedKeyBag) {
+		t.Fatalf("Unexpected key bags %v", keyBags)
+	}
+
+	var epki encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdf pbkdf2Params
+	var iv []byte
+	if _, err := asn1.Unmarshal(keyBags[0].Value.Bytes, &epki); err != nil {
+		t.Fatalf("Failed to parse key bag. %v", err)
+	}
+	if _, err := asn1.Unmarshal(epki.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatalf("Failed to parse PBES2 parameters. %v", err)
+	}
+	asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	block, _ := aes.NewCipher(pbkdf2.Key([]byte("s3cr3t"), kdf.Salt, kdf.Iterations, 32, sha256.New))
+	plain := make([]byte, len(epki.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, epki.EncryptedData)
+	want, _ := x509.MarshalPKCS8PrivateKey(key)
+	if !bytes.HasPrefix(plain, want) {
+		t.Error("Decrypted key does not match.")
+	}
+}
+
+func TestPKCS12Profile(t *testing.T) {
+	key, cert := testCertificate(t)
+	if _, err := encodePKCS12(key, []*x509.Certificate{cert}, "s3cr3t", "rc2", ""); err == nil {
+		t.Error("Accepted unknown profile.")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Names of the password rules, as reported to clients.
+const (
+	ruleMinLength       = "min_length"
+	ruleCharClasses     = "character_classes"
+	rulePersonalInfo    = "personal_info"
+	ruleHistory         = "history"
+	ruleBreached        = "breached"
+	ruleCurrentPassword = "current_password"
+)
+
+// passwordPolicy decides which passwords users may choose.
+type passwordPolicy struct {
+	MinLength int
+	// MinClasses is how many of lower case, upper case, digits and other characters must be used.
+	MinClasses int
+	// History is how many previous passwords, including the current one, may not be reused.
+	History int
+	// Breached is consulted if not nil.
+	Breached *breachedPasswords
+}
+
+type policyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// policyError is the body of 400 responses to requests with a password violating the policy.
+type policyError struct {
+	Error      string            `json:"error"`
+	Violations []policyViolation `json:"violations"`
+}
+
+// Check returns all rules password violates when chosen by u. The history is checked separately,
+// see checkPassword.
+func (p passwordPolicy) Check(password string, u User) ([]policyViolation, error) {
+	var vs []policyViolation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		vs = append(vs, policyViolation{ruleMinLength, fmt.Sprintf("Must be at least %d characters long.", p.MinLength)})
+	}
+	if passwordClasses(password) < p.MinClasses {
+		vs = append(vs, policyViolation{ruleCharClasses,
+			fmt.Sprintf("Must contain at least %d of lower case letters, upper case letters, digits and other characters.", p.MinClasses)})
+	}
+	lower := strings.ToLower(password)
+	for _, info := range []string{u.UserID, u.FirstName, u.LastName, u.FirstName + " " + u.LastName, u.Email, strings.Split(u.Email, "@")[0]} {
+		if info != "" && strings.ToLower(strings.TrimSpace(info)) == lower {
+			vs = append(vs, policyViolation{rulePersonalInfo, "Must not be your username, name or email address."})
+			break
+		}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			vs = append(vs, policyViolation{ruleBreached, "Has appeared in a data breach and must not be used."})
+		}
+	}
+	return vs, nil
+}
+
+func passwordClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// checkPassword checks password against the policy, including the history of the user.
+func (s server) checkPassword(ctx context.Context, u User, password string) ([]policyViolation, error) {
+	vs, err := s.policy.Check(password, u)
+	if err != nil {
+		return nil, err
+	}
+	if s.policy.History <= 0 {
+		return vs, nil
+	}
+	hashes, err := s.db.PasswordHistory(ctx, u.UserID, s.policy.History)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		if ok, _ := verifyPassword(password, h); ok {
+			vs = append(vs, policyViolation{ruleHistory, fmt.Sprintf("Must not be one of your last %d passwords.", s.policy.History)})
+			break
+		}
+	}
+	return vs, nil
+}
+
+// breachedPasswords looks passwords up in an offline copy of a breached password corpus, split
+// into k-anonymity ranges like the Pwned Passwords API: the directory contains one file per
+// 5 character prefix of the upper case hex SHA1 hash, named after the prefix with an optional .txt
+// suffix, listing the remaining 35 characters of every hash in the range as SUFFIX:COUNT lines.
+// Only the single range file of a password is read for every lookup.
+type breachedPasswords struct {
+	dir string
+}
+
+func newBreachedPasswords(dir string) (*breachedPasswords, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &breachedPasswords{dir: dir}, nil
+}
+
+// Contains reports whether password is in the corpus.
+func (b *breachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+	f, err := os.Open(filepath.Join(b.dir, prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(b.dir, prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+func (s server) writePolicyError(w http.ResponseWriter, vs []policyViolation) {
+	s.writeJSON(w, http.StatusBadRequest, policyError{Error: "password does not satisfy the policy", Violations: vs})
+}
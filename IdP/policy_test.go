@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func rules(vs []policyViolation) string {
+	var r []string
+	for _, v := range vs {
+		r = append(r, v.Rule)
+	}
+	return strings.Join(r, ",")
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := passwordPolicy{MinLength: 10, MinClasses: 3}
+	u := User{UserID: "a3", FirstName: "Andres Andrea", LastName: "Anderson", Email: "anderson@imovies.ch"}
+	for pw, want := range map[string]string{
+		"":                    "min_length,character_classes",
+		"short1A":             "min_length",
+		"alllowercase":        "character_classes",
+		"Correct horse 1":     "",
+		"Anderson@imovies.ch": rulePersonalInfo,
+		"ANDERSON@imovies.ch": rulePersonalInfo,
+		"äöüÄÖÜ12345":         "",
+	} {
+		vs, err := p.Check(pw, u)
+		if err != nil {
+			t.Fatalf("Failed to check password. %v", err)
+		}
+		if got := rules(vs); got != want {
+			t.Errorf("%q: got violations %q, expected %q", pw, got, want)
+		}
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idp-breached")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir. %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sum := sha1.Sum([]byte("Password123!"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	err = ioutil.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte("0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n"+hash[5:]+":42\r\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write range file. %v", err)
+	}
+	b, err := newBreachedPasswords(dir)
+	if err != nil {
+		t.Fatalf("Failed to open breached passwords. %v", err)
+	}
+	p := passwordPolicy{Breached: b}
+	if vs, _ := p.Check("Password123!", User{}); rules(vs) != ruleBreached {
+		t.Errorf("Breached password accepted: %v", vs)
+	}
+	if vs, err := p.Check("Password1234!", User{}); len(vs) != 0 || err != nil {
+		t.Errorf("Password rejected: %v %v", vs, err)
+	}
+}
+
+func TestPasswordHistoryPolicy(t *testing.T) {
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, err := NewStorage("memory://?seed="+usersDump, hasher)
+	if err != nil {
+		t.Fatalf("Failed to create storage. %v", err)
+	}
+	ctx := context.Background()
+	s := server{db: db, policy: passwordPolicy{History: 2}}
+	u, _ := db.GetUser(ctx, "a3")
+	db.ChangePassword(ctx, "a3", "first")
+	db.ChangePassword(ctx, "a3", "second")
+	for pw, want := range map[string]string{"second": ruleHistory, "first": ruleHistory, "third": ""} {
+		vs, err := s.checkPassword(ctx, u, pw)
+		if err != nil {
+			t.Fatalf("Failed to check password. %v", err)
+		}
+		if got := rules(vs); got != want {
+			t.Errorf("%q: got violations %q, expected %q", pw, got, want)
+		}
+	}
+	db.ChangePassword(ctx, "a3", "third")
+	if vs, _ := s.checkPassword(ctx, u, "first"); len(vs) != 0 {
+		t.Errorf("Password older than the history rejected: %v", vs)
+	}
+}
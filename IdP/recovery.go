@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Escrowed keys are recovered in two steps: the user asks for the key of a certificate, and once the
+// request has been approved, by a CA administrator or automatically if approval is not required,
+// downloads it once as PKCS#12 with an export password of their choice. Every step is recorded in
+// the audit log.
+const (
+	recoveryPending   = "pending"
+	recoveryApproved  = "approved"
+	recoveryRejected  = "rejected"
+	recoveryCompleted = "completed"
+
+	auditRecoveryRequested = "key_recovery_requested"
+	auditRecoveryApproved  = "key_recovery_approved"
+	auditRecoveryRejected  = "key_recovery_rejected"
+	auditRecoveryCompleted = "key_recovery_completed"
+
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type recoveryRequest struct {
+	ID          int64      `json:"id"`
+	UserID      string     `json:"uid"`
+	Serial      string     `json:"serial"`
+	Status      string     `json:"status"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	DecidedBy   string     `json:"decidedBy,omitempty"`
+	DecidedAt   *time.Time `json:"decidedAt,omitempty"`
+}
+
+// auditEvent records who did what concerning which user.
+type auditEvent struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	UserID     string    `json:"uid"`
+	Action     string    `json:"action"`
+	Detail     string    `json:"detail,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+}
+
+// audit records an event. Failures are logged, the action has already happened anyway.
+func (s server) audit(r *http.Request, actor string, uid string, action string, detail string) {
+	err := s.db.AddAuditEvent(r.Context(), auditEvent{
+		Time:       time.Now(),
+		Actor:      actor,
+		UserID:     uid,
+		Action:     action,
+		Detail:     detail,
+		RemoteAddr: s.clientIP(r),
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"actor": actor, "uid": uid, "action": action}).Error("Failed to write audit log.")
+	}
+}
+
+// RequestKeyRecovery asks for the escrowed key of a certificate of the authenticated user.
+func (s server) RequestKeyRecovery(w http.ResponseWriter, r *http.Request) {
+	id, vc, ok := s.userVault(w, r)
+	if !ok {
+		return
+	}
+	c, _, ok := s.readUserCert(w, r, vc, id)
+	if !ok {
+		return
+	}
+	l := log.WithFields(log.Fields{"uid": id, "serial": c.Serial})
+	if _, err := s.vault.ReadEscrowedKey(r.Context(), id, c.Serial); err != nil {
+		if err == errKeyNotEscrowed {
+			http.Error(w, "The key of this certificate has not been escrowed.", http.StatusNotFound)
+			return
+		}
+		s.httpInternalError(w, fmt.Errorf("failed to read escrowed key"))
+		return
+	}
+	open, err := s.db.ListRecoveryRequests(r.Context(), id, "")
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	for _, req := range open {
+		if req.Serial == c.Serial && (req.Status == recoveryPending || req.Status == recoveryApproved) {
+			http.Error(w, fmt.Sprintf("There already is an open request %d for this key.", req.ID), http.StatusConflict)
+			return
+		}
+	}
+
+	now := time.Now()
+	req := recoveryRequest{UserID: id, Serial: c.Serial, Status: recoveryPending, RequestedAt: now}
+	if !s.recoveryApproval {
+		req.Status = recoveryApproved
+	}
+	req.ID, err = s.db.CreateRecoveryRequest(r.Context(), req)
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	s.audit(r, id, id, auditRecoveryRequested, fmt.Sprintf("request %d for serial %s", req.ID, c.Serial))
+	l.WithField("status", req.Status).Info("Key recovery requested.")
+	s.writeJSON(w, http.StatusCreated, req)
+}
+
+// ListKeyRecoveries lists the key recovery requests of the authenticated user.
+func (s server) ListKeyRecoveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	reqs, err := s.db.ListRecoveryRequests(r.Context(), id, "")
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, reqs)
+}
+
+// recoveryRequestFromPath returns the request with the id of the path. On failure the response
+// has already been written and ok is false.
+func (s server) recoveryRequestFromPath(w http.ResponseWriter, r *http.Request) (recoveryRequest, bool) {
+	rid, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		s.httpBadRequest(w, "invalid id")
+		return recoveryRequest{}, false
+	}
+	req, err := s.db.GetRecoveryRequest(r.Context(), rid)
+	if err == sql.ErrNoRows {
+		s.httpNotFound(w)
+		return recoveryRequest{}, false
+	}
+	if err != nil {
+		s.httpInternalError(w, err)
+		return recoveryRequest{}, false
+	}
+	return req, true
+}
+
+// RecoverKey returns the escrowed key of an approved request as PKCS#12, protected by the export
+// password of the body, see pkcs12Request. Every approval can only be used once.
+func (s server) RecoverKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	req, ok := s.recoveryRequestFromPath(w, r)
+	if !ok {
+		return
+	}
+	if req.UserID != id {
+		s.httpNotFound(w)
+		return
+	}
+	if req.Status != recoveryApproved {
+		http.Error(w, fmt.Sprintf("The request is %s.", req.Status), http.StatusConflict)
+		return
+	}
+	exp, ok := s.readPKCS12Request(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithFields(log.Fields{"uid": id, "serial": req.Serial, "request": req.ID})
+
+	ic, err := s.vault.ReadEscrowedKey(r.Context(), id, req.Serial)
+	if err != nil {
+		l.WithError(err).Error("Failed to read escrowed key.")
+		s.httpInternalError(w, fmt.Errorf("failed to read escrowed key"))
+		return
+	}
+	p12, err := ic.pkcs12(exp.Password, exp.Profile, s.cfg.certEmail(id))
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	err = s.db.UpdateRecoveryRequest(r.Context(), req.ID, recoveryApproved, recoveryCompleted, "", time.Now())
+	if err == sql.ErrNoRows {
+		http.Error(w, "The request has already been used.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	s.audit(r, id, id, auditRecoveryCompleted, fmt.Sprintf("request %d for serial %s", req.ID, req.Serial))
+	l.Info("Recovered escrowed key.")
+	writePKCS12(w, p12)
+}
+
+// AdminListKeyRecoveries lists the key recovery requests of all users, optionally only those with
+// ?status=.
+func (s server) AdminListKeyRecoveries(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticateCAAdmin(w, r); !ok {
+		return
+	}
+	reqs, err := s.db.ListRecoveryRequests(r.Context(), r.URL.Query().Get("uid"), r.URL.Query().Get("status"))
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, reqs)
+}
+
+// AdminDecideKeyRecovery returns a handler approving or rejecting a pending key recovery request.
+func (s server) AdminDecideKeyRecovery(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := s.authenticateCAAdmin(w, r)
+		if !ok {
+			return
+		}
+		req, ok := s.recoveryRequestFromPath(w, r)
+		if !ok {
+			return
+		}
+		status, action := recoveryRejected, auditRecoveryRejected
+		if approve {
+			status, action = recoveryApproved, auditRecoveryApproved
+		}
+		err := s.db.UpdateRecoveryRequest(r.Context(), req.ID, recoveryPending, status, admin, time.Now())
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("The request is %s.", req.Status), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			s.httpInternalError(w, err)
+			return
+		}
+		s.audit(r, admin, req.UserID, action, fmt.Sprintf("request %d for serial %s", req.ID, req.Serial))
+		log.WithFields(log.Fields{"admin": admin, "uid": req.UserID, "request": req.ID, "status": status}).Info("Decided key recovery request.")
+		req, _ = s.db.GetRecoveryRequest(r.Context(), req.ID)
+		s.writeJSON(w, http.StatusOK, req)
+	}
+}
+
+// AdminAuditLog returns the newest entries of the audit log, optionally only those concerning
+// ?uid=, at most ?limit=.
+func (s server) AdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticateCAAdmin(w, r); !ok {
+		return
+	}
+	limit, err := queryInt(r.URL.Query().Get("limit"), defaultAuditLimit)
+	if err != nil || limit < 1 || limit > maxAuditLimit {
+		s.httpBadRequest(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit))
+		return
+	}
+	events, err := s.db.ListAuditEvents(r.Context(), r.URL.Query().Get("uid"), limit)
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, events)
+}
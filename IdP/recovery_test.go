@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/pkcs12"
+)
+
+func TestKeyRecovery(t *testing.T) {
+	key, cert := testCertificate(t)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	v := &fakeVault{
+		certs: map[string][]vaultCert{"a3": {
+			{Serial: "01", Certificate: certPEM},
+			{Serial: "02", Certificate: certPEM},
+		}},
+		escrow: map[string]issuedCert{"a3/01": {
+			signedCert: signedCert{Certificate: certPEM, Serial: "01"},
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		}},
+	}
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, _ := NewStorage("memory://?seed="+usersDump, hasher)
+	s := server{db: db, vault: v, auth: staticValidator{}, recoveryApproval: true,
+		vaultForUser: func(uid string, authHeader string) (certVault, error) { return v, nil }}
+	r := mux.NewRouter()
+	r.HandleFunc("/certs/{serial}/recovery", s.RequestKeyRecovery).Methods(http.MethodPost)
+	r.HandleFunc("/recovery/{id}/pkcs12", s.RecoverKey).Methods(http.MethodPost)
+	r.HandleFunc("/admin/recovery/{id}/approve", s.AdminDecideKeyRecovery(true)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/audit", s.AdminAuditLog).Methods(http.MethodGet)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(authorization, token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodPost, "/certs/02/recovery", "Bearer a3", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without escrowed key, got %d", w.Code)
+	}
+	w := do(http.MethodPost, "/certs/01/recovery", "Bearer a3", "")
+	var req recoveryRequest
+	if err := json.Unmarshal(w.Body.Bytes(), &req); w.Code != http.StatusCreated || err != nil {
+		t.Fatalf("Failed to request recovery: %d %s", w.Code, w.Body.String())
+	}
+	if req.Status != recoveryPending {
+		t.Errorf("Unexpected status %s", req.Status)
+	}
+	if w := do(http.MethodPost, "/certs/01/recovery", "Bearer a3", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a second request, got %d", w.Code)
+	}
+
+	body := `{"password":"s3cr3t","profile":"legacy"}`
+	if w := do(http.MethodPost, "/recovery/1/pkcs12", "Bearer a3", body); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 before approval, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/admin/recovery/1/approve", "Bearer a3", ""); w.Code != http.StatusForbidden {
+		t.Errorf("User approved own request: %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/admin/recovery/1/approve", "Bearer admin", ""); w.Code != http.StatusOK {
+		t.Fatalf("Failed to approve: %d %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodPost, "/recovery/1/pkcs12", "Bearer ps", body); w.Code != http.StatusNotFound {
+		t.Errorf("Other user recovered the key: %d", w.Code)
+	}
+	w = do(http.MethodPost, "/recovery/1/pkcs12", "Bearer a3", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to recover key: %d %s", w.Code, w.Body.String())
+	}
+	if _, c, err := pkcs12.Decode(w.Body.Bytes(), "s3cr3t"); err != nil || !c.Equal(cert) {
+		t.Errorf("Failed to decode recovered key. %v", err)
+	}
+	if w := do(http.MethodPost, "/recovery/1/pkcs12", "Bearer a3", body); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a used request, got %d", w.Code)
+	}
+
+	w = do(http.MethodGet, "/admin/audit?uid=a3", "Bearer admin", "")
+	var events []auditEvent
+	json.Unmarshal(w.Body.Bytes(), &events)
+	var actions []string
+	for _, e := range events {
+		actions = append(actions, e.Actor+":"+e.Action)
+	}
+	if strings.Join(actions, ",") != "a3:key_recovery_completed,admin:key_recovery_approved,a3:key_recovery_requested" {
+		t.Errorf("Unexpected audit log %v", actions)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	resetTokenTTL = time.Hour
+
+	resetMsgSent    = "If the account exists, a link to reset its password has been sent to its email address."
+	resetMsgInvalid = "This link is invalid or has expired. Please request a new one."
+	resetMsgDone    = "Your password has been changed. You can now log in with the new password."
+)
+
+// generateToken returns a random token to be handed out and the hash to store.
+func generateToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (s server) renderMessage(w http.ResponseWriter, msg string) {
+	err := s.templateMessage.Execute(w, map[string]interface{}{
+		"Message": msg,
+	})
+	if err != nil {
+		s.httpInternalError(w, err)
+	}
+}
+
+func (s server) renderForgot(w http.ResponseWriter, errMsg string) {
+	err := s.templateForgot.Execute(w, map[string]interface{}{
+		"Error": errMsg,
+	})
+	if err != nil {
+		s.httpInternalError(w, err)
+	}
+}
+
+func (s server) renderReset(w http.ResponseWriter, token string, errMsg string, vs ...policyViolation) {
+	err := s.templateReset.Execute(w, map[string]interface{}{
+		"Token":      token,
+		"Error":      errMsg,
+		"Violations": vs,
+	})
+	if err != nil {
+		s.httpInternalError(w, err)
+	}
+}
+
+// ForgotPassword asks for a username and mails a reset link to the address of the account. The
+// answer is the same whether the account exists or not.
+func (s server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.renderForgot(w, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.httpBadRequest(w, "invalid form")
+		return
+	}
+	username := r.FormValue("username")
+	l := log.WithField("username", username)
+	if username == "" {
+		s.renderForgot(w, "Please enter your username.")
+		return
+	}
+	// Limits how many mails an address can trigger, AllowMail below how many an account gets.
+	if !s.throttle.Allow(username, s.clientIP(r)) {
+		l.Warn("Password reset throttled.")
+		s.renderForgot(w, loginErrThrottled)
+		return
+	}
+
+	u, err := s.db.GetUser(r.Context(), username)
+	if err == sql.ErrNoRows || (err == nil && (u.Disabled || u.Email == "")) {
+		l.Info("Password reset requested for unknown, disabled or unreachable user.")
+		s.renderMessage(w, resetMsgSent)
+		return
+	}
+	if err != nil {
+		l.WithError(err).Error("Failed to get user.")
+		s.httpInternalError(w, fmt.Errorf("failed to reset password"))
+		return
+	}
+	// Same answer as when the mail is sent, so that the limit does not reveal the account.
+	if !s.throttle.AllowMail(u.UserID) {
+		l.Warn("Too many password reset mails.")
+		s.renderMessage(w, resetMsgSent)
+		return
+	}
+	token, hash, err := generateToken()
+	if err != nil {
+		s.httpInternalError(w, err)
+		return
+	}
+	err = s.db.CreateResetToken(r.Context(), u.UserID, hash, time.Now().Add(resetTokenTTL))
+	if err != nil {
+		l.WithError(err).Error("Failed to store reset token.")
+		s.httpInternalError(w, fmt.Errorf("failed to reset password"))
+		return
+	}
+	link := s.publicURL + "/password/reset?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hello %s\n\n"+
+		"Someone, hopefully you, asked to reset the password of your account %s. To choose a new password, open\n\n"+
+		"%s\n\n"+
+		"The link is valid for %v and can only be used once. If you did not ask for this, you can ignore this mail.\n",
+		u.FirstName, u.UserID, link, resetTokenTTL)
+	err = s.mailer.Send(u.Email, "Reset your fadalax SSO password", body)
+	if err != nil {
+		// Do not tell the user, this would reveal that the account exists.
+		l.WithError(err).Error("Failed to send reset mail.")
+	} else {
+		l.Info("Sent password reset mail.")
+	}
+	s.renderMessage(w, resetMsgSent)
+}
+
+// ResetPassword shows the form to choose a new password and sets it, if the token is valid.
+func (s server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		token := r.URL.Query().Get("token")
+		if _, err := s.db.ResetTokenUser(r.Context(), hashToken(token), time.Now()); err != nil {
+			if err != sql.ErrNoRows {
+				log.WithError(err).Error("Failed to look up reset token.")
+			}
+			s.renderMessage(w, resetMsgInvalid)
+			return
+		}
+		s.renderReset(w, token, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.httpBadRequest(w, "invalid form")
+		return
+	}
+	token := r.FormValue("token")
+	password := r.FormValue("password")
+	if password == "" {
+		s.renderReset(w, token, "Please choose a password.")
+		return
+	}
+	if password != r.FormValue("confirm") {
+		s.renderReset(w, token, "The passwords do not match.")
+		return
+	}
+
+	// Check the policy before using up the token, so that the user can try again.
+	uid, err := s.db.ResetTokenUser(r.Context(), hashToken(token), time.Now())
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).Error("Failed to look up reset token.")
+		}
+		s.renderMessage(w, resetMsgInvalid)
+		return
+	}
+	l := log.WithField("uid", uid)
+	u, err := s.db.GetUser(r.Context(), uid)
+	var vs []policyViolation
+	if err == nil {
+		vs, err = s.checkPassword(r.Context(), u, password)
+	}
+	if err != nil {
+		l.WithError(err).Error("Failed to check password policy.")
+		s.httpInternalError(w, fmt.Errorf("failed to reset password"))
+		return
+	}
+	if len(vs) > 0 {
+		s.renderReset(w, token, "The password does not satisfy the policy.", vs...)
+		return
+	}
+
+	_, err = s.db.UseResetToken(r.Context(), hashToken(token), time.Now())
+	if err != nil {
+		if err != sql.ErrNoRows {
+			l.WithError(err).Error("Failed to use reset token.")
+		}
+		s.renderMessage(w, resetMsgInvalid)
+		return
+	}
+	err = s.db.ChangePassword(r.Context(), uid, password)
+	if err != nil {
+		l.WithError(err).Error("Failed to change password.")
+		s.httpInternalError(w, fmt.Errorf("failed to reset password"))
+		return
+	}
+	s.throttle.Unlock(uid)
+	l.Info("Reset password.")
+	s.renderMessage(w, resetMsgDone)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatMail(t *testing.T) {
+	m := string(formatMail("sso@fadalax.tech", "a3@imovies.ch", "Hi\r\nBcc: evil@example.com", "line 1\nline 2"))
+	if strings.Contains(m, "\r\nBcc:") {
+		t.Errorf("Header injection possible:\n%s", m)
+	}
+	if !strings.HasSuffix(m, "\r\n\r\nline 1\r\nline 2") {
+		t.Errorf("Unexpected body:\n%s", m)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idp-reset")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir. %v", err)
+	}
+	defer os.RemoveAll(dir)
+	mails := filepath.Join(dir, "mails")
+	m, err := NewMailer("file://" + mails)
+	if err != nil {
+		t.Fatalf("Failed to create mailer. %v", err)
+	}
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, err := NewStorage("memory://?seed="+usersDump, hasher)
+	if err != nil {
+		t.Fatalf("Failed to create storage. %v", err)
+	}
+	s := server{
+		db:              db,
+		mailer:          m,
+		publicURL:       "https://idp.example.com",
+		throttle:        newLoginThrottle(5, time.Minute, time.Second),
+		policy:          passwordPolicy{MinLength: 10, MinClasses: 2, History: 2},
+		templateForgot:  template.Must(template.ParseFiles("./template/forgot.html")),
+		templateReset:   template.Must(template.ParseFiles("./template/reset.html")),
+		templateMessage: template.Must(template.ParseFiles("./template/message.html")),
+	}
+	post := func(h http.HandlerFunc, form url.Values) string {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Body.String()
+	}
+
+	if body := post(s.ForgotPassword, url.Values{"username": {"nobody"}}); !strings.Contains(body, resetMsgSent) {
+		t.Errorf("Unexpected answer for unknown user: %s", body)
+	}
+	post(s.ForgotPassword, url.Values{"username": {"a3"}})
+	post(s.ForgotPassword, url.Values{"username": {"a3"}})
+	mail, err := ioutil.ReadFile(mails)
+	if err != nil {
+		t.Fatalf("No mail sent. %v", err)
+	}
+	links := regexp.MustCompile(`https://idp\.example\.com/password/reset\?token=([\w-]+)`).FindAllStringSubmatch(string(mail), -1)
+	if len(links) != 2 || !strings.Contains(string(mail), "To: anderson@imovies.ch") {
+		t.Fatalf("Unexpected mails:\n%s", mail)
+	}
+	token := links[0][1]
+
+	w := httptest.NewRecorder()
+	s.ResetPassword(w, httptest.NewRequest(http.MethodGet, "/password/reset?token="+token, nil))
+	if !strings.Contains(w.Body.String(), `name="token" value="`+token+`"`) {
+		t.Errorf("Reset form not shown: %s", w.Body.String())
+	}
+	if body := post(s.ResetPassword, url.Values{"token": {token}, "password": {"new password"}, "confirm": {"typo"}}); !strings.Contains(body, "do not match") {
+		t.Errorf("Mismatching passwords accepted: %s", body)
+	}
+	if body := post(s.ResetPassword, url.Values{"token": {token}, "password": {"short"}, "confirm": {"short"}}); !strings.Contains(body, "at least 10 characters") {
+		t.Errorf("Password violating the policy accepted: %s", body)
+	}
+	if body := post(s.ResetPassword, url.Values{"token": {token}, "password": {"new password"}, "confirm": {"new password"}}); !strings.Contains(body, resetMsgDone) {
+		t.Errorf("Password not reset: %s", body)
+	}
+	if !db.Login(context.Background(), "a3", "new password") {
+		t.Error("Cannot log in with new password.")
+	}
+	for _, tok := range []string{token, links[1][1]} {
+		if body := post(s.ResetPassword, url.Values{"token": {tok}, "password": {"x"}, "confirm": {"x"}}); !strings.Contains(body, resetMsgInvalid) {
+			t.Errorf("Token still valid after reset: %s", body)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+const maxOCSPRequestSize = 10 << 10
+
+// revocationCache keeps the revocation status of all certificates issued by the user PKIs, their
+// CRLs and a delegated OCSP responder per PKI in memory. It is refreshed from Vault in the
+// background, so that revocation checks neither need Vault access nor wait for it.
+type revocationCache struct {
+	vault vaultClient
+	db    storageClient
+	// interval between refreshes. Answers are considered stale after 3 intervals, see staleAt.
+	interval     time.Duration
+	responderTTL time.Duration
+	now          func() time.Time
+
+	mu      sync.RWMutex
+	updated time.Time
+	issuers map[string]*issuerState // by uid
+}
+
+type issuerState struct {
+	uid    string
+	cert   *x509.Certificate
+	crl    []byte
+	status map[string]certStatus // by serial as formatted by formatSerial
+
+	responder    *x509.Certificate
+	responderKey crypto.Signer
+}
+
+type certStatus struct {
+	revokedAt time.Time
+	reason    int
+}
+
+func newRevocationCache(v vaultClient, db storageClient, interval time.Duration, responderTTL time.Duration) *revocationCache {
+	return &revocationCache{
+		vault:        v,
+		db:           db,
+		interval:     interval,
+		responderTTL: responderTTL,
+		now:          time.Now,
+		issuers:      map[string]*issuerState{},
+	}
+}
+
+// Run refreshes the cache every interval until ctx is done.
+func (c *revocationCache) Run(ctx context.Context) {
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		if err := c.Refresh(ctx); err != nil {
+			log.WithError(err).Error("Failed to refresh revocation cache.")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Refresh reloads the certificates and CRLs of all user PKIs. Responder certificates are reused
+// until half of their lifetime is over.
+func (c *revocationCache) Refresh(ctx context.Context) error {
+	names, err := c.vault.ListUserPKIs()
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	old := c.issuers
+	c.mu.RUnlock()
+
+	now := c.now()
+	issuers := map[string]*issuerState{}
+	for _, name := range names {
+		if is := c.reload(ctx, name, old[name], now); is != nil {
+			issuers[name] = is
+		}
+	}
+
+	c.mu.Lock()
+	c.issuers = issuers
+	c.updated = now
+	c.mu.Unlock()
+	log.WithField("pkis", len(issuers)).Debug("Refreshed revocation cache.")
+	return nil
+}
+
+// RefreshIssuer reloads a single PKI, e.g. after certificates have been revoked.
+func (c *revocationCache) RefreshIssuer(ctx context.Context, name string) {
+	c.mu.RLock()
+	old := c.issuers[name]
+	c.mu.RUnlock()
+	is := c.reload(ctx, name, old, c.now())
+	if is == nil {
+		return
+	}
+	c.mu.Lock()
+	c.issuers[name] = is
+	c.mu.Unlock()
+}
+
+// reload loads a PKI. If that fails, old is returned.
+func (c *revocationCache) reload(ctx context.Context, name string, old *issuerState, now time.Time) *issuerState {
+	is, err := c.loadIssuer(ctx, name)
+	if err != nil {
+		log.WithError(err).WithField("uid", name).Error("Failed to load PKI, keeping old state.")
+		return old
+	}
+	if old != nil && old.responder != nil && old.cert.Equal(is.cert) &&
+		now.Before(old.responder.NotBefore.Add(old.responder.NotAfter.Sub(old.responder.NotBefore)/2)) {
+		is.responder, is.responderKey = old.responder, old.responderKey
+	} else if err := c.newResponder(ctx, is); err != nil {
+		log.WithError(err).WithField("uid", name).Error("Failed to create OCSP responder certificate.")
+		if old != nil && old.responder != nil && old.cert.Equal(is.cert) && now.Before(old.responder.NotAfter) {
+			is.responder, is.responderKey = old.responder, old.responderKey
+		}
+	}
+	return is
+}
+
+func (c *revocationCache) loadIssuer(ctx context.Context, name string) (*issuerState, error) {
+	der, err := c.vault.ReadIssuer(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := c.vault.ReadCRL(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := c.vault.ListCerts(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	reasons, err := c.db.RevocationReasons(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	is := &issuerState{uid: name, cert: ca, crl: crl, status: map[string]certStatus{}}
+	for _, vc := range certs {
+		if err := is.add(vc, reasons); err != nil {
+			log.WithError(err).WithFields(log.Fields{"uid": name, "serial": vc.Serial}).Warn("Skipping unparsable certificate.")
+		}
+	}
+	return is, nil
+}
+
+// add records the status of a certificate. The responder certificates of earlier runs are skipped.
+// Must not be called concurrently with readers.
+func (is *issuerState) add(vc vaultCert, reasons map[string]int) error {
+	b, _ := pem.Decode([]byte(vc.Certificate))
+	if b == nil {
+		return fmt.Errorf("certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return err
+	}
+	if isOCSPResponder(cert) {
+		return nil
+	}
+	serial := formatSerial(cert.SerialNumber)
+	is.status[serial] = certStatus{revokedAt: vc.RevokedAt, reason: reasons[serial]}
+	return nil
+}
+
+// newResponder creates a key and has the PKI sign a delegated OCSP responder certificate for it.
+// The key never leaves memory.
+func (c *revocationCache) newResponder(ctx context.Context, is *issuerState) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: fmt.Sprintf("OCSP responder for %s", is.cert.Subject.CommonName)},
+	}, key)
+	if err != nil {
+		return err
+	}
+	p, err := c.vault.SignOCSPResponder(ctx, is.uid, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})), c.responderTTL)
+	if err != nil {
+		return err
+	}
+	b, _ := pem.Decode([]byte(p))
+	if b == nil {
+		return fmt.Errorf("responder certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return err
+	}
+	is.responder, is.responderKey = cert, key
+	return nil
+}
+
+// staleAt is when the last refresh can no longer be relied upon. OCSP responses are valid until
+// then, so that they never expire while they are still served.
+func (c *revocationCache) staleAt() time.Time {
+	return c.updated.Add(3 * c.interval)
+}
+
+// fresh reports whether the cache has been refreshed recently enough to be relied upon.
+func (c *revocationCache) fresh(now time.Time) bool {
+	return !c.updated.IsZero() && now.Before(c.staleAt())
+}
+
+// Status returns the status of a certificate of the PKI of uid. ok is false if the cache is stale
+// or does not know the certificate, in which case Vault has to be asked.
+func (c *revocationCache) Status(uid string, serial string) (st certStatus, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.fresh(c.now()) {
+		return certStatus{}, false
+	}
+	is, ok := c.issuers[uid]
+	if !ok {
+		return certStatus{}, false
+	}
+	st, ok = is.status[serial]
+	return st, ok
+}
+
+// Issuer returns the CA certificate of the PKI of uid, or nil if it is not known.
+func (c *revocationCache) Issuer(uid string) *x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if is, ok := c.issuers[uid]; ok {
+		return is.cert
+	}
+	return nil
+}
+
+// Issuers returns the CA certificates of all known user PKIs.
+func (c *revocationCache) Issuers() []*x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	certs := make([]*x509.Certificate, 0, len(c.issuers))
+	for _, is := range c.issuers {
+		certs = append(certs, is.cert)
+	}
+	return certs
+}
+
+// formatSerial formats a serial number like Vault does, as lower case hex bytes separated by colons.
+func formatSerial(n *big.Int) string {
+	b := n.Bytes()
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = hex.EncodeToString(b[i : i+1])
+	}
+	return strings.Join(parts, ":")
+}
+
+// CRL returns the CRLs of all user PKIs as PEM, which is what nginx expects for ssl_crl, or for
+// /crl/{uid} the DER encoded CRL of a single PKI.
+func (s server) CRL(w http.ResponseWriter, r *http.Request) {
+	c := s.revocations
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.updated.IsZero() {
+		http.Error(w, "CRLs have not been loaded yet.", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Last-Modified", c.updated.UTC().Format(http.TimeFormat))
+	if uid := mux.Vars(r)["uid"]; uid != "" {
+		is, ok := c.issuers[uid]
+		if !ok {
+			s.httpNotFound(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(is.crl)
+		return
+	}
+	var buf bytes.Buffer
+	for _, uid := range sortedKeys(c.issuers) {
+		pem.Encode(&buf, &pem.Block{Type: "X509 CRL", Bytes: c.issuers[uid].crl})
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(buf.Bytes())
+}
+
+func sortedKeys(m map[string]*issuerState) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// OCSP answers RFC 6960 requests, either POSTed or base64 encoded in the path of a GET, for
+// certificates of all user PKIs. Responses are signed by the delegated responder of the PKI.
+func (s server) OCSP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+	if r.Method == http.MethodPost {
+		der, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOCSPRequestSize))
+	} else {
+		var p string
+		p, err = url.PathUnescape(mux.Vars(r)["request"])
+		if err == nil {
+			der, err = base64.StdEncoding.DecodeString(p)
+		}
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	resp, maxAge, err := s.revocations.respond(req)
+	if err != nil {
+		log.WithError(err).Error("Failed to create OCSP response.")
+		w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", int(maxAge.Seconds())))
+	}
+	w.Write(resp)
+}
+
+// respond creates the response to req and returns how long it may be cached.
+func (c *revocationCache) respond(req *ocsp.Request) ([]byte, time.Duration, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := c.now()
+	if !c.fresh(now) {
+		return ocsp.TryLaterErrorResponse, 0, nil
+	}
+	is := c.issuerOf(req)
+	if is == nil || is.responder == nil || now.After(is.responder.NotAfter) {
+		return ocsp.UnauthorizedErrorResponse, 0, nil
+	}
+	tmpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   c.updated,
+		NextUpdate:   c.staleAt(),
+		Certificate:  is.responder,
+		IssuerHash:   req.HashAlgorithm,
+	}
+	st, ok := is.status[formatSerial(req.SerialNumber)]
+	switch {
+	case !ok:
+		tmpl.Status = ocsp.Unknown
+	case !st.revokedAt.IsZero():
+		tmpl.Status = ocsp.Revoked
+		tmpl.RevokedAt = st.revokedAt
+		tmpl.RevocationReason = st.reason
+	}
+	resp, err := ocsp.CreateResponse(is.cert, is.responder, tmpl, is.responderKey)
+	return resp, tmpl.NextUpdate.Sub(now), err
+}
+
+// issuerOf returns the PKI the request is for. Must be called with mu held.
+func (c *revocationCache) issuerOf(req *ocsp.Request) *issuerState {
+	if !req.HashAlgorithm.Available() {
+		return nil
+	}
+	for _, is := range c.issuers {
+		var spki struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}
+		if _, err := asn1.Unmarshal(is.cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+			continue
+		}
+		h := req.HashAlgorithm.New()
+		h.Write(spki.PublicKey.RightAlign())
+		if !bytes.Equal(h.Sum(nil), req.IssuerKeyHash) {
+			continue
+		}
+		h.Reset()
+		h.Write(is.cert.RawSubject)
+		if bytes.Equal(h.Sum(nil), req.IssuerNameHash) {
+			return is
+		}
+	}
+	return nil
+}
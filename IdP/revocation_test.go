@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRevocationCache(t *testing.T) {
+	ca, caKey := newTestCert(t, caTemplate(1000, "a3.fadalax.tech"), nil, nil)
+	leaf := func(serial int64) *x509.Certificate {
+		return &x509.Certificate{SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: testConfig().certEmail("a3")}}
+	}
+	good, _ := newTestCert(t, leaf(1), ca, caKey)
+	revoked, _ := newTestCert(t, leaf(2), ca, caKey)
+	goodPEM, revokedPEM := encodeCert(good), encodeCert(revoked)
+	revokedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	v := &fakeVault{ca: ca, caKey: caKey, certs: map[string][]vaultCert{"a3": {
+		{Serial: "01", Certificate: goodPEM},
+		{Serial: "02", Certificate: revokedPEM, RevokedAt: revokedAt},
+	}}}
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, _ := NewStorage("memory://", hasher)
+	db.SetRevocationReason(context.Background(), "a3", "02", 1)
+
+	c := newRevocationCache(v, db, time.Minute, time.Hour)
+	if _, ok := c.Status("a3", "01"); ok {
+		t.Error("Status known before the first refresh.")
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to refresh. %v", err)
+	}
+	if st, ok := c.Status("a3", "01"); !ok || !st.revokedAt.IsZero() {
+		t.Errorf("Unexpected status of good certificate %+v %v", st, ok)
+	}
+	if st, ok := c.Status("a3", "02"); !ok || !st.revokedAt.Equal(revokedAt) || st.reason != 1 {
+		t.Errorf("Unexpected status of revoked certificate %+v %v", st, ok)
+	}
+	if _, ok := c.Status("a3", "03"); ok {
+		t.Error("Status of unknown certificate known.")
+	}
+	// The responder certificate is stored by the PKI, but is neither the user's nor checked.
+	if len(v.certs["a3"]) != 3 {
+		t.Fatalf("Responder certificate not stored %+v", v.certs["a3"])
+	}
+	responder := v.certs["a3"][2]
+	if cert, err := parseVaultCert(responder); cert != nil || err != nil {
+		t.Errorf("Responder certificate listed as the user's. %v", err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to refresh. %v", err)
+	}
+	if _, ok := c.Status("a3", responder.Serial); ok {
+		t.Error("Status of responder certificate cached.")
+	}
+
+	s := server{revocations: c}
+	r := mux.NewRouter()
+	r.SkipClean(true)
+	r.HandleFunc("/crl", s.CRL).Methods(http.MethodGet)
+	r.HandleFunc("/crl/{uid}", s.CRL).Methods(http.MethodGet)
+	r.HandleFunc("/ocsp", s.OCSP).Methods(http.MethodPost)
+	r.HandleFunc("/ocsp/{request:.+}", s.OCSP).Methods(http.MethodGet)
+
+	check := func(cert *x509.Certificate, get bool) *ocsp.Response {
+		der, _ := ocsp.CreateRequest(cert, ca, nil)
+		req := httptest.NewRequest(http.MethodPost, "/ocsp", bytes.NewReader(der))
+		if get {
+			req = httptest.NewRequest(http.MethodGet, "/ocsp/"+url.PathEscape(base64.StdEncoding.EncodeToString(der)), nil)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		resp, err := ocsp.ParseResponseForCert(w.Body.Bytes(), cert, ca)
+		if err != nil {
+			t.Fatalf("Failed to parse OCSP response. %v", err)
+		}
+		return resp
+	}
+	if resp := check(good, false); resp.Status != ocsp.Good {
+		t.Errorf("Expected good, got %d", resp.Status)
+	}
+	if resp := check(revoked, true); resp.Status != ocsp.Revoked || resp.RevocationReason != ocsp.KeyCompromise || !resp.RevokedAt.Equal(revokedAt) {
+		t.Errorf("Unexpected response for revoked certificate %+v", resp)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/crl", nil))
+	b, _ := pem.Decode(w.Body.Bytes())
+	if b == nil || b.Type != "X509 CRL" {
+		t.Fatalf("Unexpected CRL bundle %q", w.Body.String())
+	}
+	crl, err := x509.ParseCRL(b.Bytes)
+	if err != nil || ca.CheckCRLSignature(crl) != nil || len(crl.TBSCertList.RevokedCertificates) != 1 {
+		t.Errorf("Unexpected CRL. %v", err)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/crl/nobody", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown PKI, got %d", w.Code)
+	}
+
+	// Refreshes may be late, answers must not expire while the cache is still used.
+	c.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	goodReq, _ := ocsp.CreateRequest(good, ca, nil)
+	raw, maxAge, err := c.respond(mustParseOCSPRequest(t, goodReq))
+	if late, err1 := ocsp.ParseResponseForCert(raw, good, ca); err != nil || err1 != nil || !late.NextUpdate.After(c.now()) || maxAge <= 0 {
+		t.Errorf("Late answer expired, max age %s. %v %v", maxAge, err, err1)
+	}
+
+	c.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, ok := c.Status("a3", "01"); ok {
+		t.Error("Status of stale cache used.")
+	}
+	der, _ := ocsp.CreateRequest(good, ca, nil)
+	resp, _, _ := c.respond(mustParseOCSPRequest(t, der))
+	if !bytes.Equal(resp, ocsp.TryLaterErrorResponse) {
+		t.Error("Stale cache answered OCSP request.")
+	}
+}
+
+func mustParseOCSPRequest(t *testing.T, der []byte) *ocsp.Request {
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		t.Fatalf("Failed to parse OCSP request. %v", err)
+	}
+	return req
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// appConsent is the access a user granted an OAuth 2.0 client.
+type appConsent struct {
+	ClientID   string    `json:"clientId"`
+	ClientName string    `json:"clientName"`
+	LogoURI    string    `json:"logoUri,omitempty"`
+	Scopes     []string  `json:"scopes"`
+	Audience   []string  `json:"audience"`
+	GrantedAt  time.Time `json:"grantedAt"`
+	// ExpiresAt is when Hydra forgets the consent, not set if it is remembered until revoked.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// userSession is a login session of a browser, and the clients used in it.
+type userSession struct {
+	ID         string    `json:"id"`
+	Clients    []string  `json:"clients"`
+	LastActive time.Time `json:"lastActive"`
+}
+
+func newAppConsent(cs PreviousConsentSession) appConsent {
+	c := appConsent{
+		ClientID:   cs.ConsentRequest.Client.ClientID,
+		ClientName: cs.ConsentRequest.Client.ClientName,
+		LogoURI:    cs.ConsentRequest.Client.LogoURI,
+		Scopes:     cs.GrantScope,
+		Audience:   cs.GrantAccessTokenAudience,
+		GrantedAt:  cs.HandledAt,
+	}
+	if c.ClientName == "" {
+		c.ClientName = c.ClientID
+	}
+	if cs.RememberFor > 0 {
+		exp := cs.HandledAt.Add(time.Duration(cs.RememberFor) * time.Second)
+		c.ExpiresAt = &exp
+	}
+	return c
+}
+
+// appConsents returns the latest consent per client, most recent first.
+func appConsents(sessions []PreviousConsentSession) []appConsent {
+	latest := map[string]appConsent{}
+	for _, cs := range sessions {
+		c := newAppConsent(cs)
+		if prev, ok := latest[c.ClientID]; !ok || c.GrantedAt.After(prev.GrantedAt) {
+			latest[c.ClientID] = c
+		}
+	}
+	l := []appConsent{}
+	for _, c := range latest {
+		l = append(l, c)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].GrantedAt.After(l[j].GrantedAt) })
+	return l
+}
+
+// userSessions groups consent sessions by the login session they were given in, most recently
+// active first.
+func userSessions(sessions []PreviousConsentSession) []userSession {
+	byID := map[string]*userSession{}
+	for _, cs := range sessions {
+		id := cs.ConsentRequest.LoginSessionID
+		if id == "" {
+			continue
+		}
+		us, ok := byID[id]
+		if !ok {
+			us = &userSession{ID: id, Clients: []string{}}
+			byID[id] = us
+		}
+		client := cs.ConsentRequest.Client.ClientID
+		known := false
+		for _, c := range us.Clients {
+			known = known || c == client
+		}
+		if !known {
+			us.Clients = append(us.Clients, client)
+		}
+		if cs.HandledAt.After(us.LastActive) {
+			us.LastActive = cs.HandledAt
+		}
+	}
+	l := []userSession{}
+	for _, us := range byID {
+		sort.Strings(us.Clients)
+		l = append(l, *us)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].LastActive.After(l[j].LastActive) })
+	return l
+}
+
+// ListConsents lists the clients the authenticated user granted access to.
+func (s server) ListConsents(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := s.hydra.ListConsentSessions(r.Context(), id)
+	if err != nil {
+		log.WithError(err).WithField("uid", id).Error("Failed to list consent sessions.")
+		s.httpInternalError(w, fmt.Errorf("failed to list consents"))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, appConsents(sessions))
+}
+
+// ListSessions lists the login sessions of the authenticated user in which clients were used.
+func (s server) ListSessions(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := s.hydra.ListConsentSessions(r.Context(), id)
+	if err != nil {
+		log.WithError(err).WithField("uid", id).Error("Failed to list consent sessions.")
+		s.httpInternalError(w, fmt.Errorf("failed to list consents"))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, userSessions(sessions))
+}
+
+// RevokeConsents revokes the access of the client in the path, or of all clients, and the tokens
+// issued to them.
+func (s server) RevokeConsents(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	l := log.WithField("uid", id)
+	var err error
+	if client, ok := mux.Vars(r)["client"]; ok {
+		l = l.WithField("client", client)
+		err = s.hydra.RevokeClientConsentSessions(r.Context(), id, client)
+	} else {
+		err = s.hydra.RevokeConsentSessions(r.Context(), id)
+	}
+	if err != nil {
+		l.WithError(err).Error("Failed to revoke consent sessions.")
+		s.httpInternalError(w, fmt.Errorf("failed to revoke consents"))
+		return
+	}
+	l.Info("Revoked consent.")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// RevokeSessions logs the authenticated user out of all browsers. Tokens already issued stay valid,
+// see RevokeConsents.
+func (s server) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if err := s.hydra.RevokeLoginSessions(r.Context(), id); err != nil {
+		log.WithError(err).WithField("uid", id).Error("Failed to revoke login sessions.")
+		s.httpInternalError(w, fmt.Errorf("failed to revoke sessions"))
+		return
+	}
+	log.WithField("uid", id).Info("Revoked login sessions.")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// loginState carries what has been verified so far between the steps of a multi-step login. It is
+// handed to the browser signed, so it cannot be tampered with.
+type loginState struct {
+	Challenge string   `json:"c"`
+	Subject   string   `json:"s"`
+	AMR       []string `json:"a"`
+	Expires   int64    `json:"e"`
+}
+
+const loginStateTTL = 5 * time.Minute
+
+// signState serializes and signs v with key: base64url(json).base64url(hmac-sha256)
+func signState(key []byte, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyState checks the signature of token and deserializes it into v.
+func verifyState(key []byte, token string, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed state")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed state: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed state: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("invalid state signature")
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// verifyLoginState verifies token and checks that it belongs to challenge and has not expired.
+func verifyLoginState(key []byte, token string, challenge string, now time.Time) (loginState, error) {
+	st := loginState{}
+	if err := verifyState(key, token, &st); err != nil {
+		return loginState{}, err
+	}
+	if st.Challenge != challenge {
+		return loginState{}, fmt.Errorf("state belongs to a different login challenge")
+	}
+	if now.Unix() > st.Expires {
+		return loginState{}, fmt.Errorf("state expired")
+	}
+	return st, nil
+}
@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
-	"crypto/sha1"
 	"database/sql"
-	"encoding/hex"
-	_ "github.com/go-sql-driver/mysql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
-	"io"
+	"strings"
+	"time"
 )
 
+// maxPasswordHistory is the number of previous password hashes kept per user.
+const maxPasswordHistory = 24
+
 type dbUser struct {
 	uid       string
 	firstname string
 	lastname  string
 	email     string
-	pwd       string // this is a SHA1 hash
+	pwd       string // encoded hash, see password.go. Might still be a legacy unsalted SHA1 hash.
+	admin     bool
+	disabled  bool
+	totp      TOTPConfig
+
+	emailVerified bool
+	// pendingEmail is the new address while its verification is pending.
+	pendingEmail      string
+	emailTokenHash    string
+	emailTokenExpires int64
 }
 
 type User struct {
@@ -23,15 +37,88 @@ type User struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Email     string `json:"email"`
+	Admin     bool   `json:"admin"`
+	Disabled  bool   `json:"disabled"`
+	// TOTPEnabled is true if the user has a confirmed TOTP second factor.
+	TOTPEnabled bool `json:"totpEnabled"`
+	// EmailVerified is true if the user has proven to own Email.
+	EmailVerified bool `json:"emailVerified"`
+	// PendingEmail is the address the user wants to change to, until it is verified.
+	PendingEmail string `json:"pendingEmail,omitempty"`
+}
+
+var errUserExists = errors.New("user already exists")
+
+// errPasswordColumn is returned instead of storing a password hash which the pwd column would
+// truncate, as in databases loaded from imovies_users.dump before migration 2.
+var errPasswordColumn = errors.New("pwd column is too narrow for the password hash, apply the migrations")
+
+// userColumns are the columns read by scanUser.
+const userColumns = `uid, firstname, lastname, email, admin, disabled, totp_enabled, email_verified, pending_email`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
 }
 
+func scanUser(row scanner) (dbUser, error) {
+	u := dbUser{}
+	err := row.Scan(&u.uid, &u.firstname, &u.lastname, &u.email, &u.admin, &u.disabled, &u.totp.Enabled, &u.emailVerified, &u.pendingEmail)
+	return u, err
+}
+
+// storage is a storageClient backed by a SQL database, either MySQL or SQLite.
 type storage struct {
-	db *sql.DB
+	db     *sql.DB
+	driver string
+	hasher passwordHasher
+	// dummyHash is verified against when a user does not exist, so that a failed login takes
+	// roughly the same time whether the user exists or not.
+	dummyHash string
 }
 
-// NewStorage returns a new storage client which is capable of talking to a mySQL DB.
-func NewStorage(dsn string) (*storage, error) {
-	pool, err := sql.Open("mysql", dsn)
+// NewStorage returns a new storage client for the backend selected by the scheme of dsn:
+//
+//	mysql://user:password@(host)/dbname   MySQL, a DSN without scheme is passed to MySQL as well
+//	sqlite://path/to/file.db             SQLite
+//	memory://?seed=path/to/dump.sql      in-memory, optionally seeded from a mysqldump of the users table
+//
+// The SQL backends expect their schema to be up to date, see migrate.go. Passwords are hashed using
+// hasher.
+func NewStorage(dsn string, hasher passwordHasher) (storageClient, error) {
+	dummy, err := hasher.Hash("dummy password")
+	if err != nil {
+		log.WithError(err).Error("Failed to hash dummy password.")
+		return nil, err
+	}
+
+	scheme, rest := "mysql", dsn
+	if i := strings.Index(dsn, "://"); i >= 0 {
+		scheme, rest = dsn[:i], dsn[i+len("://"):]
+	}
+	switch scheme {
+	case "mysql":
+		return newSQLStorage("mysql", rest, hasher, dummy)
+	case "sqlite":
+		return newSQLStorage("sqlite3", rest, hasher, dummy)
+	case "memory":
+		return newMemoryStorage(rest, hasher, dummy)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", scheme)
+	}
+}
+
+func newSQLStorage(driver string, dsn string, hasher passwordHasher, dummyHash string) (*storage, error) {
+	if driver == "mysql" {
+		// We scan DATETIME columns into time.Time.
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			log.WithError(err).Error("Failed to parse DSN.")
+			return nil, err
+		}
+		cfg.ParseTime = true
+		dsn = cfg.FormatDSN()
+	}
+	pool, err := sql.Open(driver, dsn)
 	if err != nil {
 		log.WithError(err).Error("Failed to sql.Open.")
 		return nil, err
@@ -41,15 +128,17 @@ func NewStorage(dsn string) (*storage, error) {
 		log.WithError(err).Error("Failed to connect to DB.")
 		return nil, err
 	}
-	return &storage{db: pool}, nil
+	if driver == "sqlite3" {
+		// SQLite does not handle concurrent writers, serialize all access instead.
+		pool.SetMaxOpenConns(1)
+	}
+	return &storage{db: pool, driver: driver, hasher: hasher, dummyHash: dummyHash}, nil
 }
 
 // GetUser retrieves a specific user from the database. It returns sql.ErrNoRows if the user was not
 // found.
 func (s *storage) GetUser(ctx context.Context, userID string) (User, error) {
-	u := dbUser{}
-	row := s.db.QueryRowContext(ctx, `SELECT uid, firstname, lastname, email FROM users WHERE uid=?`, userID)
-	err := row.Scan(&u.uid, &u.firstname, &u.lastname, &u.email)
+	u, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE uid=?`, userID))
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Failed to query DB for user.")
@@ -62,15 +151,26 @@ func (s *storage) GetUser(ctx context.Context, userID string) (User, error) {
 // ChangePassword allows a user to change their password.
 func (s *storage) ChangePassword(ctx context.Context, userID string, password string) error {
 	//hash password
-	h := sha1.New()
-	h.Write([]byte(password))
-	pwHash := hex.EncodeToString(h.Sum(nil))
+	pwHash, err := s.hasher.Hash(password)
+	if err != nil {
+		log.WithError(err).Error("Failed to hash password.")
+		return err
+	}
 
+	if err := s.checkHashFits(ctx, pwHash); err != nil {
+		log.WithError(err).Error("Failed to change password.")
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
 	// Check if user exists
-	var uid string
-	row := s.db.QueryRowContext(ctx, `SELECT uid FROM users WHERE uid=?`, userID)
-	err := row.Scan(&uid)
+	var oldHash string
+	err = tx.QueryRowContext(ctx, `SELECT pwd FROM users WHERE uid=?`, userID).Scan(&oldHash)
 	if err != nil {
+		tx.Rollback()
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Failed to query DB for user.")
 		} else {
@@ -79,15 +179,51 @@ func (s *storage) ChangePassword(ctx context.Context, userID string, password st
 		return err
 	}
 
-	//change password.
-	_, err = s.db.ExecContext(ctx, `UPDATE users SET pwd = ? WHERE uid=?`, pwHash, userID)
+	//change password and remember the old one.
+	_, err = tx.ExecContext(ctx, `UPDATE users SET pwd = ? WHERE uid=?`, pwHash, userID)
+	if err == nil && oldHash != "" {
+		_, err = tx.ExecContext(ctx, `INSERT INTO password_history (uid, pwd) VALUES (?, ?)`, userID, oldHash)
+	}
+	if err == nil {
+		// MySQL does not support LIMIT directly in an IN subquery, hence the derived table.
+		_, err = tx.ExecContext(ctx, `DELETE FROM password_history WHERE uid=? AND id NOT IN (
+SELECT id FROM (SELECT id FROM password_history WHERE uid=? ORDER BY id DESC LIMIT ?) AS keep)`,
+			userID, userID, maxPasswordHistory)
+	}
 	if err != nil {
-		if err != sql.ErrNoRows {
-			log.WithError(err).Error("Failed to change password.")
-		}
+		tx.Rollback()
+		log.WithError(err).Error("Failed to change password.")
 		return err
 	}
-	return nil
+	return tx.Commit()
+}
+
+// PasswordHistory returns the hashes of the current and up to n-1 previous passwords of a user,
+// newest first. It returns sql.ErrNoRows if the user was not found.
+func (s *storage) PasswordHistory(ctx context.Context, userID string, n int) ([]string, error) {
+	var current string
+	err := s.db.QueryRowContext(ctx, `SELECT pwd FROM users WHERE uid=?`, userID).Scan(&current)
+	if err != nil {
+		return nil, err
+	}
+	hashes := []string{current}
+	if n <= 1 {
+		return hashes, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT pwd FROM password_history WHERE uid=? ORDER BY id DESC LIMIT ?`, userID, n-1)
+	if err != nil {
+		log.WithError(err).Error("Failed to query password history.")
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
 }
 
 func (s *storage) EditUser(ctx context.Context, user User) error {
@@ -101,37 +237,508 @@ func (s *storage) EditUser(ctx context.Context, user User) error {
 	return nil
 }
 
-// Login returns true if the hashed password matches our database record.
+// Login returns true if the password matches our database record. Records which are not hashed
+// with the current algorithm and parameters, such as legacy SHA1 hashes, are upgraded on success.
 func (s *storage) Login(ctx context.Context, userID string, password string) bool {
-	//hash password
-	h := sha1.New()
-	io.WriteString(h, password)
-	pwHash := hex.EncodeToString(h.Sum(nil))
-
-	row := s.db.QueryRowContext(ctx, `SELECT uid FROM users WHERE uid=? AND pwd=?`, userID, pwHash)
+	row := s.db.QueryRowContext(ctx, `SELECT pwd, disabled FROM users WHERE uid=?`, userID)
 
-	var uid string
-	err := row.Scan(&uid)
+	var pwHash string
+	var disabled bool
+	err := row.Scan(&pwHash, &disabled)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Failed to query DB for user.")
-		} else {
-			log.WithError(err).Error("Failed login attempt")
+			return false
 		}
+		log.WithError(err).Error("Failed login attempt")
+		verifyPassword(password, s.dummyHash)
+		return false
+	}
+	ok, err := verifyPassword(password, pwHash)
+	if err != nil {
+		log.WithError(err).WithField("uid", userID).Error("Failed to verify password hash.")
 		return false
 	}
-	if uid == userID {
-		return true
-	} else {
+	if !ok {
+		log.WithField("uid", userID).Error("Failed login attempt")
 		return false
 	}
+	if disabled {
+		log.WithField("uid", userID).Warn("Login attempt for disabled user.")
+		return false
+	}
+
+	if s.hasher.NeedsRehash(pwHash) {
+		s.rehash(ctx, userID, pwHash, password)
+	}
+	return true
+}
+
+// rehash replaces oldHash with a hash produced by the current hasher. Failing to do so is not fatal,
+// we simply try again on the next login.
+func (s *storage) rehash(ctx context.Context, userID string, oldHash string, password string) {
+	l := log.WithField("uid", userID)
+	newHash, err := s.hasher.Hash(password)
+	if err != nil {
+		l.WithError(err).Error("Failed to rehash password.")
+		return
+	}
+	if err := s.checkHashFits(ctx, newHash); err != nil {
+		l.WithError(err).Warn("Not upgrading password hash.")
+		return
+	}
+	// Only replace the hash we verified against, in case the password was changed in the meantime.
+	_, err = s.db.ExecContext(ctx, `UPDATE users SET pwd = ? WHERE uid=? AND pwd=?`, newHash, userID, oldHash)
+	if err != nil {
+		l.WithError(err).Error("Failed to store rehashed password.")
+		return
+	}
+	l.Info("Upgraded password hash.")
+}
+
+// checkHashFits returns errPasswordColumn if hash is longer than the pwd column. Depending on its
+// mode, MySQL either rejects such a hash or silently truncates it, locking the user out.
+func (s *storage) checkHashFits(ctx context.Context, hash string) error {
+	if s.driver != "mysql" {
+		// SQLite does not enforce the length of varchar columns.
+		return nil
+	}
+	var width int
+	err := s.db.QueryRowContext(ctx, `SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME = 'pwd'`).Scan(&width)
+	if err != nil {
+		return err
+	}
+	if len(hash) > width {
+		return errPasswordColumn
+	}
+	return nil
+}
+
+// ListUsers returns up to limit users, ordered by uid and starting at offset, whose uid, name or
+// email contains query. It also returns the total number of matching users.
+func (s *storage) ListUsers(ctx context.Context, query string, offset int, limit int) ([]User, int, error) {
+	where, args := "", []interface{}{}
+	if query != "" {
+		where = ` WHERE uid LIKE ? ESCAPE '!' OR firstname LIKE ? ESCAPE '!' OR lastname LIKE ? ESCAPE '!' OR email LIKE ? ESCAPE '!'`
+		p := "%" + likeEscaper.Replace(query) + "%"
+		args = append(args, p, p, p, p)
+	}
+
+	var total int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`+where, args...).Scan(&total)
+	if err != nil {
+		log.WithError(err).Error("Failed to count users.")
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users`+where+` ORDER BY uid LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		log.WithError(err).Error("Failed to list users.")
+		return nil, 0, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			log.WithError(err).Error("Failed to scan user.")
+			return nil, 0, err
+		}
+		users = append(users, userFromDBUser(u))
+	}
+	return users, total, rows.Err()
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// CreateUser adds a new user. It returns errUserExists if the uid is already taken.
+func (s *storage) CreateUser(ctx context.Context, user User, password string) error {
+	pwHash, err := s.hasher.Hash(password)
+	if err != nil {
+		log.WithError(err).Error("Failed to hash password.")
+		return err
+	}
+	_, err = s.GetUser(ctx, user.UserID)
+	if err == nil {
+		return errUserExists
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO users (uid, firstname, lastname, email, pwd, admin, disabled, email_verified) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.UserID, user.FirstName, user.LastName, user.Email, pwHash, user.Admin, user.Disabled, user.EmailVerified)
+	if err != nil {
+		// Most likely a concurrent insert of the same uid.
+		if _, getErr := s.GetUser(ctx, user.UserID); getErr == nil {
+			return errUserExists
+		}
+		log.WithError(err).Error("Failed to create user.")
+		return err
+	}
+	return nil
+}
+
+// SetUserDisabled disables or enables a user. Disabled users cannot log in. It returns
+// sql.ErrNoRows if the user was not found.
+func (s *storage) SetUserDisabled(ctx context.Context, userID string, disabled bool) error {
+	return s.execUser(ctx, `UPDATE users SET disabled = ? WHERE uid=?`, disabled, userID)
+}
+
+// DeleteUser removes a user. It returns sql.ErrNoRows if the user was not found.
+func (s *storage) DeleteUser(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE uid=?`, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to delete recovery codes.")
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM password_reset_tokens WHERE uid=?`, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to delete reset tokens.")
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM password_history WHERE uid=?`, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to delete password history.")
+		return err
+	}
+	return s.execUser(ctx, `DELETE FROM users WHERE uid=?`, userID)
+}
+
+// GetTOTP returns the TOTP configuration of a user or sql.ErrNoRows if the user was not found.
+func (s *storage) GetTOTP(ctx context.Context, userID string) (TOTPConfig, error) {
+	c := TOTPConfig{}
+	row := s.db.QueryRowContext(ctx, `SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE uid=?`, userID)
+	err := row.Scan(&c.Secret, &c.Enabled, &c.LastStep)
+	if err != nil && err != sql.ErrNoRows {
+		log.WithError(err).Error("Failed to query DB for TOTP config.")
+	}
+	return c, err
+}
+
+// SetTOTP replaces the TOTP configuration of a user.
+func (s *storage) SetTOTP(ctx context.Context, userID string, c TOTPConfig) error {
+	return s.execUser(ctx, `UPDATE users SET totp_secret = ?, totp_enabled = ?, totp_last_step = ? WHERE uid=?`,
+		c.Secret, c.Enabled, c.LastStep, userID)
+}
+
+// UseTOTPStep records that a code for step has been used. It returns false if a code of this or a
+// later step has already been used, i.e. the code is being replayed.
+func (s *storage) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE users SET totp_last_step = ? WHERE uid=? AND totp_last_step < ?`, step, userID, step)
+	if err != nil {
+		log.WithError(err).Error("Failed to record TOTP step.")
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// SetRecoveryCodes replaces all recovery codes of a user.
+func (s *storage) SetRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE uid=?`, userID)
+	if err != nil {
+		tx.Rollback()
+		log.WithError(err).Error("Failed to delete recovery codes.")
+		return err
+	}
+	for _, h := range codeHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (uid, code_hash) VALUES (?, ?)`, userID, h)
+		if err != nil {
+			tx.Rollback()
+			log.WithError(err).Error("Failed to store recovery code.")
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes a recovery code. It returns false if the code does not exist or has
+// already been used.
+func (s *storage) UseRecoveryCode(ctx context.Context, userID string, codeHash string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE uid=? AND code_hash=?`, userID, codeHash)
+	if err != nil {
+		log.WithError(err).Error("Failed to use recovery code.")
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// CreateResetToken stores the hash of a password reset token for a user.
+func (s *storage) CreateResetToken(ctx context.Context, userID string, tokenHash string, expires time.Time) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO password_reset_tokens (token_hash, uid, expires_at) VALUES (?, ?, ?)`,
+		tokenHash, userID, expires.Unix())
+	if err != nil {
+		log.WithError(err).Error("Failed to store reset token.")
+	}
+	return err
+}
+
+// ResetTokenUser returns the user a valid reset token belongs to without using it, or
+// sql.ErrNoRows if the token is unknown or expired.
+func (s *storage) ResetTokenUser(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	var uid string
+	err := s.db.QueryRowContext(ctx, `SELECT uid FROM password_reset_tokens WHERE token_hash=? AND expires_at > ?`,
+		tokenHash, now.Unix()).Scan(&uid)
+	return uid, err
+}
+
+// UseResetToken consumes a valid reset token and invalidates all other tokens of the same user.
+// It returns the user or sql.ErrNoRows if the token is unknown, expired or already used.
+func (s *storage) UseResetToken(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	var uid string
+	err = tx.QueryRowContext(ctx, `SELECT uid FROM password_reset_tokens WHERE token_hash=? AND expires_at > ?`,
+		tokenHash, now.Unix()).Scan(&uid)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	// Only one of several concurrent requests gets to delete the token.
+	res, err := tx.ExecContext(ctx, `DELETE FROM password_reset_tokens WHERE token_hash=?`, tokenHash)
+	if err == nil {
+		var n int64
+		n, err = res.RowsAffected()
+		if err == nil && n != 1 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM password_reset_tokens WHERE uid=?`, uid)
+	}
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return uid, tx.Commit()
+}
+
+// SetPendingEmail starts the change of the email address of a user to email, which is only
+// committed once ConfirmEmail is called with the token. It returns sql.ErrNoRows if the user was
+// not found.
+func (s *storage) SetPendingEmail(ctx context.Context, userID string, email string, tokenHash string, expires time.Time) error {
+	return s.execUser(ctx, `UPDATE users SET pending_email = ?, email_token_hash = ?, email_token_expires = ? WHERE uid=?`,
+		email, tokenHash, expires.Unix(), userID)
+}
+
+// ConfirmEmail commits the pending email change the token belongs to. It returns the user or
+// sql.ErrNoRows if the token is unknown or expired.
+func (s *storage) ConfirmEmail(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	var uid string
+	err := s.db.QueryRowContext(ctx, `SELECT uid FROM users WHERE email_token_hash=? AND email_token_expires > ? AND pending_email <> ''`,
+		tokenHash, now.Unix()).Scan(&uid)
+	if err != nil {
+		return "", err
+	}
+	err = s.execUser(ctx, `UPDATE users SET email = pending_email, email_verified = 1, pending_email = '', email_token_hash = '', email_token_expires = 0
+WHERE email_token_hash = ? AND uid=?`, tokenHash, uid)
+	return uid, err
+}
+
+// SetRevocationReason records why a certificate of a user was revoked.
+func (s *storage) SetRevocationReason(ctx context.Context, userID string, serial string, reason int) error {
+	_, err := s.db.ExecContext(ctx, `REPLACE INTO cert_revocations (uid, serial, reason) VALUES (?, ?, ?)`,
+		userID, serial, reason)
+	if err != nil {
+		log.WithError(err).Error("Failed to store revocation reason.")
+	}
+	return err
+}
+
+// RevocationReasons returns the recorded revocation reasons of the certificates of a user by serial.
+func (s *storage) RevocationReasons(ctx context.Context, userID string) (map[string]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT serial, reason FROM cert_revocations WHERE uid=?`, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to query DB for revocation reasons.")
+		return nil, err
+	}
+	defer rows.Close()
+	reasons := map[string]int{}
+	for rows.Next() {
+		var serial string
+		var reason int
+		if err := rows.Scan(&serial, &reason); err != nil {
+			return nil, err
+		}
+		reasons[serial] = reason
+	}
+	return reasons, rows.Err()
+}
+
+// CreateRecoveryRequest stores a new key recovery request and returns its id.
+func (s *storage) CreateRecoveryRequest(ctx context.Context, req recoveryRequest) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO key_recovery_requests (uid, serial, status, requested_at, decided_by, decided_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		req.UserID, req.Serial, req.Status, req.RequestedAt.Unix(), req.DecidedBy, unixOrZero(req.DecidedAt))
+	if err != nil {
+		log.WithError(err).Error("Failed to store key recovery request.")
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+const recoveryColumns = `id, uid, serial, status, requested_at, decided_by, decided_at`
+
+func scanRecoveryRequest(row scanner) (recoveryRequest, error) {
+	var req recoveryRequest
+	var requestedAt, decidedAt int64
+	err := row.Scan(&req.ID, &req.UserID, &req.Serial, &req.Status, &requestedAt, &req.DecidedBy, &decidedAt)
+	req.RequestedAt = time.Unix(requestedAt, 0)
+	if decidedAt != 0 {
+		t := time.Unix(decidedAt, 0)
+		req.DecidedAt = &t
+	}
+	return req, err
+}
+
+// GetRecoveryRequest returns a key recovery request or sql.ErrNoRows.
+func (s *storage) GetRecoveryRequest(ctx context.Context, id int64) (recoveryRequest, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+recoveryColumns+` FROM key_recovery_requests WHERE id=?`, id)
+	req, err := scanRecoveryRequest(row)
+	if err != nil && err != sql.ErrNoRows {
+		log.WithError(err).Error("Failed to query DB for key recovery request.")
+	}
+	return req, err
+}
+
+// ListRecoveryRequests returns the key recovery requests of a user, or of all users if userID is
+// empty, optionally only those with status, newest first.
+func (s *storage) ListRecoveryRequests(ctx context.Context, userID string, status string) ([]recoveryRequest, error) {
+	var conds []string
+	var args []interface{}
+	if userID != "" {
+		conds, args = append(conds, "uid=?"), append(args, userID)
+	}
+	if status != "" {
+		conds, args = append(conds, "status=?"), append(args, status)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+recoveryColumns+` FROM key_recovery_requests`+where+` ORDER BY id DESC`, args...)
+	if err != nil {
+		log.WithError(err).Error("Failed to list key recovery requests.")
+		return nil, err
+	}
+	defer rows.Close()
+	reqs := []recoveryRequest{}
+	for rows.Next() {
+		req, err := scanRecoveryRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, rows.Err()
+}
+
+// UpdateRecoveryRequest moves a key recovery request from status from to status to. If decidedBy
+// is not empty, the decision is recorded too. It returns sql.ErrNoRows if the request does not
+// exist or is not in status from, so that of concurrent updates only one succeeds.
+func (s *storage) UpdateRecoveryRequest(ctx context.Context, id int64, from string, to string, decidedBy string, at time.Time) error {
+	query, args := `UPDATE key_recovery_requests SET status=? WHERE id=? AND status=?`, []interface{}{to, id, from}
+	if decidedBy != "" {
+		query = `UPDATE key_recovery_requests SET status=?, decided_by=?, decided_at=? WHERE id=? AND status=?`
+		args = []interface{}{to, decidedBy, at.Unix(), id, from}
+	}
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		log.WithError(err).Error("Failed to update key recovery request.")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AddAuditEvent appends an event to the audit log.
+func (s *storage) AddAuditEvent(ctx context.Context, e auditEvent) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO audit_log (at, actor, uid, action, detail, remote_addr) VALUES (?, ?, ?, ?, ?, ?)`,
+		e.Time.Unix(), e.Actor, e.UserID, e.Action, e.Detail, e.RemoteAddr)
+	if err != nil {
+		log.WithError(err).Error("Failed to write audit log.")
+	}
+	return err
+}
+
+// ListAuditEvents returns the newest limit events concerning a user, or all users if userID is
+// empty, newest first.
+func (s *storage) ListAuditEvents(ctx context.Context, userID string, limit int) ([]auditEvent, error) {
+	where, args := "", []interface{}{}
+	if userID != "" {
+		where, args = " WHERE uid=?", append(args, userID)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, at, actor, uid, action, detail, remote_addr FROM audit_log`+where+` ORDER BY id DESC LIMIT ?`,
+		append(args, limit)...)
+	if err != nil {
+		log.WithError(err).Error("Failed to list audit log.")
+		return nil, err
+	}
+	defer rows.Close()
+	events := []auditEvent{}
+	for rows.Next() {
+		var e auditEvent
+		var at int64
+		if err := rows.Scan(&e.ID, &at, &e.Actor, &e.UserID, &e.Action, &e.Detail, &e.RemoteAddr); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(at, 0)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// execUser executes a statement affecting a single user and returns sql.ErrNoRows if it did not
+// match any row.
+func (s *storage) execUser(ctx context.Context, query string, args ...interface{}) error {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		log.WithError(err).Error("Failed to update user.")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// MySQL does not count rows which already had the desired values, so check again.
+		var uid string
+		return s.db.QueryRowContext(ctx, `SELECT uid FROM users WHERE uid=?`, args[len(args)-1]).Scan(&uid)
+	}
+	return nil
 }
 
 func userFromDBUser(u dbUser) User {
 	return User{
-		UserID:    u.uid,
-		FirstName: u.firstname,
-		LastName:  u.lastname,
-		Email:     u.email,
+		UserID:        u.uid,
+		FirstName:     u.firstname,
+		LastName:      u.lastname,
+		Email:         u.email,
+		Admin:         u.admin,
+		Disabled:      u.disabled,
+		TOTPEnabled:   u.totp.Enabled,
+		EmailVerified: u.emailVerified,
+		PendingEmail:  u.pendingEmail,
 	}
 }
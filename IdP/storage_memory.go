@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStorage is a storageClient which keeps all users in memory. It is meant for tests and local
+// development, nothing is ever persisted.
+type memoryStorage struct {
+	mu            sync.Mutex
+	users         map[string]dbUser
+	recoveryCodes map[string]map[string]bool
+	resetTokens   map[string]resetToken
+	history       map[string][]string // previous password hashes, newest first
+	revocations   map[string]map[string]int
+	recoveries    []recoveryRequest
+	audit         []auditEvent
+	hasher        passwordHasher
+	dummyHash     string
+}
+
+type resetToken struct {
+	uid     string
+	expires time.Time
+}
+
+// newMemoryStorage creates an in-memory storage. dsn may contain a seed parameter pointing to a
+// mysqldump of the users table, e.g. "?seed=../ansible/roles/mysql/files/imovies_users.dump".
+func newMemoryStorage(dsn string, hasher passwordHasher, dummyHash string) (*memoryStorage, error) {
+	s := &memoryStorage{
+		users:         map[string]dbUser{},
+		recoveryCodes: map[string]map[string]bool{},
+		resetTokens:   map[string]resetToken{},
+		history:       map[string][]string{},
+		revocations:   map[string]map[string]int{},
+		hasher:        hasher,
+		dummyHash:     dummyHash,
+	}
+	query := ""
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		query = dsn[i+1:]
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory dsn: %v", err)
+	}
+	if seed := q.Get("seed"); seed != "" {
+		f, err := os.Open(seed)
+		if err != nil {
+			log.WithError(err).Error("Failed to open seed file.")
+			return nil, err
+		}
+		defer f.Close()
+		users, err := parseUsersDump(f)
+		if err != nil {
+			log.WithError(err).Error("Failed to parse seed file.")
+			return nil, err
+		}
+		for _, u := range users {
+			// Like migration 7, trust the addresses set up by the operators.
+			u.emailVerified = u.email != ""
+			s.users[u.uid] = u
+		}
+		log.WithField("users", len(users)).Info("Seeded in-memory storage.")
+	}
+	return s, nil
+}
+
+// GetUser returns sql.ErrNoRows if the user was not found, just like the SQL backends.
+func (s *memoryStorage) GetUser(ctx context.Context, userID string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return userFromDBUser(u), nil
+}
+
+func (s *memoryStorage) ChangePassword(ctx context.Context, userID string, password string) error {
+	pwHash, err := s.hasher.Hash(password)
+	if err != nil {
+		log.WithError(err).Error("Failed to hash password.")
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		log.WithField("uid", userID).Error("No user with uID found.")
+		return sql.ErrNoRows
+	}
+	if u.pwd != "" {
+		h := append([]string{u.pwd}, s.history[userID]...)
+		if len(h) > maxPasswordHistory {
+			h = h[:maxPasswordHistory]
+		}
+		s.history[userID] = h
+	}
+	u.pwd = pwHash
+	s.users[userID] = u
+	return nil
+}
+
+func (s *memoryStorage) PasswordHistory(ctx context.Context, userID string, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	hashes := append([]string{u.pwd}, s.history[userID]...)
+	if n < 1 {
+		n = 1
+	}
+	if len(hashes) > n {
+		hashes = hashes[:n]
+	}
+	return hashes, nil
+}
+
+func (s *memoryStorage) EditUser(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[user.UserID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.firstname = user.FirstName
+	u.lastname = user.LastName
+	u.email = user.Email
+	s.users[user.UserID] = u
+	return nil
+}
+
+// Login behaves like storage.Login, including upgrading outdated password hashes.
+func (s *memoryStorage) Login(ctx context.Context, userID string, password string) bool {
+	s.mu.Lock()
+	u, ok := s.users[userID]
+	s.mu.Unlock()
+	if !ok {
+		log.WithField("uid", userID).Error("Failed login attempt")
+		verifyPassword(password, s.dummyHash)
+		return false
+	}
+	ok, err := verifyPassword(password, u.pwd)
+	if err != nil {
+		log.WithError(err).WithField("uid", userID).Error("Failed to verify password hash.")
+		return false
+	}
+	if !ok {
+		log.WithField("uid", userID).Error("Failed login attempt")
+		return false
+	}
+	if u.disabled {
+		log.WithField("uid", userID).Warn("Login attempt for disabled user.")
+		return false
+	}
+
+	if s.hasher.NeedsRehash(u.pwd) {
+		newHash, err := s.hasher.Hash(password)
+		if err != nil {
+			log.WithError(err).WithField("uid", userID).Error("Failed to rehash password.")
+			return true
+		}
+		s.mu.Lock()
+		if cur, ok := s.users[userID]; ok && cur.pwd == u.pwd {
+			cur.pwd = newHash
+			s.users[userID] = cur
+		}
+		s.mu.Unlock()
+	}
+	return true
+}
+
+func (s *memoryStorage) ListUsers(ctx context.Context, query string, offset int, limit int) ([]User, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := strings.ToLower(query)
+	matches := []User{}
+	for _, u := range s.users {
+		if q == "" || strings.Contains(strings.ToLower(u.uid), q) || strings.Contains(strings.ToLower(u.firstname), q) ||
+			strings.Contains(strings.ToLower(u.lastname), q) || strings.Contains(strings.ToLower(u.email), q) {
+			matches = append(matches, userFromDBUser(u))
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].UserID < matches[j].UserID })
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		return matches[offset : offset+limit], total, nil
+	}
+	return matches[offset:], total, nil
+}
+
+func (s *memoryStorage) CreateUser(ctx context.Context, user User, password string) error {
+	pwHash, err := s.hasher.Hash(password)
+	if err != nil {
+		log.WithError(err).Error("Failed to hash password.")
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user.UserID]; ok {
+		return errUserExists
+	}
+	s.users[user.UserID] = dbUser{
+		uid:       user.UserID,
+		firstname: user.FirstName,
+		lastname:  user.LastName,
+		email:     user.Email,
+		pwd:       pwHash,
+		admin:     user.Admin,
+		disabled:  user.Disabled,
+
+		emailVerified: user.EmailVerified,
+	}
+	return nil
+}
+
+func (s *memoryStorage) SetUserDisabled(ctx context.Context, userID string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.disabled = disabled
+	s.users[userID] = u
+	return nil
+}
+
+func (s *memoryStorage) DeleteUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(s.users, userID)
+	delete(s.recoveryCodes, userID)
+	delete(s.history, userID)
+	s.deleteResetTokens(userID)
+	return nil
+}
+
+func (s *memoryStorage) GetTOTP(ctx context.Context, userID string) (TOTPConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return TOTPConfig{}, sql.ErrNoRows
+	}
+	return u.totp, nil
+}
+
+func (s *memoryStorage) SetTOTP(ctx context.Context, userID string, c TOTPConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.totp = c
+	s.users[userID] = u
+	return nil
+}
+
+func (s *memoryStorage) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok || u.totp.LastStep >= step {
+		return false, nil
+	}
+	u.totp.LastStep = step
+	s.users[userID] = u
+	return true, nil
+}
+
+func (s *memoryStorage) SetRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := map[string]bool{}
+	for _, h := range codeHashes {
+		codes[h] = true
+	}
+	s.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (s *memoryStorage) UseRecoveryCode(ctx context.Context, userID string, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.recoveryCodes[userID][codeHash] {
+		return false, nil
+	}
+	delete(s.recoveryCodes[userID], codeHash)
+	return true, nil
+}
+
+func (s *memoryStorage) CreateResetToken(ctx context.Context, userID string, tokenHash string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetTokens[tokenHash] = resetToken{uid: userID, expires: expires}
+	return nil
+}
+
+func (s *memoryStorage) ResetTokenUser(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.resetTokens[tokenHash]
+	if !ok || !now.Before(t.expires) {
+		return "", sql.ErrNoRows
+	}
+	return t.uid, nil
+}
+
+func (s *memoryStorage) UseResetToken(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.resetTokens[tokenHash]
+	if !ok || !now.Before(t.expires) {
+		return "", sql.ErrNoRows
+	}
+	s.deleteResetTokens(t.uid)
+	return t.uid, nil
+}
+
+// deleteResetTokens must be called with mu held.
+func (s *memoryStorage) deleteResetTokens(userID string) {
+	for h, t := range s.resetTokens {
+		if t.uid == userID {
+			delete(s.resetTokens, h)
+		}
+	}
+}
+
+func (s *memoryStorage) SetPendingEmail(ctx context.Context, userID string, email string, tokenHash string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	u.pendingEmail = email
+	u.emailTokenHash = tokenHash
+	u.emailTokenExpires = expires.Unix()
+	s.users[userID] = u
+	return nil
+}
+
+func (s *memoryStorage) ConfirmEmail(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for uid, u := range s.users {
+		if u.emailTokenHash != tokenHash || u.emailTokenExpires <= now.Unix() || u.pendingEmail == "" {
+			continue
+		}
+		u.email = u.pendingEmail
+		u.emailVerified = true
+		u.pendingEmail = ""
+		u.emailTokenHash = ""
+		u.emailTokenExpires = 0
+		s.users[uid] = u
+		return uid, nil
+	}
+	return "", sql.ErrNoRows
+}
+
+func (s *memoryStorage) SetRevocationReason(ctx context.Context, userID string, serial string, reason int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revocations[userID] == nil {
+		s.revocations[userID] = map[string]int{}
+	}
+	s.revocations[userID][serial] = reason
+	return nil
+}
+
+func (s *memoryStorage) RevocationReasons(ctx context.Context, userID string) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reasons := map[string]int{}
+	for serial, reason := range s.revocations[userID] {
+		reasons[serial] = reason
+	}
+	return reasons, nil
+}
+
+func (s *memoryStorage) CreateRecoveryRequest(ctx context.Context, req recoveryRequest) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req.ID = int64(len(s.recoveries) + 1)
+	s.recoveries = append(s.recoveries, req)
+	return req.ID, nil
+}
+
+func (s *memoryStorage) GetRecoveryRequest(ctx context.Context, id int64) (recoveryRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || id > int64(len(s.recoveries)) {
+		return recoveryRequest{}, sql.ErrNoRows
+	}
+	return s.recoveries[id-1], nil
+}
+
+func (s *memoryStorage) ListRecoveryRequests(ctx context.Context, userID string, status string) ([]recoveryRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := []recoveryRequest{}
+	for i := len(s.recoveries) - 1; i >= 0; i-- {
+		req := s.recoveries[i]
+		if (userID == "" || req.UserID == userID) && (status == "" || req.Status == status) {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, nil
+}
+
+func (s *memoryStorage) UpdateRecoveryRequest(ctx context.Context, id int64, from string, to string, decidedBy string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || id > int64(len(s.recoveries)) || s.recoveries[id-1].Status != from {
+		return sql.ErrNoRows
+	}
+	req := &s.recoveries[id-1]
+	req.Status = to
+	if decidedBy != "" {
+		at := time.Unix(at.Unix(), 0)
+		req.DecidedBy, req.DecidedAt = decidedBy, &at
+	}
+	return nil
+}
+
+func (s *memoryStorage) AddAuditEvent(ctx context.Context, e auditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.ID = int64(len(s.audit) + 1)
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *memoryStorage) ListAuditEvents(ctx context.Context, userID string, limit int) ([]auditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := []auditEvent{}
+	for i := len(s.audit) - 1; i >= 0 && len(events) < limit; i-- {
+		if userID == "" || s.audit[i].UserID == userID {
+			events = append(events, s.audit[i])
+		}
+	}
+	return events, nil
+}
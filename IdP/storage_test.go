@@ -2,22 +2,132 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 )
 
-var testDSN = flag.String("testdsn", "user:pass@(localhost)/imovies", "DSN of the DB to connect to: user:password@/dbname")
+const usersDump = "../ansible/roles/mysql/files/imovies_users.dump"
+
+var testDSN = flag.String("testdsn", "", "DSN of an additional DB to test against, e.g. user:password@(localhost)/imovies")
+
+// newTestStorages returns all backends which can be tested hermetically, each containing the users
+// of imovies_users.dump, plus the one passed via -testdsn. The returned func removes temporary files.
+func newTestStorages(t *testing.T, hasher passwordHasher) (map[string]storageClient, func()) {
+	stores := map[string]storageClient{}
+
+	mem, err := NewStorage("memory://?seed="+usersDump, hasher)
+	if err != nil {
+		t.Fatalf("Failed to create memory storage. %v", err)
+	}
+	stores["memory"] = mem
+
+	dir, err := ioutil.TempDir("", "idp-storage")
+	if err != nil {
+		t.Fatalf("Failed to create tmp dir. %v", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	lite, err := NewStorage("sqlite://"+filepath.Join(dir, "idp.db"), hasher)
+	if err != nil {
+		cleanup()
+		t.Fatalf("Failed to create sqlite storage. %v", err)
+	}
+	// Import the dump into the original schema and migrate it afterwards, like in production.
+	err = lite.(*storage).MigrateUp(context.Background(), 1)
+	if err != nil {
+		cleanup()
+		t.Fatalf("Failed to migrate sqlite storage. %v", err)
+	}
+	f, err := os.Open(usersDump)
+	if err != nil {
+		t.Fatalf("Failed to open dump. %v", err)
+	}
+	defer f.Close()
+	users, err := parseUsersDump(f)
+	if err != nil {
+		t.Fatalf("Failed to parse dump. %v", err)
+	}
+	for _, u := range users {
+		_, err := lite.(*storage).db.Exec(`INSERT INTO users (uid, firstname, lastname, email, pwd) VALUES (?, ?, ?, ?, ?)`,
+			u.uid, u.firstname, u.lastname, u.email, u.pwd)
+		if err != nil {
+			t.Fatalf("Failed to seed sqlite. %v", err)
+		}
+	}
+	err = lite.(*storage).MigrateUp(context.Background(), 0)
+	if err != nil {
+		cleanup()
+		t.Fatalf("Failed to migrate sqlite storage. %v", err)
+	}
+	stores["sqlite"] = lite
+
+	if *testDSN != "" {
+		db, err := NewStorage(*testDSN, hasher)
+		if err != nil {
+			t.Fatalf("Failed to create storage component. %v", err)
+		}
+		stores["testdsn"] = db
+	}
+	return stores, cleanup
+}
+
+func TestParseUsersDump(t *testing.T) {
+	f, err := os.Open(usersDump)
+	if err != nil {
+		t.Fatalf("Failed to open dump. %v", err)
+	}
+	defer f.Close()
+	users, err := parseUsersDump(f)
+	if err != nil {
+		t.Fatalf("Failed to parse dump. %v", err)
+	}
+	if len(users) != 4 {
+		t.Fatalf("Expected 4 users, got %d", len(users))
+	}
+	a3 := users[3]
+	if a3.uid != "a3" || a3.firstname != "Andres Andrea" || a3.lastname != "Anderson" || a3.pwd != "6b97f534c330b5cc78d4cc23e01e48be3377105b" {
+		t.Errorf("Unexpected user %+v", a3)
+	}
+
+	rows, err := parseValues(`('o\'neil','it''s','a,b'),('x',NULL,'');`)
+	if err != nil {
+		t.Fatalf("Failed to parse values. %v", err)
+	}
+	if len(rows) != 2 || rows[0][0] != "o'neil" || rows[0][1] != "it's" || rows[0][2] != "a,b" || rows[1][1] != "" {
+		t.Errorf("Unexpected rows %q", rows)
+	}
+}
 
 // Simple complete test to check for obvious errors
 func TestStorage(t *testing.T) {
 	flag.Parse()
-	db, err := NewStorage(*testDSN)
+	hasher, err := NewPasswordHasher("argon2id")
 	if err != nil {
-		t.Errorf("Failed to create storage component. %v", err)
+		t.Errorf("Failed to create password hasher. %v", err)
 		return
 	}
+	stores, cleanup := newTestStorages(t, hasher)
+	defer cleanup()
+	for name, db := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, db)
+			testUserManagement(t, db)
+			testResetTokens(t, db)
+			testPasswordHistory(t, db)
+			testEmailChange(t, db)
+			testRevocationReasons(t, db)
+			testRecoveryRequests(t, db)
+		})
+	}
+}
 
+func testStorage(t *testing.T, db storageClient) {
 	//We assume the user a3 already exists.
 	log.Infof("Getting user a3")
 	u, err := db.GetUser(context.Background(), "a3")
@@ -74,4 +184,204 @@ func TestStorage(t *testing.T) {
 		return
 	}
 
+	// Unknown users cannot login
+	if db.Login(context.Background(), "nobody", "Astrid") {
+		t.Error("Could login with unknown user")
+	}
+}
+
+func testUserManagement(t *testing.T, db storageClient) {
+	ctx := context.Background()
+	users, total, err := db.ListUsers(ctx, "", 0, 2)
+	if err != nil {
+		t.Fatalf("Failed to list users. %v", err)
+	}
+	if total != 4 || len(users) != 2 || users[0].UserID != "a3" || users[1].UserID != "lb" {
+		t.Errorf("Unexpected first page %v, total %d", users, total)
+	}
+	users, total, err = db.ListUsers(ctx, "SCHL", 0, 10)
+	if err != nil || total != 1 || len(users) != 1 || users[0].UserID != "ms" {
+		t.Errorf("Unexpected search result %v, total %d. %v", users, total, err)
+	}
+	users, total, err = db.ListUsers(ctx, "%", 0, 10)
+	if err != nil || total != 0 || len(users) != 0 {
+		t.Errorf("Wildcards are not escaped: %v, total %d. %v", users, total, err)
+	}
+
+	u := User{UserID: "nu", FirstName: "New", LastName: "User", Email: "nu@imovies.ch"}
+	if err := db.CreateUser(ctx, u, "secret"); err != nil {
+		t.Fatalf("Failed to create user. %v", err)
+	}
+	if err := db.CreateUser(ctx, u, "secret"); err != errUserExists {
+		t.Errorf("Expected errUserExists, got %v", err)
+	}
+	if !db.Login(ctx, "nu", "secret") {
+		t.Error("Could not login new user")
+	}
+
+	if err := db.SetUserDisabled(ctx, "nu", true); err != nil {
+		t.Fatalf("Failed to disable user. %v", err)
+	}
+	if got, _ := db.GetUser(ctx, "nu"); !got.Disabled {
+		t.Error("User not disabled")
+	}
+	if db.Login(ctx, "nu", "secret") {
+		t.Error("Disabled user could login")
+	}
+	if err := db.SetUserDisabled(ctx, "nu", true); err != nil {
+		t.Errorf("Disabling twice failed. %v", err)
+	}
+	if err := db.SetUserDisabled(ctx, "nobody", true); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+
+	if err := db.DeleteUser(ctx, "nu"); err != nil {
+		t.Fatalf("Failed to delete user. %v", err)
+	}
+	if _, err := db.GetUser(ctx, "nu"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for deleted user, got %v", err)
+	}
+	if err := db.DeleteUser(ctx, "nu"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testResetTokens(t *testing.T, db storageClient) {
+	ctx := context.Background()
+	now := time.Now()
+	if err := db.CreateResetToken(ctx, "a3", "h1", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create reset token. %v", err)
+	}
+	db.CreateResetToken(ctx, "a3", "h2", now.Add(time.Hour))
+	db.CreateResetToken(ctx, "a3", "h3", now.Add(-time.Minute))
+	db.CreateResetToken(ctx, "ps", "h4", now.Add(time.Hour))
+
+	if uid, err := db.ResetTokenUser(ctx, "h1", now); uid != "a3" || err != nil {
+		t.Errorf("Expected a3, got %q. %v", uid, err)
+	}
+	if _, err := db.ResetTokenUser(ctx, "h3", now); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for expired token, got %v", err)
+	}
+	if _, err := db.UseResetToken(ctx, "h3", now); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for expired token, got %v", err)
+	}
+	if uid, err := db.UseResetToken(ctx, "h1", now); uid != "a3" || err != nil {
+		t.Errorf("Expected a3, got %q. %v", uid, err)
+	}
+	if _, err := db.UseResetToken(ctx, "h1", now); err != sql.ErrNoRows {
+		t.Errorf("Token used twice. %v", err)
+	}
+	if _, err := db.UseResetToken(ctx, "h2", now); err != sql.ErrNoRows {
+		t.Errorf("Other token of the user not invalidated. %v", err)
+	}
+	if uid, err := db.UseResetToken(ctx, "h4", now); uid != "ps" || err != nil {
+		t.Errorf("Token of other user invalidated. %v", err)
+	}
+}
+
+func testPasswordHistory(t *testing.T, db storageClient) {
+	ctx := context.Background()
+	for _, pw := range []string{"first", "second", "third"} {
+		if err := db.ChangePassword(ctx, "lb", pw); err != nil {
+			t.Fatalf("Failed to change password. %v", err)
+		}
+	}
+	hashes, err := db.PasswordHistory(ctx, "lb", 3)
+	if err != nil {
+		t.Fatalf("Failed to get password history. %v", err)
+	}
+	if len(hashes) != 3 {
+		t.Fatalf("Expected 3 hashes, got %d", len(hashes))
+	}
+	for i, pw := range []string{"third", "second", "first"} {
+		if ok, _ := verifyPassword(pw, hashes[i]); !ok {
+			t.Errorf("Hash %d does not match %s", i, pw)
+		}
+	}
+	if _, err := db.PasswordHistory(ctx, "nobody", 3); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testEmailChange(t *testing.T, db storageClient) {
+	ctx := context.Background()
+	now := time.Now()
+	if u, _ := db.GetUser(ctx, "ms"); !u.EmailVerified {
+		t.Error("Existing address not verified.")
+	}
+	if err := db.SetPendingEmail(ctx, "ms", "new@imovies.ch", "h1", now.Add(-time.Minute)); err != nil {
+		t.Fatalf("Failed to set pending email. %v", err)
+	}
+	if _, err := db.ConfirmEmail(ctx, "h1", now); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for expired token, got %v", err)
+	}
+	db.SetPendingEmail(ctx, "ms", "new@imovies.ch", "h2", now.Add(time.Hour))
+	if u, _ := db.GetUser(ctx, "ms"); u.Email != "ms@imovies.ch" || u.PendingEmail != "new@imovies.ch" {
+		t.Errorf("Unexpected user %+v", u)
+	}
+	if uid, err := db.ConfirmEmail(ctx, "h2", now); uid != "ms" || err != nil {
+		t.Errorf("Expected ms, got %q. %v", uid, err)
+	}
+	if u, _ := db.GetUser(ctx, "ms"); u.Email != "new@imovies.ch" || u.PendingEmail != "" || !u.EmailVerified {
+		t.Errorf("Unexpected user %+v", u)
+	}
+	if _, err := db.ConfirmEmail(ctx, "h2", now); err != sql.ErrNoRows {
+		t.Errorf("Token used twice. %v", err)
+	}
+	if err := db.SetPendingEmail(ctx, "nobody", "x@imovies.ch", "h3", now); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testRevocationReasons(t *testing.T, db storageClient) {
+	ctx := context.Background()
+	if err := db.SetRevocationReason(ctx, "a3", "01:02", 1); err != nil {
+		t.Fatalf("Failed to set revocation reason. %v", err)
+	}
+	db.SetRevocationReason(ctx, "a3", "01:02", 4)
+	db.SetRevocationReason(ctx, "ps", "01:03", 5)
+	reasons, err := db.RevocationReasons(ctx, "a3")
+	if err != nil {
+		t.Fatalf("Failed to get revocation reasons. %v", err)
+	}
+	if len(reasons) != 1 || reasons["01:02"] != 4 {
+		t.Errorf("Unexpected reasons %v", reasons)
+	}
+}
+
+func testRecoveryRequests(t *testing.T, db storageClient) {
+	ctx := context.Background()
+	now := time.Now()
+	id, err := db.CreateRecoveryRequest(ctx, recoveryRequest{UserID: "a3", Serial: "01:02", Status: recoveryPending, RequestedAt: now})
+	if err != nil {
+		t.Fatalf("Failed to create recovery request. %v", err)
+	}
+	db.CreateRecoveryRequest(ctx, recoveryRequest{UserID: "ps", Serial: "01:03", Status: recoveryPending, RequestedAt: now})
+	if err := db.UpdateRecoveryRequest(ctx, id, recoveryPending, recoveryApproved, "admin", now); err != nil {
+		t.Fatalf("Failed to approve. %v", err)
+	}
+	if err := db.UpdateRecoveryRequest(ctx, id, recoveryPending, recoveryRejected, "admin", now); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for decided request, got %v", err)
+	}
+	req, err := db.GetRecoveryRequest(ctx, id)
+	if err != nil || req.Status != recoveryApproved || req.DecidedBy != "admin" || req.DecidedAt == nil || req.DecidedAt.Unix() != now.Unix() {
+		t.Errorf("Unexpected request %+v. %v", req, err)
+	}
+	if reqs, _ := db.ListRecoveryRequests(ctx, "", recoveryPending); len(reqs) != 1 || reqs[0].UserID != "ps" {
+		t.Errorf("Unexpected pending requests %+v", reqs)
+	}
+	if _, err := db.GetRecoveryRequest(ctx, 1000); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+
+	for _, action := range []string{"first", "second", "third"} {
+		if err := db.AddAuditEvent(ctx, auditEvent{Time: now, Actor: "a3", UserID: "a3", Action: action}); err != nil {
+			t.Fatalf("Failed to add audit event. %v", err)
+		}
+	}
+	db.AddAuditEvent(ctx, auditEvent{Time: now, Actor: "admin", UserID: "ps", Action: "other"})
+	events, err := db.ListAuditEvents(ctx, "a3", 2)
+	if err != nil || len(events) != 2 || events[0].Action != "third" || events[1].Action != "second" {
+		t.Errorf("Unexpected audit events %+v. %v", events, err)
+	}
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// An address sees the failures of many users, so it is only locked after more of them.
+	ipThresholdFactor = 4
+	// Every address may try to log in at most ipRate times per second, with bursts of ipBurst.
+	ipRate  = 1
+	ipBurst = 10
+	// At most mailBurst mails are sent to an account at once, then one every mailInterval, no
+	// matter from how many addresses they are asked for.
+	mailBurst    = 3
+	mailInterval = 20 * time.Minute
+)
+
+// loginThrottle tracks failed logins per username and per source address. After every failure the
+// next attempt is delayed exponentially, and after threshold failures the key is locked out
+// completely. State is kept in memory, so it is per instance and lost on restart.
+type loginThrottle struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	threshold int
+	lockout   time.Duration
+	baseDelay time.Duration
+	users     map[string]*failures
+	ips       map[string]*failures
+	limiters  map[string]*usedLimiter
+	// mails limits the mails per username, see AllowMail.
+	mails     map[string]*usedLimiter
+	lastPrune time.Time
+}
+
+// usedLimiter is a rate limiter and when it was last used, for pruning.
+type usedLimiter struct {
+	*rate.Limiter
+	last time.Time
+}
+
+type failures struct {
+	count        int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newLoginThrottle(threshold int, lockout time.Duration, baseDelay time.Duration) *loginThrottle {
+	return &loginThrottle{
+		now:       time.Now,
+		threshold: threshold,
+		lockout:   lockout,
+		baseDelay: baseDelay,
+		users:     map[string]*failures{},
+		ips:       map[string]*failures{},
+		limiters:  map[string]*usedLimiter{},
+		mails:     map[string]*usedLimiter{},
+	}
+}
+
+// AllowMail reports whether another mail, like a password reset link, may be sent to user, and
+// counts it if so.
+func (t *loginThrottle) AllowMail(user string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.prune(now)
+	key := normalizeUser(user)
+	lim, ok := t.mails[key]
+	if !ok {
+		lim = &usedLimiter{Limiter: rate.NewLimiter(rate.Every(mailInterval), mailBurst)}
+		t.mails[key] = lim
+	}
+	lim.last = now
+	return lim.AllowN(now, 1)
+}
+
+// Allow reports whether a login attempt for user from ip may proceed. It must be called before
+// checking the credentials, so that locked out users cannot learn whether a password is correct.
+func (t *loginThrottle) Allow(user string, ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.prune(now)
+
+	lim, ok := t.limiters[ip]
+	if !ok {
+		lim = &usedLimiter{Limiter: rate.NewLimiter(ipRate, ipBurst)}
+		t.limiters[ip] = lim
+	}
+	lim.last = now
+	if !lim.AllowN(now, 1) {
+		return false
+	}
+	if f, ok := t.users[normalizeUser(user)]; ok && now.Before(f.blockedUntil) {
+		return false
+	}
+	if f, ok := t.ips[ip]; ok && now.Before(f.blockedUntil) {
+		return false
+	}
+	return true
+}
+
+// Failure records a failed attempt.
+func (t *loginThrottle) Failure(user string, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.record(t.users, normalizeUser(user), t.threshold, now)
+	t.record(t.ips, ip, t.threshold*ipThresholdFactor, now)
+}
+
+func (t *loginThrottle) record(m map[string]*failures, key string, threshold int, now time.Time) {
+	f, ok := m[key]
+	if !ok || now.Sub(f.last) > t.lockout {
+		// Old failures are forgotten after a quiet period.
+		f = &failures{}
+		m[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= threshold {
+		f.blockedUntil = now.Add(t.lockout)
+		return
+	}
+	delay := t.baseDelay << uint(f.count-1)
+	if delay > t.lockout || delay <= 0 {
+		delay = t.lockout
+	}
+	f.blockedUntil = now.Add(delay)
+}
+
+// Success forgets the failures of user. Those of the address are kept, otherwise an attacker could
+// reset them by logging into their own account.
+func (t *loginThrottle) Success(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.users, normalizeUser(user))
+}
+
+// Unlock lifts a lockout of user, e.g. on request of an administrator.
+func (t *loginThrottle) Unlock(user string) {
+	t.Success(user)
+}
+
+// prune drops entries which no longer have any effect. Must be called with mu held.
+func (t *loginThrottle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for _, m := range []map[string]*failures{t.users, t.ips} {
+		for k, f := range m {
+			if now.Sub(f.last) > t.lockout && now.After(f.blockedUntil) {
+				delete(m, k)
+			}
+		}
+	}
+	for k, lim := range t.limiters {
+		// Once the bucket is full again it behaves exactly like a new limiter.
+		if now.Sub(lim.last) > ipBurst*time.Second/ipRate {
+			delete(t.limiters, k)
+		}
+	}
+	for k, lim := range t.mails {
+		if now.Sub(lim.last) > mailBurst*mailInterval {
+			delete(t.mails, k)
+		}
+	}
+}
+
+// normalizeUser maps usernames which log into the same account to the same key. MySQL compares
+// uids case insensitively.
+func normalizeUser(user string) string {
+	return strings.ToLower(strings.TrimSpace(user))
+}
+
+// remoteHost returns the address of the peer of the connection r came in on.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
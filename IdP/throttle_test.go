@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	th := newLoginThrottle(3, 10*time.Minute, time.Second)
+	th.now = func() time.Time { return now }
+
+	if !th.Allow("a3", "10.0.0.1") {
+		t.Fatal("First attempt not allowed.")
+	}
+	th.Failure("a3", "10.0.0.1")
+	if th.Allow("A3", "10.0.0.2") {
+		t.Error("Attempt allowed during backoff.")
+	}
+	now = now.Add(time.Second)
+	if !th.Allow("a3", "10.0.0.2") {
+		t.Error("Attempt not allowed after backoff.")
+	}
+	th.Failure("a3", "10.0.0.2")
+	now = now.Add(time.Second)
+	if th.Allow("a3", "10.0.0.2") {
+		t.Error("Backoff not doubled.")
+	}
+	now = now.Add(time.Second)
+	th.Failure("a3", "10.0.0.3")
+	now = now.Add(time.Minute)
+	if th.Allow("a3", "10.0.0.4") {
+		t.Error("Attempt allowed after lockout.")
+	}
+	if !th.Allow("a4", "10.0.0.4") {
+		t.Error("Other user affected by lockout.")
+	}
+	th.Unlock("a3")
+	if !th.Allow("a3", "10.0.0.4") {
+		t.Error("Attempt not allowed after unlock.")
+	}
+
+	// Failures expire after the lockout duration.
+	th.Failure("b3", "10.0.0.5")
+	th.Failure("b3", "10.0.0.5")
+	now = now.Add(11 * time.Minute)
+	th.Failure("b3", "10.0.0.5")
+	now = now.Add(time.Second)
+	if !th.Allow("b3", "10.0.0.5") {
+		t.Error("Old failures were not forgotten.")
+	}
+}
+
+func TestLoginThrottleIP(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	th := newLoginThrottle(3, 10*time.Minute, time.Millisecond)
+	th.now = func() time.Time { return now }
+
+	// Spraying one password over many accounts locks the address.
+	users := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"}
+	for _, u := range users {
+		now = now.Add(2 * time.Second)
+		if !th.Allow(u, "10.0.0.1") {
+			t.Fatalf("Attempt for %s not allowed.", u)
+		}
+		th.Failure(u, "10.0.0.1")
+	}
+	now = now.Add(time.Second)
+	if th.Allow("m", "10.0.0.1") {
+		t.Error("Address not locked out.")
+	}
+	if !th.Allow("m", "10.0.0.2") {
+		t.Error("Other address affected by lockout.")
+	}
+
+	// Rate limit per address, independent of failures.
+	allowed := 0
+	for i := 0; i < 2*ipBurst; i++ {
+		if th.Allow("n", "10.0.0.3") {
+			allowed++
+		}
+	}
+	if allowed != ipBurst {
+		t.Errorf("Allowed %d attempts in a burst, expected %d", allowed, ipBurst)
+	}
+}
+
+func TestMailLimit(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	th := newLoginThrottle(3, 10*time.Minute, time.Second)
+	th.now = func() time.Time { return now }
+
+	for i := 0; i < mailBurst; i++ {
+		if !th.AllowMail("a3") {
+			t.Fatalf("Mail %d not allowed.", i)
+		}
+	}
+	if th.AllowMail(" A3 ") {
+		t.Error("Mail allowed after burst.")
+	}
+	if !th.AllowMail("a4") {
+		t.Error("Other user affected by mail limit.")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP as specified in RFC 6238 with the parameters every authenticator app understands: HMAC-SHA1,
+// 6 digits and a 30 second period.
+const (
+	totpIssuer        = "fadalax SSO"
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1 // accepted steps before and after the current one, to allow for clock drift
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPConfig is the second factor configuration of a user. An enrollment which has not been
+// confirmed yet has a Secret but is not Enabled.
+type TOTPConfig struct {
+	Secret  string // base32, as shown to the user
+	Enabled bool
+	// LastStep is the last time step a code was accepted for. Codes of this or earlier steps are
+	// rejected, so that every code can only be used once.
+	LastStep int64
+}
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURI returns the otpauth:// provisioning URI, usually rendered as a QR code.
+func totpURI(uid string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + uid)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// hotp computes the HOTP value of RFC 4226 for key and counter.
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, v%mod)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// checkTOTP returns the time step code is valid for, or -1 if it is not valid around now.
+func checkTOTP(secret string, code string, now time.Time) (int64, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return -1, fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return -1, nil
+	}
+	cur := totpStep(now)
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return -1, nil
+}
+
+// generateRecoveryCodes returns fresh one-time recovery codes and the hashes to store. The codes
+// have enough entropy that a fast hash is sufficient.
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(totpEncoding.EncodeToString(b))
+		c = c[:4] + "-" + c[4:]
+		codes = append(codes, c)
+		hashes = append(hashes, hashRecoveryCode(c))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes code, so that case and dashes do not matter, and hashes it.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238 appendix B, truncated to 6 digits.
+func TestTOTPVectors(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		step, err := checkTOTP(secret, code, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("Failed to check code. %v", err)
+		}
+		if step != unix/totpPeriod {
+			t.Errorf("Code %s at %d: got step %d, expected %d", code, unix, step, unix/totpPeriod)
+		}
+	}
+	step, _ := checkTOTP(secret, "287082", time.Unix(59+3*totpPeriod, 0))
+	if step != -1 {
+		t.Error("Accepted a code outside of the allowed skew.")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("a3", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/fadalax%20SSO:a3?") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+}
+
+func TestSecondFactor(t *testing.T) {
+	hasher, _ := NewPasswordHasher("bcrypt")
+	db, err := NewStorage("memory://?seed="+usersDump, hasher)
+	if err != nil {
+		t.Fatalf("Failed to create storage. %v", err)
+	}
+	s := server{db: db}
+	ctx := context.Background()
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret. %v", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	code := hotp(key, uint64(totpStep(time.Now())))
+
+	if ok, _ := s.checkSecondFactor(ctx, "a3", code); ok {
+		t.Error("Accepted code without enabled TOTP.")
+	}
+	db.SetTOTP(ctx, "a3", TOTPConfig{Secret: secret, Enabled: true})
+	if ok, err := s.checkSecondFactor(ctx, "a3", code); !ok || err != nil {
+		t.Errorf("Valid code not accepted. %v", err)
+	}
+	if ok, _ := s.checkSecondFactor(ctx, "a3", code); ok {
+		t.Error("Replayed code accepted.")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("Failed to generate recovery codes. %v", err)
+	}
+	db.SetRecoveryCodes(ctx, "a3", hashes)
+	if ok, _ := s.checkSecondFactor(ctx, "a3", strings.ToUpper(codes[0])); !ok {
+		t.Error("Recovery code not accepted.")
+	}
+	if ok, _ := s.checkSecondFactor(ctx, "a3", codes[0]); ok {
+		t.Error("Recovery code accepted twice.")
+	}
+}
+
+func TestLoginState(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+	token, err := signState(key, loginState{Challenge: "c", Subject: "a3", AMR: []string{amrPassword}, Expires: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign state. %v", err)
+	}
+	st, err := verifyLoginState(key, token, "c", now)
+	if err != nil || st.Subject != "a3" {
+		t.Errorf("Failed to verify state %+v. %v", st, err)
+	}
+	if _, err := verifyLoginState(key, token, "other", now); err == nil {
+		t.Error("State accepted for a different challenge.")
+	}
+	if _, err := verifyLoginState(key, token, "c", now.Add(2*time.Minute)); err == nil {
+		t.Error("Expired state accepted.")
+	}
+	if _, err := verifyLoginState([]byte("other"), token, "c", now); err == nil {
+		t.Error("State with wrong signature accepted.")
+	}
+}
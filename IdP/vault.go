@@ -3,25 +3,32 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
-	"os/exec"
 	"path"
-	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
 const alphanumeric = "[[:alnum:]]"
 
+var (
+	errCertNotFound   = errors.New("certificate not found")
+	errKeyNotEscrowed = errors.New("no escrowed key")
+)
+
 type vault struct {
 	c   *api.Logical
 	sys *api.Sys
+	cfg Config
 }
 
-func NewVaultClient(vaultAddress string, token string) (*vault, error) {
+func NewVaultClient(vaultAddress string, token string, cfg Config) (*vault, error) {
 	// Reads token from VAULT_TOKEN automatically.
 	c, err := api.NewClient(&api.Config{
 		Address: vaultAddress,
@@ -37,10 +44,10 @@ func NewVaultClient(vaultAddress string, token string) (*vault, error) {
 		log.Error("No VAULT_TOKEN set.")
 		return nil, fmt.Errorf("missing vault client token")
 	}
-	return &vault{c: c.Logical(), sys: c.Sys()}, nil
+	return &vault{c: c.Logical(), sys: c.Sys(), cfg: cfg}, nil
 }
 
-func NewVaultUserClient(vaultAddress string, name string, jwtoken string) (*vault, error) {
+func NewVaultUserClient(vaultAddress string, name string, jwtoken string, cfg Config) (*vault, error) {
 	// Reads token from VAULT_TOKEN automatically.
 	c, err := api.NewClient(&api.Config{
 		Address: vaultAddress,
@@ -66,7 +73,7 @@ func NewVaultUserClient(vaultAddress string, name string, jwtoken string) (*vaul
 	if c.Token() == "" {
 		return nil, fmt.Errorf("missing vault client token")
 	}
-	return &vault{c: c.Logical(), sys: c.Sys()}, nil
+	return &vault{c: c.Logical(), sys: c.Sys(), cfg: cfg}, nil
 }
 
 func (v *vault) PKIRoleExists(name string) (bool, error) {
@@ -100,7 +107,7 @@ func (v *vault) CreatePKIUser(name string) error {
 		Type:        "pki",
 		Description: fmt.Sprintf("PKI for user %s", name),
 		Config: api.MountConfigInput{
-			MaxLeaseTTL: "43800h",
+			MaxLeaseTTL: v.cfg.PKI.CATTL,
 		},
 	}
 	err := v.sys.Mount(mountPath, mountInput)
@@ -111,7 +118,7 @@ func (v *vault) CreatePKIUser(name string) error {
 
 	// Generate intermediate
 	interCAReq, err := v.c.Write(fmt.Sprintf("%s/intermediate/generate/internal", mountPath), map[string]interface{}{
-		"common_name": fmt.Sprintf("%s.fadalax.tech", name),
+		"common_name": fmt.Sprintf("%s.%s", name, v.cfg.Domain),
 	})
 	if err != nil {
 		l.WithError(err).Error("Failed to generate intermediate.")
@@ -122,7 +129,7 @@ func (v *vault) CreatePKIUser(name string) error {
 	interCA, err := v.c.Write("pki/root/sign-intermediate", map[string]interface{}{
 		"csr":    interCAReq.Data["csr"],
 		"format": "pem_bundle",
-		"ttl":    "43800h",
+		"ttl":    v.cfg.PKI.CATTL,
 	})
 	if err != nil {
 		l.WithError(err).Error("Failed to sign intermediate.")
@@ -141,15 +148,15 @@ func (v *vault) CreatePKIUser(name string) error {
 	// Note that we depend on a lot of secure defaults here, such as key type and length.
 	_, err = v.c.Write(fmt.Sprintf("%s/roles/%s", mountPath, name), map[string]interface{}{
 		"allow_localhost":       false,
-		"allowed_domains":       []string{fmt.Sprintf("%s@fadalax.tech", name)},
+		"allowed_domains":       []string{v.cfg.certEmail(name)},
 		"enforce_hostnames":     true,
 		"allow_bare_domains":    true,
 		"allow_ip_sans":         false,
 		"server_flag":           false, // Should not be used as server certs.
 		"client_flag":           true,  // Since we are want to generate certs which can be used for auth.
 		"email_protection_flag": true,  // Emails are the other core purpose.
-		"organization":          "imovies",
-		"country":               "CH",
+		"organization":          v.cfg.PKI.Organization,
+		"country":               v.cfg.PKI.Country,
 	})
 	if err != nil {
 		l.WithError(err).Error("Failed to create PKI role.")
@@ -167,8 +174,8 @@ func (v *vault) CreatePKIUser(name string) error {
 
 	// Add oidc role
 	_, err = v.c.Write(fmt.Sprintf("/auth/oidc/role/%s", name), map[string]interface{}{
-		"bound_audiences":       "vault",
-		"allowed_redirect_uris": "https://vault.fadalax.tech:8200/ui/vault/auth/oidc/oidc/callback",
+		"bound_audiences":       v.cfg.Tokens.VaultAudience,
+		"allowed_redirect_uris": v.cfg.PKI.VaultRedirectURI,
 		"user_claim":            "sub",
 		"policies":              []string{fmt.Sprintf("pki-user/%s", name), fmt.Sprintf("kv-user/%s", name)},
 		"bound_subject":         name,
@@ -180,7 +187,7 @@ func (v *vault) CreatePKIUser(name string) error {
 
 	// Add jwt role
 	_, err = v.c.Write(fmt.Sprintf("/auth/jwt/role/%s", name), map[string]interface{}{
-		"bound_audiences": "fadalax-frontend",
+		"bound_audiences": v.cfg.Tokens.Audience,
 		"user_claim":      "sub",
 		"policies":        []string{fmt.Sprintf("pki-user/%s", name), fmt.Sprintf("kv-user/%s", name)},
 		"bound_subject":   name,
@@ -197,7 +204,7 @@ func (v *vault) CreatePKIUser(name string) error {
 		Type:        "kv",
 		Description: fmt.Sprintf("Key value storage for keys of user %s", name),
 		Config: api.MountConfigInput{
-			MaxLeaseTTL: "43800h",
+			MaxLeaseTTL: v.cfg.PKI.CATTL,
 		},
 	}
 	err = v.sys.Mount(mountPath, mountInput)
@@ -206,11 +213,7 @@ func (v *vault) CreatePKIUser(name string) error {
 		return err
 	}
 
-	// Add policy
-	_, err = v.c.Write(fmt.Sprintf("/sys/policy%s", mountPath), map[string]interface{}{
-		"policy": fmt.Sprintf("path \"%s/*\" {capabilities = [ \"create\", \"read\", \"update\", \"delete\", \"list\", \"sudo\" ]}", mountPath),
-	})
-	if err != nil {
+	if err := v.writeKVPolicy(name); err != nil {
 		l.WithError(err).Error("Failed to create kv policy.")
 		return err
 	}
@@ -241,57 +244,89 @@ func (v *vault) CertificateIsValid(pkiMount string, certSerial string) (bool, er
 	return ts == 0 || time.Unix(ts, 0).After(time.Now()), nil
 }
 
-func (v *vault) GetCert(ctx context.Context, name string) ([]byte, error) {
+// issuedCert is a key and certificate issued by Vault, PEM encoded.
+type issuedCert struct {
+	signedCert
+	PrivateKey string
+}
+
+// IssueCert has the PKI of the user issue a new key and certificate. The key is escrowed in the KV
+// mount of the user.
+func (v *vault) IssueCert(ctx context.Context, name string) (issuedCert, error) {
 	l := log.WithField("name", name)
 	if !regexp.MustCompile(alphanumeric).MatchString(name) {
 		l.Error("Invalid name format.")
-		return nil, fmt.Errorf("invalid name format")
+		return issuedCert{}, fmt.Errorf("invalid name format")
 	}
 	mountPath := fmt.Sprintf("/pki-user/%s", name)
 	cert, err := v.c.Write(fmt.Sprintf("%s/issue/%s", mountPath, name), map[string]interface{}{
-		"common_name": fmt.Sprintf("%s@fadalax.tech", name),
-		"ttl":         "336h",
+		"common_name": v.cfg.certEmail(name),
+		"ttl":         v.cfg.PKI.CertTTL,
 	})
 	if err != nil {
 		l.WithError(err).Error("Failed to issue cert.")
-		return nil, err
+		return issuedCert{}, err
+	}
+	if cert == nil {
+		return issuedCert{}, fmt.Errorf("empty response from vault")
 	}
 
-	dir, err := ioutil.TempDir("", "cert")
+	ic, err := issuedCertFromData(cert.Data)
 	if err != nil {
-		l.WithError(err).Error("Failed to create tmp dir.")
-		return nil, err
+		return issuedCert{}, err
 	}
 
-	// defer os.RemoveAll(dir) // clean up
-
-	certSerial := cert.Data["serial_number"].(string)
 	// save the private key into the users KV
-	_, err = v.c.Write(fmt.Sprintf("/kv-user/%s/%s", name, certSerial), cert.Data)
+	_, err = v.c.Write(fmt.Sprintf("/kv-user/%s/%s", name, ic.Serial), cert.Data)
 	if err != nil {
 		l.WithError(err).Error("Failed to archive cert in vault")
-		return nil, err
+		return issuedCert{}, err
 	}
+	l.Info("Issued Certificate")
+	return ic, nil
+}
 
-	priv := filepath.Join(dir, "private.key")
-	if err := ioutil.WriteFile(priv, []byte(cert.Data["private_key"].(string)), 0666); err != nil {
-		l.WithError(err).Error("Failed to write key.")
-		return nil, err
-	}
-	certf := filepath.Join(dir, "cert.pem")
-	if err := ioutil.WriteFile(certf, []byte(cert.Data["issuing_ca"].(string)+"\n"+cert.Data["certificate"].(string)), 0666); err != nil {
-		l.WithError(err).Error("Failed to write cert.")
-		return nil, err
+// SignCSR signs csr, PEM encoded, with the PKI of the user. The CSR must have been validated, see
+// validateCSR.
+func (v *vault) SignCSR(ctx context.Context, name string, csr string) (signedCert, error) {
+	l := log.WithField("name", name)
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		l.Error("Invalid name format.")
+		return signedCert{}, fmt.Errorf("invalid name format")
 	}
-
-	res, err := exec.CommandContext(ctx, "/usr/bin/openssl", "pkcs12", "-export", "-inkey", priv, "-in", certf, "-password", "pass:").Output()
+	mountPath := fmt.Sprintf("/pki-user/%s", name)
+	sec, err := v.c.Write(fmt.Sprintf("%s/sign/%s", mountPath, name), map[string]interface{}{
+		"csr":         csr,
+		"common_name": v.cfg.certEmail(name),
+		"ttl":         v.cfg.PKI.CertTTL,
+		"format":      "pem",
+	})
 	if err != nil {
-		l.WithError(err).Error("Failed to convert file.")
-		return nil, err
+		l.WithError(err).Error("Failed to sign CSR.")
+		return signedCert{}, err
+	}
+	if sec == nil {
+		return signedCert{}, fmt.Errorf("empty response from vault")
+	}
+	c := signedCert{}
+	c.Certificate, _ = sec.Data["certificate"].(string)
+	c.Serial, _ = sec.Data["serial_number"].(string)
+	if chain, ok := sec.Data["ca_chain"].([]interface{}); ok {
+		for _, ca := range chain {
+			if p, ok := ca.(string); ok {
+				c.CAChain = append(c.CAChain, p)
+			}
+		}
 	}
-	l.Info("Issued Certificate")
-
-	return res, nil
+	if len(c.CAChain) == 0 {
+		if ca, ok := sec.Data["issuing_ca"].(string); ok {
+			c.CAChain = []string{ca}
+		}
+	}
+	if c.Certificate == "" {
+		return signedCert{}, fmt.Errorf("no certificate in vault response")
+	}
+	return c, nil
 }
 
 func (v *vault) RevokeCerts(ctx context.Context, name string) error {
@@ -324,3 +359,249 @@ func (v *vault) RevokeCerts(ctx context.Context, name string) error {
 
 	return nil
 }
+
+// ListUserPKIs returns the names of all users with a PKI mount.
+func (v *vault) ListUserPKIs() ([]string, error) {
+	mounts, err := v.sys.ListMounts()
+	if err != nil {
+		log.WithError(err).Error("Failed to list mounts.")
+		return nil, err
+	}
+	var names []string
+	for p, m := range mounts {
+		if m.Type != "pki" || !strings.HasPrefix(p, "pki-user/") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(strings.TrimPrefix(p, "pki-user/"), "/"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeKVPolicy sets the policy of the KV mount of a user. Users may only escrow keys, reading them
+// back needs a key recovery request, see RecoverKey.
+func (v *vault) writeKVPolicy(name string) error {
+	_, err := v.c.Write(fmt.Sprintf("/sys/policy/kv-user/%s", name), map[string]interface{}{
+		"policy": fmt.Sprintf("path \"kv-user/%s/*\" {capabilities = [ \"create\", \"update\" ]}", name),
+	})
+	return err
+}
+
+// UpdateKVPolicies rewrites the policies of the KV mounts of all users, see writeKVPolicy.
+func (v *vault) UpdateKVPolicies(ctx context.Context) error {
+	names, err := v.ListUserPKIs()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := v.writeKVPolicy(name); err != nil {
+			log.WithError(err).WithField("name", name).Error("Failed to update kv policy.")
+			return err
+		}
+	}
+	return nil
+}
+
+// issuedCertFromData reads the response of the issue endpoint of a PKI mount, which is also what
+// is escrowed.
+func issuedCertFromData(data map[string]interface{}) (issuedCert, error) {
+	ic := issuedCert{}
+	ic.Certificate, _ = data["certificate"].(string)
+	ic.Serial, _ = data["serial_number"].(string)
+	ic.PrivateKey, _ = data["private_key"].(string)
+	if ca, ok := data["issuing_ca"].(string); ok {
+		ic.CAChain = []string{ca}
+	}
+	if ic.Certificate == "" || ic.PrivateKey == "" || ic.Serial == "" {
+		return issuedCert{}, fmt.Errorf("incomplete vault response")
+	}
+	return ic, nil
+}
+
+// ReadEscrowedKey returns the key and certificate escrowed by IssueCert, or errKeyNotEscrowed.
+// Keys of certificates signed from a CSR are never known to Vault.
+func (v *vault) ReadEscrowedKey(ctx context.Context, name string, serial string) (issuedCert, error) {
+	l := log.WithFields(log.Fields{"name": name, "serial": serial})
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		l.Error("Invalid name format.")
+		return issuedCert{}, fmt.Errorf("invalid name format")
+	}
+	sec, err := v.c.Read(fmt.Sprintf("/kv-user/%s/%s", name, serial))
+	if err != nil {
+		l.WithError(err).Error("Failed to read escrowed key.")
+		return issuedCert{}, err
+	}
+	if sec == nil {
+		return issuedCert{}, errKeyNotEscrowed
+	}
+	return issuedCertFromData(sec.Data)
+}
+
+// vaultCert is a certificate stored in a PKI mount.
+type vaultCert struct {
+	Serial      string
+	Certificate string
+	// RevokedAt is zero if the certificate has not been revoked.
+	RevokedAt time.Time
+}
+
+// ListCerts returns all certificates issued by the PKI of a user.
+func (v *vault) ListCerts(ctx context.Context, name string) ([]vaultCert, error) {
+	l := log.WithField("name", name)
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		l.Error("Invalid name format.")
+		return nil, fmt.Errorf("invalid name format")
+	}
+	mountPath := fmt.Sprintf("/pki-user/%s", name)
+	certList, err := v.c.List(fmt.Sprintf("%s/certs", mountPath))
+	if err != nil {
+		l.WithError(err).Error("Failed to list certs.")
+		return nil, err
+	}
+	if certList == nil {
+		return nil, nil
+	}
+	keys, _ := certList.Data["keys"].([]interface{})
+	certs := make([]vaultCert, 0, len(keys))
+	for _, k := range keys {
+		serial, ok := k.(string)
+		if !ok {
+			continue
+		}
+		c, err := v.ReadCert(ctx, name, serial)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+// ReadCert returns a certificate issued by the PKI of a user or errCertNotFound.
+func (v *vault) ReadCert(ctx context.Context, name string, serial string) (vaultCert, error) {
+	l := log.WithFields(log.Fields{"name": name, "serial": serial})
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		l.Error("Invalid name format.")
+		return vaultCert{}, fmt.Errorf("invalid name format")
+	}
+	sec, err := v.c.Read(fmt.Sprintf("/pki-user/%s/cert/%s", name, serial))
+	if err != nil {
+		l.WithError(err).Error("Failed to read cert.")
+		return vaultCert{}, err
+	}
+	if sec == nil {
+		return vaultCert{}, errCertNotFound
+	}
+	c := vaultCert{Serial: serial}
+	c.Certificate, _ = sec.Data["certificate"].(string)
+	if c.Certificate == "" {
+		return vaultCert{}, errCertNotFound
+	}
+	if rts, ok := sec.Data["revocation_time"].(json.Number); ok {
+		ts, err := rts.Int64()
+		if err != nil {
+			return vaultCert{}, err
+		}
+		if ts != 0 {
+			c.RevokedAt = time.Unix(ts, 0)
+		}
+	}
+	return c, nil
+}
+
+// RevokeCert revokes a single certificate issued by the PKI of a user and returns the revocation
+// time.
+func (v *vault) RevokeCert(ctx context.Context, name string, serial string) (time.Time, error) {
+	l := log.WithFields(log.Fields{"name": name, "serial": serial})
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		l.Error("Invalid name format.")
+		return time.Time{}, fmt.Errorf("invalid name format")
+	}
+	sec, err := v.c.Write(fmt.Sprintf("/pki-user/%s/revoke", name), map[string]interface{}{
+		"serial_number": serial,
+	})
+	if err != nil {
+		l.WithError(err).Error("Failed to revoke cert.")
+		return time.Time{}, err
+	}
+	l.Info("Revoked cert")
+	if sec != nil {
+		if rts, ok := sec.Data["revocation_time"].(json.Number); ok {
+			if ts, err := rts.Int64(); err == nil && ts != 0 {
+				return time.Unix(ts, 0), nil
+			}
+		}
+	}
+	return time.Now(), nil
+}
+
+// ReadCRL returns the DER encoded CRL of the PKI of a user.
+func (v *vault) ReadCRL(ctx context.Context, name string) ([]byte, error) {
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		log.WithField("name", name).Error("Invalid name format.")
+		return nil, fmt.Errorf("invalid name format")
+	}
+	return v.readPEM(ctx, fmt.Sprintf("/pki-user/%s/cert/crl", name), "X509 CRL")
+}
+
+// ReadIssuer returns the DER encoded CA certificate of the PKI of a user.
+func (v *vault) ReadIssuer(ctx context.Context, name string) ([]byte, error) {
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		log.WithField("name", name).Error("Invalid name format.")
+		return nil, fmt.Errorf("invalid name format")
+	}
+	return v.readPEM(ctx, fmt.Sprintf("/pki-user/%s/cert/ca", name), "CERTIFICATE")
+}
+
+// ReadRootCA returns the DER encoded certificate of the root pki mount, which signs the user PKIs
+// and the certificate of the CA administrator.
+func (v *vault) ReadRootCA(ctx context.Context) ([]byte, error) {
+	return v.readPEM(ctx, "/pki/cert/ca", "CERTIFICATE")
+}
+
+// readPEM reads a certificate or CRL from a PKI mount, which returns PEM.
+func (v *vault) readPEM(ctx context.Context, p string, blockType string) ([]byte, error) {
+	l := log.WithField("path", p)
+	sec, err := v.c.Read(p)
+	if err != nil {
+		l.WithError(err).Error("Failed to read from PKI.")
+		return nil, err
+	}
+	if sec == nil {
+		return nil, errCertNotFound
+	}
+	pemStr, _ := sec.Data["certificate"].(string)
+	b, _ := pem.Decode([]byte(pemStr))
+	if b == nil || b.Type != blockType {
+		return nil, fmt.Errorf("no %s in vault response", blockType)
+	}
+	return b.Bytes, nil
+}
+
+// SignOCSPResponder has the PKI of a user sign a delegated OCSP responder certificate for csr.
+func (v *vault) SignOCSPResponder(ctx context.Context, name string, csr string, ttl time.Duration) (string, error) {
+	l := log.WithField("name", name)
+	if !regexp.MustCompile(alphanumeric).MatchString(name) {
+		l.Error("Invalid name format.")
+		return "", fmt.Errorf("invalid name format")
+	}
+	sec, err := v.c.Write(fmt.Sprintf("/pki-user/%s/sign-verbatim", name), map[string]interface{}{
+		"csr":           csr,
+		"ttl":           ttl.String(),
+		"key_usage":     "DigitalSignature",
+		"ext_key_usage": "OCSPSigning",
+		"format":        "pem",
+	})
+	if err != nil {
+		l.WithError(err).Error("Failed to sign OCSP responder certificate.")
+		return "", err
+	}
+	if sec == nil {
+		return "", fmt.Errorf("empty response from vault")
+	}
+	c, _ := sec.Data["certificate"].(string)
+	if c == "" {
+		return "", fmt.Errorf("no certificate in vault response")
+	}
+	return c, nil
+}
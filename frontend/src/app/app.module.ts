@@ -7,6 +7,7 @@ import { UserDetailComponent } from './user-detail/user-detail.component';
 import {MatButtonModule, MatDialogModule, MatFormFieldModule, MatInputModule, MatSnackBarModule} from '@angular/material';
 import {ReactiveFormsModule} from '@angular/forms';
 import { ChangePasswordDialogComponent } from './change-password-dialog/change-password-dialog.component';
+import { ExportCertificateDialogComponent } from './export-certificate-dialog/export-certificate-dialog.component';
 import {HttpClientModule} from '@angular/common/http';
 import {OAuthModule} from 'angular-oauth2-oidc';
 import { HomeComponent } from './home/home.component';
@@ -18,6 +19,7 @@ import {APP_ROUTES} from './app.routes';
     AppComponent,
     UserDetailComponent,
     ChangePasswordDialogComponent,
+    ExportCertificateDialogComponent,
     HomeComponent
   ],
   imports: [
@@ -39,7 +41,8 @@ import {APP_ROUTES} from './app.routes';
     RouterModule.forRoot(APP_ROUTES)
   ],
   entryComponents: [
-    ChangePasswordDialogComponent
+    ChangePasswordDialogComponent,
+    ExportCertificateDialogComponent
   ],
   providers: [],
   bootstrap: [AppComponent]
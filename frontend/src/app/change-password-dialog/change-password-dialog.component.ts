@@ -10,6 +10,7 @@ import {ChangePasswordDialogData} from '../entities/changePasswordDialogData';
 })
 export class ChangePasswordDialogComponent implements OnInit {
 
+  currentPasswordField = new FormControl('');
   newPasswordField = new FormControl('');
 
   constructor(
@@ -21,6 +22,7 @@ export class ChangePasswordDialogComponent implements OnInit {
 
   changePassword() {
     // password has to be changed - either here or send back to user UserDetailComponent
+    this.data.currentPassword = this.currentPasswordField.value;
     this.data.newPassword = this.newPasswordField.value;
     this.dialogRef.close(this.data);
   }
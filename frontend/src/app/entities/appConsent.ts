@@ -0,0 +1,10 @@
+export class AppConsent {
+  clientId: string;
+  clientName: string;
+  logoUri?: string;
+  scopes: string[];
+  audience: string[];
+  grantedAt: string;
+  // Not set if the consent is remembered until revoked.
+  expiresAt?: string;
+}
@@ -0,0 +1,10 @@
+export class Certificate {
+  serial: string;
+  subject: string;
+  notBefore: string;
+  notAfter: string;
+  revoked: boolean;
+  revokedAt?: string;
+  // RFC 5280 reason name, e.g. keyCompromise.
+  reason?: string;
+}
@@ -1,3 +1,4 @@
 export class ChangePasswordDialogData {
+  currentPassword: string;
   newPassword: string;
 }
@@ -0,0 +1,4 @@
+export class ExportCertificateDialogData {
+  password: string;
+  legacy: boolean;
+}
@@ -0,0 +1,10 @@
+export class RecoveryRequest {
+  id: number;
+  uid: string;
+  serial: string;
+  // pending, approved, rejected or completed.
+  status: string;
+  requestedAt: string;
+  decidedBy?: string;
+  decidedAt?: string;
+}
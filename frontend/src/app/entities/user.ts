@@ -3,4 +3,7 @@ export class User {
   firstName: string;
   lastName: string;
   email: string;
+  emailVerified?: boolean;
+  // New address waiting for verification, the old one stays in use until then.
+  pendingEmail?: string;
 }
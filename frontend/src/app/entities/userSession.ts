@@ -0,0 +1,6 @@
+export class UserSession {
+  id: string;
+  // The ids of the clients used in the session.
+  clients: string[];
+  lastActive: string;
+}
@@ -0,0 +1,33 @@
+import {Component, Inject, OnInit} from '@angular/core';
+import {FormControl} from '@angular/forms';
+import {MAT_DIALOG_DATA, MatDialogRef} from '@angular/material';
+import {ExportCertificateDialogData} from '../entities/exportCertificateDialogData';
+
+@Component({
+  selector: 'app-export-certificate-dialog',
+  templateUrl: './export-certificate-dialog.component.html',
+  styleUrls: ['./export-certificate-dialog.component.css']
+})
+export class ExportCertificateDialogComponent implements OnInit {
+
+  passwordField = new FormControl('');
+  legacyField = new FormControl(false);
+
+  constructor(
+    public dialogRef: MatDialogRef<ExportCertificateDialogComponent>,
+    @Inject(MAT_DIALOG_DATA) public data: ExportCertificateDialogData) { }
+
+  ngOnInit() {
+  }
+
+  export() {
+    this.data.password = this.passwordField.value;
+    this.data.legacy = this.legacyField.value;
+    this.dialogRef.close(this.data);
+  }
+
+  cancelAndCloseDialog() {
+    this.dialogRef.close(-1);
+  }
+
+}
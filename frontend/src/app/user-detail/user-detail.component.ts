@@ -4,7 +4,11 @@ import {FormControl, Validators} from '@angular/forms';
 import {MatDialog, MatSnackBar} from '@angular/material';
 import {ChangePasswordDialogComponent} from '../change-password-dialog/change-password-dialog.component';
 import {ChangePasswordDialogData} from '../entities/changePasswordDialogData';
+import {ExportCertificateDialogComponent} from '../export-certificate-dialog/export-certificate-dialog.component';
+import {ExportCertificateDialogData} from '../entities/exportCertificateDialogData';
 import {UserService} from '../user.service';
+import {Certificate} from '../entities/certificate';
+import {RecoveryRequest} from '../entities/recoveryRequest';
 
 @Component({
   selector: 'app-user-detail',
@@ -19,8 +23,6 @@ export class UserDetailComponent implements OnInit {
 
   @ViewChild('downloadCertLink', {static: false}) private downloadCertLink: ElementRef;
 
-  certificate: string;
-
   public userInfo: User = {
     uid: '',
     firstName: '',
@@ -30,6 +32,11 @@ export class UserDetailComponent implements OnInit {
 
   public editEnabled = false;
 
+  public certificates: Certificate[] = [];
+  public recoveries: RecoveryRequest[] = [];
+  public revocationReasons = ['unspecified', 'keyCompromise', 'affiliationChanged', 'superseded', 'cessationOfOperation'];
+  revocationReasonField = new FormControl('unspecified');
+
   firstNameField = new FormControl('');
   lastNameField = new FormControl('');
   emailField = new FormControl('', [Validators.required, Validators.email]);
@@ -55,6 +62,12 @@ export class UserDetailComponent implements OnInit {
         this.emailField.setValue(this.userInfo.email);
       }
     });
+    this.loadCertificates();
+  }
+
+  loadCertificates() {
+    this.userService.listCertificates().subscribe(certs => this.certificates = certs);
+    this.userService.listKeyRecoveries().subscribe(reqs => this.recoveries = reqs);
   }
 
   enableEditUserInfo() {
@@ -69,10 +82,14 @@ export class UserDetailComponent implements OnInit {
       email: this.emailField.value,
     };
     this.userService.saveUserInfo(modifiedUser)
-      .subscribe(success => {
-        if (success) {
-          this.userInfo = modifiedUser;
+      .subscribe(user => {
+        if (user) {
+          this.userInfo = user;
+          this.emailField.setValue(user.email);
           this.editEnabled = false;
+          if (user.pendingEmail === modifiedUser.email) {
+            this.snackbar.open('We sent a link to ' + user.pendingEmail + ' to verify the new address', 'OK');
+          }
         }
       });
   }
@@ -84,6 +101,7 @@ export class UserDetailComponent implements OnInit {
   startChangePasswordProcess() {
     const dialogRef = this.dialog.open(ChangePasswordDialogComponent, {
       data: {
+        currentPassword: null,
         newPassword: null
       }
     });
@@ -91,35 +109,98 @@ export class UserDetailComponent implements OnInit {
       if (result !== -1) {
         // user wants to change password - result is of type ChangePasswordDialogData
         const passwordData = (result as ChangePasswordDialogData);
-        this.userService.changeUserPassword(this.uid, passwordData.newPassword).subscribe();
+        this.userService.changeUserPassword(this.uid, passwordData.currentPassword, passwordData.newPassword).subscribe(
+          () => this.snackbar.open('Your password has been changed', '', {duration: 3000}),
+          err => {
+            // The body is not parsed, since the request expects a text response.
+            let message = 'Failed to change password';
+            try {
+              message = JSON.parse(err.error).violations.map(v => v.message).join(' ');
+            } catch (e) {
+            }
+            this.snackbar.open(message, 'OK');
+          });
       } // else: user cancelled change password request / nothing has to be done
     });
   }
 
   issueCertificate() {
-    this.userService.issueCertificate().subscribe(res => this.certificate = res);
+    this.askExportPassword(exportData =>
+      this.userService.issueCertificate(exportData.password, exportData.legacy).subscribe(
+        res => this.saveBundle(res),
+        () => this.snackbar.open('Failed to issue certificate', 'OK')));
+  }
+
+  requestKeyRecovery(cert: Certificate) {
+    this.userService.requestKeyRecovery(cert.serial).subscribe(
+      req => {
+        const message = req.status === 'approved' ? 'You can now download the key' : 'An administrator has to approve the request';
+        this.snackbar.open(message, '', {duration: 3000});
+        this.loadCertificates();
+      },
+      err => this.snackbar.open(typeof err.error === 'string' ? err.error : 'Failed to request key recovery', 'OK'));
+  }
+
+  recoverKey(req: RecoveryRequest) {
+    this.askExportPassword(exportData =>
+      this.userService.recoverKey(req.id, exportData.password, exportData.legacy).subscribe(
+        res => this.saveBundle(res),
+        () => this.snackbar.open('Failed to recover the key', 'OK')));
+  }
+
+  private askExportPassword(then: (data: ExportCertificateDialogData) => void) {
+    const dialogRef = this.dialog.open(ExportCertificateDialogComponent, {
+      data: {
+        password: null,
+        legacy: false
+      }
+    });
+    dialogRef.afterClosed().subscribe(result => {
+      if (result && result !== -1) {
+        then(result as ExportCertificateDialogData);
+      }
+    });
   }
 
-  downloadCertificate() {
-    this.userService.downloadResource().subscribe(res => {
+  private saveBundle(res: Blob) {
+    const url = window.URL.createObjectURL(res);
+    const link = this.downloadCertLink.nativeElement;
+    link.href = url;
+    link.download = 'cert.p12';
+    link.click();
+
+    window.URL.revokeObjectURL(url);
+    this.loadCertificates();
+  }
+
+  downloadCertificate(cert: Certificate) {
+    this.userService.downloadCertificate(cert.serial).subscribe(res => {
       const url = window.URL.createObjectURL(res);
       const link = this.downloadCertLink.nativeElement;
       link.href = url;
-      link.download = 'cert.p12';
+      link.download = cert.serial.replace(/:/g, '') + '.pem';
       link.click();
 
       window.URL.revokeObjectURL(url);
-
     });
   }
 
+  revokeSingleCertificate(cert: Certificate) {
+    this.userService.revokeCertificate(cert.serial, this.revocationReasonField.value).subscribe(
+      () => {
+        this.snackbar.open('The certificate has been revoked', '', {duration: 3000});
+        this.loadCertificates();
+      },
+      () => this.snackbar.open('Failed to revoke the certificate', 'OK'));
+  }
+
   revokeCertificate() {
     this.userService.revokeCertificates().subscribe(success => {
       if (success) {
-        this.certificate = null;
         const snackBarRef = this.snackbar.open('All certificates have been revoked', '', {
           duration: 3000,
         });
+        this.loadCertificates();
       }
     });
   }
@@ -1,6 +1,10 @@
 import { Injectable } from '@angular/core';
 import {Observable} from 'rxjs';
 import {User} from './entities/user';
+import {Certificate} from './entities/certificate';
+import {RecoveryRequest} from './entities/recoveryRequest';
+import {AppConsent} from './entities/appConsent';
+import {UserSession} from './entities/userSession';
 import {HttpClient, HttpHeaders} from '@angular/common/http';
 import {OAuthService} from 'angular-oauth2-oidc';
 import {map} from 'rxjs/operators';
@@ -25,8 +29,21 @@ export class UserService {
     });
   }
 
-  saveUserInfo(userInfo: User): Observable<boolean> {
-    return this.http.put(this.baseUrl + 'user', userInfo, {
+  /**
+   * Returns the saved user. A changed email address is only pending until it has been verified.
+   */
+  saveUserInfo(userInfo: User): Observable<User> {
+    return this.http.put<User>(this.baseUrl + 'user', userInfo, {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+    });
+  }
+
+  /**
+   * Fails with an HttpErrorResponse whose error lists the violated password rules if the
+   * current password is wrong or the new one does not satisfy the policy.
+   */
+  changeUserPassword(userId: string, currentPassword: string, newPassword: string): Observable<boolean> {
+    return this.http.put(this.baseUrl + 'user/password', {currentPassword, password: newPassword}, {
       headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
       responseType: 'text',
       observe: 'response'
@@ -37,8 +54,58 @@ export class UserService {
     );
   }
 
-  changeUserPassword(userId: string, newPassword: string): Observable<boolean> {
-    return this.http.put(this.baseUrl + 'user/password', {password: newPassword}, {
+  /**
+   * Issues a new key and certificate, returned as PKCS#12 protected by password. The legacy
+   * profile uses 3DES for systems which do not support AES encrypted bundles.
+   */
+  issueCertificate(password: string, legacy: boolean): Observable<Blob> {
+    return this.http.post(this.baseUrl + 'cert/pkcs12', {password, profile: legacy ? 'legacy' : 'modern'}, {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+      responseType: 'blob'});
+  }
+
+  listCertificates(): Observable<Certificate[]> {
+    return this.http.get<Certificate[]>(this.baseUrl + 'certs', {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+    });
+  }
+
+  downloadCertificate(serial: string): Observable<Blob> {
+    return this.http.get(this.baseUrl + 'certs/' + encodeURIComponent(serial), {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+      responseType: 'blob'});
+  }
+
+  revokeCertificate(serial: string, reason: string): Observable<Certificate> {
+    return this.http.delete<Certificate>(this.baseUrl + 'certs/' + encodeURIComponent(serial), {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+      params: {reason},
+    });
+  }
+
+  requestKeyRecovery(serial: string): Observable<RecoveryRequest> {
+    return this.http.post<RecoveryRequest>(this.baseUrl + 'certs/' + encodeURIComponent(serial) + '/recovery', null, {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+    });
+  }
+
+  listKeyRecoveries(): Observable<RecoveryRequest[]> {
+    return this.http.get<RecoveryRequest[]>(this.baseUrl + 'recovery', {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+    });
+  }
+
+  /**
+   * Downloads the recovered key of an approved request as PKCS#12. Every approval can only be used once.
+   */
+  recoverKey(id: number, password: string, legacy: boolean): Observable<Blob> {
+    return this.http.post(this.baseUrl + 'recovery/' + id + '/pkcs12', {password, profile: legacy ? 'legacy' : 'modern'}, {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+      responseType: 'blob'});
+  }
+
+  revokeCertificates(): Observable<boolean> {
+    return this.http.delete(this.baseUrl + 'cert', {
       headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
       responseType: 'text',
       observe: 'response'
@@ -49,26 +116,39 @@ export class UserService {
     );
   }
 
-  issueCertificate(): Observable<string> {
-    return this.http.get(this.baseUrl + 'cert', {
+  listConsents(): Observable<AppConsent[]> {
+    return this.http.get<AppConsent[]>(this.baseUrl + 'user/consents', {
       headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
-      responseType: 'text'
+    });
+  }
+
+  /**
+   * Revokes the access of the client, or of all clients if none is given, and the tokens issued to them.
+   */
+  revokeConsent(clientId?: string): Observable<boolean> {
+    const url = this.baseUrl + 'user/consents' + (clientId ? '/' + encodeURIComponent(clientId) : '');
+    return this.http.delete(url, {
+      headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
+      responseType: 'text',
+      observe: 'response'
     }).pipe(
-      map(res => {
-        return res;
+      map(response => {
+        return response.ok;
       })
     );
   }
 
-
-  public downloadResource(): Observable<Blob> {
-    return this.http.get(this.baseUrl + 'cert', {
+  listSessions(): Observable<UserSession[]> {
+    return this.http.get<UserSession[]>(this.baseUrl + 'user/sessions', {
       headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
-      responseType: 'blob'});
+    });
   }
 
-  revokeCertificates(): Observable<boolean> {
-    return this.http.delete(this.baseUrl + 'cert', {
+  /**
+   * Logs out of all browsers. Tokens already issued stay valid until they expire or consent is revoked.
+   */
+  revokeSessions(): Observable<boolean> {
+    return this.http.delete(this.baseUrl + 'user/sessions', {
       headers: new HttpHeaders('Authorization: Bearer ' + this.oauthService.getIdToken()),
       responseType: 'text',
       observe: 'response'